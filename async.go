@@ -0,0 +1,157 @@
+package caskdb
+
+import "sync"
+
+// QueueFullPolicy decides what SetAsync does when the async queue has no free slot.
+type QueueFullPolicy int
+
+const (
+	// BlockWhenFull makes SetAsync wait till the background writer frees up a slot.
+	// This applies backpressure to the caller and never loses a write.
+	BlockWhenFull QueueFullPolicy = iota
+	// RejectWhenFull makes SetAsync return ErrQueueFull immediately, leaving it to
+	// the caller to retry, fall back to Set or drop the write.
+	RejectWhenFull
+)
+
+// asyncWrite is a single SetAsync request waiting in the queue
+type asyncWrite struct {
+	key   string
+	value string
+}
+
+// pendingWrites has the latest value of every key with a SetAsync write still in the
+// queue, see WithAsyncReadYourWrites. It has its own lock, SetAsync doesn't take the
+// store's lock.
+type pendingWrites struct {
+	mu     sync.Mutex
+	writes map[string]pendingWrite
+}
+
+// pendingWrite is the latest queued value of a key, and the number of the queued
+// writes of the key. The key is forgotten once all of them are written.
+type pendingWrite struct {
+	value  string
+	queued int
+}
+
+func newPendingWrites() *pendingWrites {
+	return &pendingWrites{writes: make(map[string]pendingWrite)}
+}
+
+// add records a write of the key being queued, and returns what the key had before
+// so that it can be undone. The caller must hold the lock.
+func (p *pendingWrites) add(key, value string) (pendingWrite, bool) {
+	prev, ok := p.writes[key]
+	p.writes[key] = pendingWrite{value, prev.queued + 1}
+	return prev, ok
+}
+
+// undo reverts the add of a write which didn't make it to the queue. The caller must
+// hold the lock.
+func (p *pendingWrites) undo(key string, prev pendingWrite, ok bool) {
+	if ok {
+		p.writes[key] = prev
+	} else {
+		delete(p.writes, key)
+	}
+}
+
+// done records a queued write of the key as written, or failed
+func (p *pendingWrites) done(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.writes[key]
+	if w.queued <= 1 {
+		delete(p.writes, key)
+		return
+	}
+	w.queued--
+	p.writes[key] = w
+}
+
+// get returns the latest queued value of the key
+func (p *pendingWrites) get(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w, ok := p.writes[key]
+	return w.value, ok
+}
+
+// SetAsync queues the key and value to be written to the disk by a background
+// writer and returns without waiting for the write. The writes are applied in the
+// order they were queued. Until the background writer gets to it, the key is not
+// visible to Get, unless the store was opened with WithAsyncReadYourWrites.
+//
+// The queue is bounded by WithAsyncQueueSize. When it is full, SetAsync blocks or
+// returns ErrQueueFull as per WithAsyncFullPolicy. Both the cases are counted in
+// Metrics, which helps in sizing the queue.
+//
+// A key which can't be written, see WithUTF8Keys, is rejected right away, like Set
+// does, instead of failing later in the background writer.
+//
+// SetAsync must not be called after Close.
+func (d *DiskStore) SetAsync(key string, value string) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	w := asyncWrite{key, value}
+	if d.pending != nil {
+		return d.setAsyncPending(w)
+	}
+	select {
+	case d.asyncQueue <- w:
+		return nil
+	default:
+	}
+	// the queue is full
+	if d.opts.asyncFullPolicy == RejectWhenFull {
+		d.metrics.asyncDropped.Add(1)
+		return ErrQueueFull
+	}
+	d.metrics.asyncBlocked.Add(1)
+	d.asyncQueue <- w
+	return nil
+}
+
+// setAsyncPending is SetAsync with WithAsyncReadYourWrites. The write is added to
+// the pending writes before it is queued, the writer could get to it right away.
+func (d *DiskStore) setAsyncPending(w asyncWrite) error {
+	p := d.pending
+	p.mu.Lock()
+	prev, ok := p.add(w.key, w.value)
+	select {
+	case d.asyncQueue <- w:
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+	// the queue is full
+	if d.opts.asyncFullPolicy == RejectWhenFull {
+		// nothing else touched the key, we held the lock all along
+		p.undo(w.key, prev, ok)
+		p.mu.Unlock()
+		d.metrics.asyncDropped.Add(1)
+		return ErrQueueFull
+	}
+	// the lock is not held while waiting, the writer needs it to make progress
+	p.mu.Unlock()
+	d.metrics.asyncBlocked.Add(1)
+	d.asyncQueue <- w
+	return nil
+}
+
+// runAsyncWriter drains the async queue till it is closed. There is exactly one
+// writer per store, which keeps the writes in the order they were queued.
+func (d *DiskStore) runAsyncWriter() {
+	defer close(d.asyncDone)
+	for w := range d.asyncQueue {
+		if err := d.Set(w.key, w.value); err != nil {
+			d.metrics.asyncFailed.Add(1)
+		}
+		// the key is in the keyDir now, or the write failed and it never will be
+		if d.pending != nil {
+			d.pending.done(w.key)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SetAsync(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if err := store.SetAsync("name", "jojo"); err != nil {
+		t.Fatalf("SetAsync() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if val, _ := store.Get("name"); val != "jojo" {
+		t.Errorf("Get() = %v, want %v", val, "jojo")
+	}
+	store.Close()
+}
+
+func TestDiskStore_SetAsyncRejectWhenFull(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAsyncQueueSize(4), WithAsyncFullPolicy(RejectWhenFull))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	// holding the lock stalls the background writer, so the queue fills up
+	store.mu.Lock()
+	// the writer picks up the first write and waits on the lock, the rest stay queued
+	store.SetAsync("stuck", "value")
+	waitForQueueDepth(t, store, 0)
+	for i := 1; i <= 4; i++ {
+		if err := store.SetAsync("key", "value"); err != nil {
+			t.Fatalf("SetAsync() error = %v", err)
+		}
+		if depth := store.Metrics().AsyncQueueDepth; depth != i {
+			t.Errorf("Metrics().AsyncQueueDepth = %v, want %v", depth, i)
+		}
+	}
+	if err := store.SetAsync("key", "dropped"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("SetAsync() error = %v, want %v", err, ErrQueueFull)
+	}
+	m := store.Metrics()
+	if m.AsyncDropped != 1 {
+		t.Errorf("Metrics().AsyncDropped = %v, want %v", m.AsyncDropped, 1)
+	}
+	if m.AsyncQueueSize != 4 {
+		t.Errorf("Metrics().AsyncQueueSize = %v, want %v", m.AsyncQueueSize, 4)
+	}
+	store.mu.Unlock()
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("key"); val != "value" {
+		t.Errorf("Get() = %v, want %v", val, "value")
+	}
+}
+
+func TestDiskStore_SetAsyncBlockWhenFull(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAsyncQueueSize(1), WithAsyncFullPolicy(BlockWhenFull))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.mu.Lock()
+	store.SetAsync("stuck", "value")
+	waitForQueueDepth(t, store, 0)
+	store.SetAsync("queued", "value")
+
+	done := make(chan error)
+	go func() {
+		done <- store.SetAsync("blocked", "value")
+	}()
+	select {
+	case <-done:
+		t.Fatalf("SetAsync() returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	store.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Errorf("SetAsync() error = %v", err)
+	}
+	if blocked := store.Metrics().AsyncBlocked; blocked != 1 {
+		t.Errorf("Metrics().AsyncBlocked = %v, want %v", blocked, 1)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("blocked"); val != "value" {
+		t.Errorf("Get() = %v, want %v", val, "value")
+	}
+}
+
+// waitForQueueDepth waits till the background writer has picked up the queued
+// writes, leaving behind depth of them
+func waitForQueueDepth(t *testing.T, store *DiskStore, depth int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for store.Metrics().AsyncQueueDepth != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("Metrics().AsyncQueueDepth = %v, want %v", store.Metrics().AsyncQueueDepth, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDiskStore_WithAsyncReadYourWrites(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithAsyncQueueSize(1), WithAsyncFullPolicy(RejectWhenFull), WithAsyncReadYourWrites())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	// holding the lock stalls the background writer, nothing gets flushed
+	store.mu.Lock()
+	store.SetAsync("name", "jojo")
+	waitForQueueDepth(t, store, 0)
+	if err := store.SetAsync("name", "dio"); err != nil {
+		t.Fatalf("SetAsync() error = %v", err)
+	}
+	if err := store.SetAsync("name", "dropped"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("SetAsync() error = %v, want %v", err, ErrQueueFull)
+	}
+	if val, err := store.Get("name"); val != "dio" {
+		t.Errorf("Get() before the flush = %v, %v, want %v", val, err, "dio")
+	}
+	if val, intact, err := store.GetChecked("name"); val != "dio" || !intact || err != nil {
+		t.Errorf("GetChecked() before the flush = %v, %v, %v, want %v, true, nil", val, intact, err, "dio")
+	}
+	store.mu.Unlock()
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("name"); val != "dio" {
+		t.Errorf("Get() = %v, want %v", val, "dio")
+	}
+}
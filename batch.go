@@ -0,0 +1,147 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Batch collects the writes to apply to the store together, for the bulk loads:
+//
+//	b := store.NewBatch()
+//	for _, book := range books {
+//		b.Set(book.title, book.author)
+//	}
+//	err := b.Commit()
+//
+// Nothing is written till Commit, which writes all the records with a single write
+// and fsync, and then updates the keyDir with all of them in one pass, under a
+// single acquisition of the write lock. The individual Sets take the lock, sync and
+// update the keyDir once per key, which adds up for the large loads.
+//
+// The writes are applied in the order they were added, a later write of a key wins.
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	store *DiskStore
+	ops   []batchOp
+}
+
+// batchOp is a single write of a Batch
+type batchOp struct {
+	flags uint8
+	key   string
+	value string
+}
+
+// NewBatch returns an empty Batch of writes to the store.
+func (d *DiskStore) NewBatch() *Batch {
+	return &Batch{store: d}
+}
+
+// Set adds the write of the key and value to the batch.
+func (b *Batch) Set(key string, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds the delete of the key to the batch. Unlike DiskStore.Delete, the
+// tombstone is written even if the key doesn't exist, the batch doesn't look at the
+// store till Commit.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{flags: flagTombstone, key: key})
+}
+
+// Len returns the number of the writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the store, and empties it. The records are durable, and
+// visible to Get, once Commit returns. On an error, none of the writes are visible,
+// and the batch is left as it was.
+func (b *Batch) Commit() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	d := b.store
+	timestamp := uint64(time.Now().Unix())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	headers := make([]recordHeader, len(b.ops))
+	var flags uint8
+	for i, op := range b.ops {
+		if err := d.checkKey(op.key); err != nil {
+			return err
+		}
+		headers[i] = recordHeader{timestamp: timestamp, flags: op.flags}
+		headers[i].flags |= d.compressFlag(op.flags)
+		flags |= headers[i].flags
+	}
+	if err := d.supportFlags(flags); err != nil {
+		return err
+	}
+	data, sizes := d.encodeBatch(headers, b.ops)
+	if err := d.reserve(len(data)); err != nil {
+		return err
+	}
+	write := d.write
+	if d.wal != nil {
+		write = d.writeWAL
+	}
+	if err := write(data); err != nil {
+		return err
+	}
+	// the records are durable, all of them go to the keyDir in one pass
+	d.indexRecords(headers, b.ops, data, sizes)
+	b.ops = nil
+	return indexErr(d.keyDir)
+}
+
+// encodeBatch encodes the records of the batch, with the headers, into a single
+// buffer in the format of the file. The buffer is allocated once, at the total size
+// of the records worked out up front, there are no reallocations or copies while
+// appending. It also returns the size of each record. The caller must hold the write
+// lock.
+func (d *DiskStore) encodeBatch(headers []recordHeader, ops []batchOp) ([]byte, []int) {
+	var prev uint32
+	if d.digest != nil {
+		prev = d.digest.sum
+	}
+	data, sizes, _ := d.encodeBatchIn(d.version, prev, headers, ops)
+	return data, sizes
+}
+
+// encodeBatchIn is encodeBatch in the given format version. With WithDigest, every
+// record links to the one before it, see flagChained, the first one to prev. It also
+// returns the checksum of the last record, for the next one to link to.
+func (d *DiskStore) encodeBatchIn(version uint32, prev uint32, headers []recordHeader, ops []batchOp) ([]byte, []int, uint32) {
+	values := make([]string, 0, len(ops))
+	total := 0
+	chained := d.digest != nil && version != formatV1
+	for i, op := range ops {
+		if chained {
+			headers[i].flags |= flagChained
+		}
+		value := op.value
+		if headers[i].flags&flagCompressed != 0 {
+			value = compressValue(value)
+		}
+		values = append(values, value)
+		total += recordSize(headers[i], op.key, value, version)
+	}
+	data := make([]byte, 0, total)
+	sizes := make([]int, len(ops))
+	for i, op := range ops {
+		start := len(data)
+		if chained {
+			headers[i].chain = prev
+		}
+		data = appendRecordIn(version, data, headers[i], op.key, values[i])
+		sizes[i] = len(data) - start
+		if chained {
+			prev = binary.LittleEndian.Uint32(data[start : start+4])
+		}
+	}
+	return data, sizes, prev
+}
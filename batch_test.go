@@ -0,0 +1,134 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBatch_Commit(t *testing.T) {
+	dir := t.TempDir()
+	single, err := NewDiskStore(filepath.Join(dir, "single.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer single.Close()
+	batched, err := NewDiskStore(filepath.Join(dir, "batched.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+
+	b := batched.NewBatch()
+	for i := 0; i < 1000; i++ {
+		key, val := fmt.Sprintf("key-%d", i%800), fmt.Sprintf("value-%d", i)
+		single.Set(key, val)
+		b.Set(key, val)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		single.Delete(key)
+		b.Delete(key)
+	}
+	if got, _ := batched.Get("key-200"); got != "" {
+		t.Errorf("Get() before Commit() = %v, want nothing", got)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Len() after Commit() = %v, want 0", b.Len())
+	}
+	if got, want := batched.Metrics().KeyDirPasses, uint64(1); got != want {
+		t.Errorf("Metrics().KeyDirPasses = %v, want %v", got, want)
+	}
+	if got := single.Metrics().KeyDirPasses; got != 1100 {
+		t.Errorf("Metrics().KeyDirPasses of the single writes = %v, want %v", got, 1100)
+	}
+
+	check := func(store *DiskStore) {
+		if got, want := len(store.Keys()), len(single.Keys()); got != want {
+			t.Errorf("len(Keys()) = %v, want %v", got, want)
+		}
+		for _, key := range single.Keys() {
+			want, _ := single.Get(key)
+			got, _ := store.Get(key)
+			if got != want {
+				t.Errorf("Get(%v) = %v, want %v", key, got, want)
+			}
+		}
+	}
+	check(batched)
+	entries := make(map[string]KeyEntry)
+	batched.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		entries[key] = kEntry
+		return true
+	})
+	batched.Close()
+
+	// the keyDir loaded from the file is the one the batch built
+	batched, err = NewDiskStore(filepath.Join(dir, "batched.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer batched.Close()
+	check(batched)
+	loaded := make(map[string]KeyEntry)
+	batched.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		loaded[key] = kEntry
+		return true
+	})
+	if !reflect.DeepEqual(loaded, entries) {
+		t.Errorf("keyDir after reopen differs from the one after Commit()")
+	}
+}
+
+func TestDiskStore_encodeBatch(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	b := store.NewBatch()
+	for i := 0; i < 1000; i++ {
+		b.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	headers := make([]recordHeader, b.Len())
+	// the values, the sizes and the combined buffer, whatever the number of records
+	allocs := testing.AllocsPerRun(10, func() {
+		store.encodeBatch(headers, b.ops)
+	})
+	if allocs != 3 {
+		t.Errorf("encodeBatch() allocations = %v, want %v", allocs, 3)
+	}
+	data, sizes := store.encodeBatch(headers, b.ops)
+	offset := 0
+	for i, op := range b.ops {
+		size, want := encodeKV(0, op.key, op.value)
+		if sizes[i] != size || !reflect.DeepEqual(data[offset:offset+size], want) {
+			t.Fatalf("encodeBatch() record %d = %v, want %v", i, data[offset:offset+sizes[i]], want)
+		}
+		offset += size
+	}
+	if cap(data) != len(data) {
+		t.Errorf("encodeBatch() buffer capacity = %v, want the size %v", cap(data), len(data))
+	}
+}
+
+func BenchmarkBatch_Commit(b *testing.B) {
+	store, err := NewDiskStore(filepath.Join(b.TempDir(), "test.db"))
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		batch := store.NewBatch()
+		for j := 0; j < 1000; j++ {
+			batch.Set(fmt.Sprintf("key-%d", j), "value")
+		}
+		if err := batch.Commit(); err != nil {
+			b.Fatalf("Commit() error = %v", err)
+		}
+	}
+}
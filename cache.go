@@ -0,0 +1,101 @@
+package caskdb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// readCache is an LRU cache of the values, so that the hot keys are served without
+// going to the disk at all. Every cached value remembers the KeyEntry it was read
+// from, and it is a hit only if the keyDir still points to the same record. So an
+// overwritten key is never served stale, no matter how the cache is invalidated.
+//
+// Gets run concurrently under the store's read lock, and all of them update the
+// LRU order, so the cache has a lock of its own.
+type readCache struct {
+	mu       sync.Mutex
+	capacity int
+	// ttl is how long a value is served from the cache before it is read again from
+	// the disk. Zero means forever
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheItem struct {
+	key      string
+	value    string
+	kEntry   KeyEntry
+	cachedAt time.Time
+}
+
+func newReadCache(capacity int, ttl time.Duration) *readCache {
+	return &readCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached value of the key, if it was read from the record kEntry
+// points to and it is not older than the ttl
+func (c *readCache) get(key string, kEntry KeyEntry) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	item := elem.Value.(*cacheItem)
+	if item.kEntry != kEntry || (c.ttl > 0 && time.Since(item.cachedAt) > c.ttl) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return item.value, true
+}
+
+func (c *readCache) put(key string, value string, kEntry KeyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.items[key] = c.order.PushFront(&cacheItem{key, value, kEntry, time.Now()})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+func (c *readCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// reset empties the cache
+func (c *readCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// ResetCache empties the read cache, so the next Get of every key goes to the disk,
+// like after a restart. It is a no-op if the cache is disabled. It is safe to call
+// concurrently with the reads and the writes.
+func (d *DiskStore) ResetCache() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.cache != nil {
+		d.cache.reset()
+	}
+}
@@ -0,0 +1,113 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Cache(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+
+	store.Get("hamlet")
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if m := store.Metrics(); m.CacheHits != 1 || m.CacheMisses != 1 {
+		t.Errorf("Metrics() hits, misses = %v, %v, want 1, 1", m.CacheHits, m.CacheMisses)
+	}
+	// an overwritten key is read again from the disk
+	store.Set("hamlet", "shakespeare!")
+	if val, _ := store.Get("hamlet"); val != "shakespeare!" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare!")
+	}
+	// dune and othello push hamlet out of the cache
+	store.Get("dune")
+	store.Get("othello")
+	before := store.Metrics().CacheMisses
+	store.Get("hamlet")
+	if misses := store.Metrics().CacheMisses; misses != before+1 {
+		t.Errorf("Metrics().CacheMisses = %v, want %v", misses, before+1)
+	}
+}
+
+func TestDiskStore_CacheTTL(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithCacheSize(10), WithCacheTTL(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Get("hamlet")
+
+	// another process rewrites the record in place
+	kEntry, _ := store.keyDir.get("hamlet")
+	_, data := encodeKV(kEntry.timestamp, "hamlet", "marlowe!!!!")
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	file.WriteAt(data, int64(kEntry.position))
+	file.Close()
+
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want the cached %v", val, "shakespeare")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if val, _ := store.Get("hamlet"); val != "marlowe!!!!" {
+		t.Errorf("Get() = %v, want %v", val, "marlowe!!!!")
+	}
+}
+
+func TestDiskStore_CacheMerge(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithCacheSize(10))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "aaa")
+	store.Get("othello")
+	// the merged record lands where the cached one was
+	store.Set("othello", "bbb")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if got, _ := store.Get("othello"); got != "bbb" {
+		t.Errorf("Get() after Merge() = %v, want %v", got, "bbb")
+	}
+}
+
+func TestDiskStore_ResetCache(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Get("hamlet")
+	store.Get("hamlet")
+
+	store.ResetMetrics()
+	if m := store.Metrics(); m != (Metrics{AsyncQueueSize: m.AsyncQueueSize}) {
+		t.Errorf("Metrics() after ResetMetrics() = %+v, want the counters at zero", m)
+	}
+	store.ResetCache()
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if m := store.Metrics(); m.CacheHits != 0 || m.CacheMisses != 1 {
+		t.Errorf("Metrics() hits, misses after ResetCache() = %v, %v, want 0, 1", m.CacheHits, m.CacheMisses)
+	}
+}
@@ -0,0 +1,53 @@
+package caskdb
+
+// GetChecked is like Get, but a record which doesn't match its checksum is not an
+// error: the value is returned along with false, and it is up to the caller to
+// decide what to do with it, like serving it with a warning. The value of a corrupt
+// record is whatever is on the disk, it could be garbage. The records of formatV1
+// have no checksum, they are always reported as intact.
+//
+// GetChecked always reads from the disk, the read cache could hide a corruption
+// which happened after the value was cached. WithCorruptionFallback does not apply.
+// A write still queued with WithAsyncReadYourWrites is returned as intact.
+func (d *DiskStore) GetChecked(key string) (string, bool, error) {
+	if d.opts.indexOnly {
+		return "", false, ErrValuesDisabled
+	}
+	// a queued write is newer than anything on the disk, and it has not been
+	// written to be corrupt
+	if d.pending != nil {
+		if value, ok := d.pending.get(key); ok {
+			return value, true, nil
+		}
+	}
+	if err := d.reloadEvicted(key); err != nil {
+		return "", false, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return "", false, ErrKeyNotFound
+	}
+	d.touch(key)
+	data, version, err := d.readRecord(kEntry)
+	if err != nil {
+		return "", false, err
+	}
+	if validChecksum(data, version) {
+		_, _, value, err := d.decodeRecord(kEntry.fileID, data, version)
+		if err != nil {
+			return "", false, err
+		}
+		return value, true, nil
+	}
+	// none of the header can be trusted, but the sizes have to add up to the
+	// record's for decodeKV not to run past it
+	hSize := headerSizeOf(version)
+	h := decodeHeader(data[:hSize], version)
+	if uint64(hSize)+uint64(h.keySize)+uint64(h.valueSize) == uint64(len(data)) {
+		_, _, value := decodeKV(data, version)
+		return value, false, nil
+	}
+	return string(data[hSize+uint32(len(key)):]), false, nil
+}
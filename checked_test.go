@@ -0,0 +1,38 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_GetChecked(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if val, ok, err := store.GetChecked("dune"); err != nil || !ok || val != "frank herbert" {
+		t.Errorf("GetChecked() = %v, %v, %v, want %v, true, nil", val, ok, err, "frank herbert")
+	}
+	// cached, but the corruption is still caught
+	store.Get("hamlet")
+	kEntry, _ := store.keyDir.get("hamlet")
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte{'?'}, int64(kEntry.position+kEntry.totalSize-1)); err != nil {
+		t.Fatalf("failed to corrupt the db file: %v", err)
+	}
+	file.Close()
+	if val, ok, err := store.GetChecked("hamlet"); err != nil || ok || val != "shakespear?" {
+		t.Errorf("GetChecked() = %v, %v, %v, want %v, false, nil", val, ok, err, "shakespear?")
+	}
+	if _, _, err := store.GetChecked("othello"); err != ErrKeyNotFound {
+		t.Errorf("GetChecked() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
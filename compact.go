@@ -0,0 +1,283 @@
+package caskdb
+
+import (
+	"log"
+	"os"
+)
+
+// compactSuffix is appended to the segment name to get the name of the temporary
+// file CompactSmallSegments writes to
+const compactSuffix = ".compact"
+
+// CompactSmallSegments coalesces the runs of adjacent sealed segments, each smaller
+// than minSize bytes, into a single segment per run. Unlike Merge, it keeps all the
+// records, dead or alive, and only cuts down the number of the files, which is handy
+// after frequent rotations with WithRotateInterval left many tiny segments around.
+// Each open segment costs a file descriptor, and a file to open at the startup.
+//
+// A run is written to a temporary file, which then replaces the newest segment of the
+// run, and the older ones are removed. The records keep their order, so a crash
+// midway leaves the same data behind, only some of it twice. The active segment is
+// never touched.
+//
+// The write lock is held for the entire compaction, so call this when the store is
+// idle.
+func (d *DiskStore) CompactSmallSegments(minSize int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	var run []*segment
+	for _, seg := range d.sortedSegments() {
+		if seg.size < minSize {
+			run = append(run, seg)
+			continue
+		}
+		if err := d.coalesceSegments(run); err != nil {
+			return err
+		}
+		run = nil
+	}
+	if err := d.coalesceSegments(run); err != nil {
+		return err
+	}
+	// the blobs moved along with the refs to them
+	if err := d.rebuildBlobs(); err != nil {
+		return err
+	}
+	// the records of an older format were rewritten in the current one
+	return d.rebuildDigest()
+}
+
+// coalesceSegments writes the records of the adjacent sealed segments, oldest first,
+// in place of the newest of them, and removes the others. A run of a single segment
+// is left alone. The caller must hold the write lock.
+func (d *DiskStore) coalesceSegments(run []*segment) error {
+	if len(run) < 2 {
+		return nil
+	}
+	target := run[len(run)-1]
+	fsys := d.opts.fileSystem
+	tmpName := target.name + compactSuffix
+	tmp, err := fsys.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	moved, err := copySegments(tmp, run)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(tmpName)
+		return err
+	}
+	// the file is closed before renaming, Windows can't rename over an open file
+	target.file.Close()
+	if err := fsys.Rename(tmpName, target.name); err != nil {
+		fsys.Remove(tmpName)
+		if reopened, openErr := d.openSegment(target.id); openErr == nil {
+			reopened.newest = target.newest
+			d.segments[target.id] = reopened
+		}
+		return err
+	}
+	seg, err := d.openSegment(target.id)
+	if err != nil {
+		delete(d.segments, target.id)
+		return err
+	}
+	for _, old := range run {
+		if old.newest > seg.newest {
+			seg.newest = old.newest
+		}
+	}
+	d.segments[seg.id] = seg
+	// the keys are repointed before the older segments go away
+	repointed := make(map[string]KeyEntry)
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if dst, ok := moved[recordPosition{kEntry.fileID, kEntry.position}]; ok {
+			kEntry.fileID = seg.id
+			kEntry.position = dst.position
+			kEntry.totalSize = dst.totalSize
+			repointed[key] = kEntry
+		}
+		return true
+	})
+	for key, kEntry := range repointed {
+		d.keyDir.put(key, kEntry)
+	}
+	for _, old := range run[:len(run)-1] {
+		old.file.Close()
+		delete(d.segments, old.id)
+		// the records are in the new segment already, loading them twice is harmless
+		if err := fsys.Remove(old.name); err != nil {
+			log.Printf("caskdb: removal of the compacted segment %s failed: %v", old.name, err)
+		}
+	}
+	return nil
+}
+
+// recordPosition is where a record is, the segment and the offset in it
+type recordPosition struct {
+	fileID   uint32
+	position uint32
+}
+
+// copySegments copies all the records of the segments, in the order, to dst in the
+// current format. It returns where each record went in dst, by where it was.
+func copySegments(dst File, segments []*segment) (map[recordPosition]KeyEntry, error) {
+	if _, err := dst.Write(encodeFileHeader(currentFormat)); err != nil {
+		return nil, err
+	}
+	moved := make(map[recordPosition]KeyEntry)
+	writePosition := uint32(fileHeaderSize)
+	var buf []byte
+	for _, seg := range segments {
+		hSize := headerSizeOf(seg.version)
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+			totalSize := hSize + h.keySize + h.valueSize
+			if cap(buf) < int(totalSize) {
+				buf = make([]byte, totalSize)
+			}
+			record := buf[:totalSize]
+			if err := readFull(seg.file, record, int64(position)); err != nil {
+				return err
+			}
+			if seg.version != currentFormat {
+				h, key, value := decodeKV(record, seg.version)
+				_, record = encodeRecord(h, key, value)
+			}
+			if _, err := dst.Write(record); err != nil {
+				return err
+			}
+			moved[recordPosition{seg.id, uint32(position)}] = NewKeyEntry(0, h.timestamp, writePosition, uint32(len(record)))
+			writePosition += uint32(len(record))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return moved, nil
+}
+
+// CompactActive rewrites the active segment without the records superseded by a
+// later record of the same key in it, like a key set over and over since the last
+// rotation. The sealed segments are not touched, which makes it much cheaper than
+// Merge when the overwrites hammer the active segment.
+//
+// The last record of every key in the active segment is kept, even a delete or one
+// which is not live, it could hide an older record in a sealed segment. The new file
+// is written and synced first, and swapped in place of the active segment, like
+// Merge does. The write lock is held for the entire compaction.
+func (d *DiskStore) CompactActive() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	size := int64(d.writePosition)
+	last := make(map[string]int)
+	_, err := forEachRecord(d.file, size, d.version, func(position int, h recordHeader, key []byte) error {
+		// a blob is written once per segment, it is the last of its hash anyway
+		if h.flags&flagBlob == 0 {
+			last[string(key)] = position
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fsys := d.opts.fileSystem
+	tmpName := d.fileName + compactSuffix
+	tmp, err := fsys.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	moved, writePosition, err := d.copyLast(tmp, size, last)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(tmpName)
+		return err
+	}
+	if swapped, err := d.swapFile(tmpName); err != nil {
+		if !swapped {
+			fsys.Remove(tmpName)
+		}
+		return err
+	}
+	repointed := make(map[string]KeyEntry)
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.fileID != d.activeID {
+			return true
+		}
+		if position, ok := moved[kEntry.position]; ok {
+			kEntry.position = position
+			repointed[key] = kEntry
+		}
+		return true
+	})
+	for key, kEntry := range repointed {
+		d.keyDir.put(key, kEntry)
+	}
+	d.writePosition = writePosition
+	// the cached values could be of the old positions
+	if d.cache != nil {
+		d.cache = newReadCache(d.opts.cacheSize, d.opts.cacheTTL)
+	}
+	// the new file was synced, the WAL entries are of the old one
+	if err := d.checkpointWAL(); err != nil {
+		return err
+	}
+	if err := d.rebuildBlobs(); err != nil {
+		return err
+	}
+	return d.rebuildDigest()
+}
+
+// copyLast copies the records of the active segment at the positions in last to dst,
+// in the same format. It returns where each record went in dst, by where it was,
+// and the offset where the next record can be written in dst.
+func (d *DiskStore) copyLast(dst File, size int64, last map[string]int) (map[uint32]uint32, int, error) {
+	writePosition := dataStartOf(d.version)
+	if d.version != formatV1 {
+		if _, err := dst.Write(encodeFileHeader(d.version)); err != nil {
+			return nil, 0, err
+		}
+	}
+	moved := make(map[uint32]uint32)
+	hSize := headerSizeOf(d.version)
+	var buf []byte
+	_, err := forEachRecord(d.file, size, d.version, func(position int, h recordHeader, key []byte) error {
+		if h.flags&flagBlob == 0 && last[string(key)] != position {
+			return nil
+		}
+		totalSize := hSize + h.keySize + h.valueSize
+		if cap(buf) < int(totalSize) {
+			buf = make([]byte, totalSize)
+		}
+		record := buf[:totalSize]
+		if err := readFull(d.file, record, int64(position)); err != nil {
+			return err
+		}
+		if _, err := dst.Write(record); err != nil {
+			return err
+		}
+		moved[uint32(position)] = uint32(writePosition)
+		writePosition += int(totalSize)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return moved, writePosition, nil
+}
@@ -0,0 +1,125 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_CompactSmallSegments(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		key, val := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		store.Set(key, val)
+		tests[key] = val
+		// a large segment in the middle splits the small ones into two runs
+		if i == 4 {
+			store.Set("big", string(make([]byte, 1024)))
+			tests["big"] = string(make([]byte, 1024))
+		}
+		// an overwrite and a delete across the segments
+		if i == 6 {
+			store.Set("key-1", "overwritten")
+			tests["key-1"] = "overwritten"
+			store.Delete("key-2")
+			delete(tests, "key-2")
+		}
+		store.Rotate()
+	}
+	store.Set("active", "segment")
+	tests["active"] = "segment"
+
+	if err := store.CompactSmallSegments(512); err != nil {
+		t.Fatalf("CompactSmallSegments() error = %v", err)
+	}
+	// 1-4 and 6-8 are coalesced, 5 is too large
+	ids, _ := listSegments(osFS{}, fileName)
+	if want := []uint32{4, 5, 8}; fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("listSegments() = %v, want %v", ids, want)
+	}
+	check := func(store *DiskStore) {
+		for key, val := range tests {
+			if got, err := store.Get(key); got != val {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, val)
+			}
+		}
+		if _, err := store.Get("key-2"); err != ErrKeyNotFound {
+			t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+	check(store)
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestDiskStore_CompactActive(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Rotate()
+	for i := 0; i < 50; i++ {
+		store.Set("crime and punishment", fmt.Sprintf("dostoevsky-%d", i))
+		store.Set("anna karenina", fmt.Sprintf("tolstoy-%d", i))
+	}
+	// the delete hides the record in the sealed segment
+	store.Set("othello", "william shakespeare")
+	store.Delete("othello")
+	before, _ := os.Stat(fileName)
+
+	if err := store.CompactActive(); err != nil {
+		t.Fatalf("CompactActive() error = %v", err)
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size()/10 {
+		t.Errorf("active file size = %v, want less than a tenth of %v", after.Size(), before.Size())
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky-49",
+		"anna karenina":        "tolstoy-49",
+		"hamlet":               "shakespeare",
+	}
+	check := func(store *DiskStore) {
+		for key, val := range tests {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("Get(%v) = %v, want %v", key, got, val)
+			}
+		}
+		if _, err := store.Get("othello"); err != ErrKeyNotFound {
+			t.Errorf("Get() of the deleted key error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+	check(store)
+	store.Set("hamlet", "william shakespeare")
+	tests["hamlet"] = "william shakespeare"
+	check(store)
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package caskdb
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// SyncCoordinator batches the fsyncs of the stores sharing it, see
+// WithSyncCoordinator. The first write to ask for an fsync opens a flush window,
+// and all the writes asking during the window wait for it to end. Then every file
+// with a write pending is synced once, however many writes it had, and all of them
+// resume. So under a load of concurrent writes, from one store or many, a whole
+// window worth of writes costs one fsync per file, instead of one per write. The
+// price is the window added to the latency of every write.
+//
+// A SyncCoordinator is safe for concurrent use, by any number of stores.
+type SyncCoordinator struct {
+	window time.Duration
+	mu     sync.Mutex
+	// batch has the files of the open flush window, nil if there is none
+	batch *syncBatch
+}
+
+// syncBatch is the files to sync at the end of a flush window, and what each sync
+// returned. done is closed once all of them are synced.
+type syncBatch struct {
+	files map[File]error
+	done  chan struct{}
+}
+
+// NewSyncCoordinator returns a SyncCoordinator with flush windows of the given
+// length.
+func NewSyncCoordinator(window time.Duration) *SyncCoordinator {
+	return &SyncCoordinator{window: window}
+}
+
+// sync syncs the file at the end of the current flush window, and returns its error
+func (c *SyncCoordinator) sync(file File) error {
+	c.mu.Lock()
+	b := c.batch
+	if b == nil {
+		b = &syncBatch{files: make(map[File]error), done: make(chan struct{})}
+		c.batch = b
+		time.AfterFunc(c.window, c.flush)
+	}
+	b.files[file] = nil
+	c.mu.Unlock()
+	<-b.done
+	return b.files[file]
+}
+
+// flush ends the flush window, and syncs its files
+func (c *SyncCoordinator) flush() {
+	c.mu.Lock()
+	b := c.batch
+	c.batch = nil
+	c.mu.Unlock()
+	for file := range b.files {
+		// a segment rotated in the meanwhile was synced before closing
+		if err := file.Sync(); err != nil && !errors.Is(err, fs.ErrClosed) {
+			b.files[file] = err
+		}
+	}
+	close(b.done)
+}
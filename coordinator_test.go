@@ -0,0 +1,95 @@
+package caskdb
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFS counts the syncs of the files of MemFS
+type countingFS struct {
+	*MemFS
+	syncs atomic.Int64
+}
+
+type countingFile struct {
+	File
+	fsys *countingFS
+}
+
+func (c *countingFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := c.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{file, c}, nil
+}
+
+func (f *countingFile) Sync() error {
+	f.fsys.syncs.Add(1)
+	return f.File.Sync()
+}
+
+// setConcurrently runs the Sets of several goroutines on every store, and returns the
+// number of the syncs they took
+func setConcurrently(t *testing.T, fsys *countingFS, opts ...Option) int64 {
+	const stores, writers, writes = 3, 4, 10
+	var all []*DiskStore
+	for i := 0; i < stores; i++ {
+		store, err := NewDiskStore(fmt.Sprintf("store %d.db", i), append(opts, WithFileSystem(fsys), WithIndexOrder(IndexBeforeSync))...)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		all = append(all, store)
+	}
+	before := fsys.syncs.Load()
+	var wg sync.WaitGroup
+	for _, store := range all {
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(store *DiskStore, w int) {
+				defer wg.Done()
+				for i := 0; i < writes; i++ {
+					if err := store.Set(fmt.Sprintf("key %d %d", w, i), "value"); err != nil {
+						t.Errorf("Set() error = %v", err)
+					}
+				}
+			}(store, w)
+		}
+	}
+	wg.Wait()
+	syncs := fsys.syncs.Load() - before
+	for _, store := range all {
+		store.Close()
+	}
+
+	for i := 0; i < stores; i++ {
+		store, err := NewDiskStore(fmt.Sprintf("store %d.db", i), WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for w := 0; w < writers; w++ {
+			for j := 0; j < writes; j++ {
+				if got, err := store.Get(fmt.Sprintf("key %d %d", w, j)); err != nil || got != "value" {
+					t.Errorf("Get() = %v, %v, want value", got, err)
+				}
+			}
+		}
+		store.Close()
+	}
+	return syncs
+}
+
+func TestDiskStore_WithSyncCoordinator(t *testing.T) {
+	independent := setConcurrently(t, &countingFS{MemFS: NewMemFS()})
+	coordinated := setConcurrently(t, &countingFS{MemFS: NewMemFS()}, WithSyncCoordinator(NewSyncCoordinator(5*time.Millisecond)))
+	if independent != 3*4*10 {
+		t.Errorf("syncs without a coordinator = %v, want one per Set", independent)
+	}
+	if coordinated >= independent {
+		t.Errorf("syncs with a coordinator = %v, want fewer than %v", coordinated, independent)
+	}
+}
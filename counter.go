@@ -0,0 +1,76 @@
+package caskdb
+
+import "encoding/binary"
+
+// counterSize is the size of a counter value, an int64
+const counterSize = 8
+
+// CounterStore keeps int64 counters in a DiskStore. A counter is stored natively, as
+// 8 bytes big endian, rather than as a decimal string, so it is compact and there
+// is no parsing or formatting on every update:
+//
+//	views := caskdb.NewCounterStore(store)
+//	n, err := views.Add("hamlet", 1)
+//
+// A missing counter is zero. The counters share the keys with the rest of the store,
+// keep them apart, say with a prefix.
+type CounterStore struct {
+	store *DiskStore
+}
+
+// NewCounterStore returns a CounterStore over the store.
+func NewCounterStore(store *DiskStore) *CounterStore {
+	return &CounterStore{store: store}
+}
+
+// Get returns the value of the counter, zero if it doesn't exist. It returns
+// ErrNotCounter if the key has a value which is not a counter.
+func (c *CounterStore) Get(key string) (int64, error) {
+	value, ok, err := c.store.get(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return decodeCounter(value)
+}
+
+// Add adds the delta to the counter and returns the new value. The read and the
+// write are atomic, the concurrent Adds never lose an update. A missing counter
+// starts from zero.
+func (c *CounterStore) Add(key string, delta int64) (int64, error) {
+	d := c.store
+	var n int64
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.update(key, func(value string, ok bool) (string, bool, error) {
+		if ok {
+			var err error
+			if n, err = decodeCounter(value); err != nil {
+				return "", false, err
+			}
+		}
+		n += delta
+		return encodeCounter(n), true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Reset removes the counter, it reads as zero after.
+func (c *CounterStore) Reset(key string) error {
+	return c.store.Delete(key)
+}
+
+func encodeCounter(n int64) string {
+	buf := make([]byte, counterSize)
+	binary.BigEndian.PutUint64(buf, uint64(n))
+	return string(buf)
+}
+
+func decodeCounter(value string) (int64, error) {
+	if len(value) != counterSize {
+		return 0, ErrNotCounter
+	}
+	return int64(binary.BigEndian.Uint64([]byte(value))), nil
+}
@@ -0,0 +1,59 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCounterStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	counters := NewCounterStore(store)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := counters.Add("views", 1); err != nil {
+					t.Errorf("Add() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := counters.Add("balance", -42); n != -42 || err != nil {
+		t.Errorf("Add() = %v, %v, want %v", n, err, -42)
+	}
+	if n, _ := counters.Get("views"); n != 200 {
+		t.Errorf("Get() = %v, want %v", n, 200)
+	}
+	store.Set("hamlet", "shakespeare")
+	if _, err := counters.Add("hamlet", 1); !errors.Is(err, ErrNotCounter) {
+		t.Errorf("Add() of a string error = %v, want %v", err, ErrNotCounter)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	counters = NewCounterStore(store)
+	for key, want := range map[string]int64{"views": 200, "balance": -42, "missing": 0} {
+		if n, err := counters.Get(key); n != want || err != nil {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, n, err, want)
+		}
+	}
+	if err := counters.Reset("views"); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	if n, _ := counters.Get("views"); n != 0 {
+		t.Errorf("Get() after Reset() = %v, want 0", n)
+	}
+}
@@ -0,0 +1,119 @@
+package caskdb
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+)
+
+// csvBatchSize is the number of rows ImportCSV writes with a single Batch
+const csvBatchSize = 1024
+
+// CSVOption configures ExportCSV and ImportCSV
+type CSVOption func(*csvOptions)
+
+type csvOptions struct {
+	base64Values bool
+}
+
+// WithCSVBase64 encodes the values in base64, for the binary values. CSV itself
+// passes any bytes through, but the tools reading it expect text, and a carriage
+// return at the end of a line inside a value doesn't survive a CSV reader. The
+// keys are written as they are. ImportCSV must be given the same option.
+func WithCSVBase64() CSVOption {
+	return func(o *csvOptions) {
+		o.base64Values = true
+	}
+}
+
+// ExportCSV writes all the keys and their values to w as CSV, a key and its value
+// on each row, in no particular order. The values with commas, quotes or newlines
+// are quoted and escaped as per RFC 4180. Like DumpTo, it is a consistent snapshot
+// of the store, the writes wait till it is over.
+func (d *DiskStore) ExportCSV(w io.Writer, opts ...CSVOption) error {
+	o := csvOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if d.opts.indexOnly {
+		return ErrValuesDisabled
+	}
+	if err := d.restoreEvicted(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	cw := csv.NewWriter(w)
+	var err error
+	now := time.Now().Unix()
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.expired(now) {
+			return true
+		}
+		var data []byte
+		var version uint32
+		if data, version, err = d.readRecord(kEntry); err != nil {
+			return false
+		}
+		if !validChecksum(data, version) {
+			err = ErrChecksumMismatch
+			return false
+		}
+		var value string
+		if _, _, value, err = d.decodeRecord(kEntry.fileID, data, version); err != nil {
+			return false
+		}
+		if o.base64Values {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		err = cw.Write([]string{key, value})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportCSV reads the keys and their values from r, as written by ExportCSV, and
+// sets them in the store. Every row must have exactly a key and a value. The rows
+// are written in batches, see Batch, so on an error the rows before the failed
+// batch are in the store already.
+func (d *DiskStore) ImportCSV(r io.Reader, opts ...CSVOption) error {
+	o := csvOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.ReuseRecord = true
+	batch := d.NewBatch()
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key, value := row[0], row[1]
+		if o.base64Values {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				line, _ := cr.FieldPos(1)
+				return fmt.Errorf("caskdb: value of %q on line %d is not base64: %w", key, line, err)
+			}
+			value = string(decoded)
+		}
+		batch.Set(key, value)
+		if batch.Len() == csvBatchSize {
+			if err := batch.Commit(); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.Commit()
+}
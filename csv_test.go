@@ -0,0 +1,72 @@
+package caskdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_ExportCSV(t *testing.T) {
+	tests := map[string]string{
+		"hamlet":                "shakespeare",
+		"crime, and punishment": "fyodor \"the\" dostoevsky",
+		"anna karenina":         "leo tolstoy,\nyasnaya polyana",
+		"empty":                 "",
+	}
+	binary := map[string]string{"binary": "\x00\xff\r\n\"", "hamlet": "shakespeare"}
+	for name, tt := range map[string]struct {
+		pairs map[string]string
+		opts  []CSVOption
+	}{
+		"plain":  {tests, nil},
+		"base64": {binary, []CSVOption{WithCSVBase64()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			for key, val := range tt.pairs {
+				store.Set(key, val)
+			}
+			var buf bytes.Buffer
+			if err := store.ExportCSV(&buf, tt.opts...); err != nil {
+				t.Fatalf("ExportCSV() error = %v", err)
+			}
+			if lines := strings.Count(buf.String(), "\n"); lines < len(tt.pairs) {
+				t.Errorf("ExportCSV() wrote %v lines, want at least %v", lines, len(tt.pairs))
+			}
+
+			imported, err := NewDiskStore(filepath.Join(dir, "imported.db"))
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer imported.Close()
+			if err := imported.ImportCSV(&buf, tt.opts...); err != nil {
+				t.Fatalf("ImportCSV() error = %v", err)
+			}
+			got, _ := imported.MGet(imported.Keys())
+			if !reflect.DeepEqual(got, tt.pairs) {
+				t.Errorf("ImportCSV() = %q, want %q", got, tt.pairs)
+			}
+		})
+	}
+}
+
+func TestDiskStore_ImportCSVInvalid(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.ImportCSV(strings.NewReader("hamlet,shakespeare,extra\n")); err == nil {
+		t.Errorf("ImportCSV() of three columns error = nil, want an error")
+	}
+	if err := store.ImportCSV(strings.NewReader("hamlet,not base64!\n"), WithCSVBase64()); err == nil {
+		t.Errorf("ImportCSV() of invalid base64 error = nil, want an error")
+	}
+}
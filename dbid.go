@@ -0,0 +1,125 @@
+package caskdb
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The database ID is kept in-band, as a flagDatabaseID record right past the file
+// header of every segment, see WithDatabaseID. So any copy of the files has it, a
+// single sealed segment or the dump of DumpTo too. The rewrites of the segments,
+// Merge, Migrate, ReplaceAll and the cold tier, start their new files with it, and
+// the compactions copy it over along with the other records.
+
+// idSize is the length of the ID, the canonical text form of a UUID
+const idSize = 36
+
+// errFoundID stops the scan for the database ID at the first record, see findID
+var errFoundID = errors.New("caskdb: found the database id")
+
+// DatabaseID returns the unique ID of the database, or an empty string if it has
+// none: a database gets one when it is first opened with WithDatabaseID. Two copies
+// of a database share its ID, while any two databases created independently have
+// different ones.
+func (d *DiskStore) DatabaseID() string {
+	return d.id
+}
+
+// idRecord returns the record of the database ID which starts a segment of the given
+// format version, or nil if the database has no ID. formatV1 has no room for it.
+func (d *DiskStore) idRecord(version uint32) []byte {
+	if d.id == "" || version == formatV1 {
+		return nil
+	}
+	_, record := encodeRecord(recordHeader{flags: flagDatabaseID}, d.id, "")
+	return record
+}
+
+// loadDatabaseID reads the ID of the database from the first segment which has it.
+// With WithDatabaseID, a database without one gets a new ID, written at the start of
+// the active segment, or of a new one the active segment is rotated to if it has
+// records already. A read-only store does not write the ID, it is left empty.
+func (d *DiskStore) loadDatabaseID() error {
+	for _, seg := range d.allSegments() {
+		id, err := findID(seg.file, seg.size, seg.version)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			d.id = id
+			return nil
+		}
+	}
+	if !d.opts.databaseID || d.opts.readOnly {
+		return nil
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	d.id = id
+	if d.writePosition > dataStartOf(d.version) {
+		// rotate starts the new segment with the ID
+		if err := d.rotate(); err != nil {
+			d.id = ""
+			return err
+		}
+		return nil
+	}
+	// an empty formatV1 file has no file header, it becomes a file of the current
+	// format
+	if d.version == formatV1 {
+		if err := d.write(encodeFileHeader(currentFormat)); err != nil {
+			d.id = ""
+			return err
+		}
+		d.version = currentFormat
+		d.writePosition = fileHeaderSize
+	}
+	record := d.idRecord(d.version)
+	if err := d.write(record); err != nil {
+		d.id = ""
+		return err
+	}
+	d.addDigest(record)
+	d.writePosition += len(record)
+	return nil
+}
+
+// findID returns the database ID of the first record of the segment in r, written in
+// the given format version, or an empty string if it is not a flagDatabaseID record
+func findID(r io.ReaderAt, size int64, version uint32) (string, error) {
+	if version == formatV1 {
+		return "", nil
+	}
+	var id string
+	_, err := forEachRecord(r, size, version, func(position int, h recordHeader, key []byte) error {
+		if h.flags&flagDatabaseID != 0 && len(key) == idSize {
+			record := make([]byte, headerSize+h.keySize+h.valueSize)
+			if err := readFull(r, record, int64(position)); err != nil {
+				return err
+			}
+			if validChecksum(record, version) {
+				id = string(key)
+			}
+		}
+		return errFoundID
+	})
+	if err != nil && err != errFoundID {
+		return "", err
+	}
+	return id, nil
+}
+
+// newUUID returns a random UUID, version 4
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,162 @@
+package caskdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestDiskStore_WithDatabaseID(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	store, err := NewDiskStore(fileName, WithDatabaseID())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	id := store.DatabaseID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("DatabaseID() = %v, want a UUID", id)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "william shakespeare")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if err := store.Migrate(int(formatV2)); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	// formatV1 has no room for the ID
+	if err := store.Migrate(int(formatV1)); err == nil {
+		t.Errorf("Migrate() to formatV1 error = nil, want an error")
+	}
+	if got := store.Len(); got != 1 {
+		t.Errorf("Len() = %v, want %v", got, 1)
+	}
+	var dump bytes.Buffer
+	if err := store.DumpTo(&dump); err != nil {
+		t.Fatalf("DumpTo() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithDatabaseID())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got := store.DatabaseID(); got != id {
+		t.Errorf("DatabaseID() after reopen = %v, want %v", got, id)
+	}
+	store.Close()
+
+	// the ID is in the file, a copy of it alone has the ID too
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	copyName := filepath.Join(dir, "copy.db")
+	if err := os.WriteFile(copyName, data, 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	dumpName := filepath.Join(dir, "dump.db")
+	if err := os.WriteFile(dumpName, dump.Bytes(), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	for _, name := range []string{copyName, dumpName} {
+		copied, err := NewDiskStore(name, WithDatabaseID())
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		if got := copied.DatabaseID(); got != id {
+			t.Errorf("DatabaseID() of the copy %v = %v, want %v", filepath.Base(name), got, id)
+		}
+		if got, err := copied.Get("othello"); err != nil || got != "william shakespeare" {
+			t.Errorf("Get() of the copy %v = %v, %v, want %v, nil", filepath.Base(name), got, err, "william shakespeare")
+		}
+		copied.Close()
+	}
+
+	other, err := NewDiskStore(filepath.Join(dir, "other.db"), WithDatabaseID())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer other.Close()
+	otherID := other.DatabaseID()
+	if otherID == id || otherID == "" {
+		t.Errorf("DatabaseID() of another database = %v, want other than %v", otherID, id)
+	}
+	// an import is no copy, the store keeps its own ID
+	if err := other.Import(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if got := other.DatabaseID(); got != otherID {
+		t.Errorf("DatabaseID() after Import() = %v, want %v", got, otherID)
+	}
+	if got := other.Len(); got != 1 {
+		t.Errorf("Len() after Import() = %v, want %v", got, 1)
+	}
+
+	// the ID is kept without the option too
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got := store.DatabaseID(); got != id {
+		t.Errorf("DatabaseID() without WithDatabaseID() = %v, want %v", got, id)
+	}
+	store.Close()
+
+	plain, err := NewDiskStore(filepath.Join(dir, "plain.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer plain.Close()
+	if got := plain.DatabaseID(); got != "" {
+		t.Errorf("DatabaseID() without WithDatabaseID() = %v, want empty", got)
+	}
+}
+
+func TestDiskStore_WithDatabaseIDRotate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	// the records written before the ID are in a segment of their own
+	store, err = NewDiskStore(fileName, WithDatabaseID())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	id := store.DatabaseID()
+	if id == "" {
+		t.Fatalf("DatabaseID() = %v, want an ID", id)
+	}
+	// a segment with just the ID is not sealed
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	segments, err := store.Segments()
+	if err != nil {
+		t.Fatalf("Segments() error = %v", err)
+	}
+	if len(segments) != 2 {
+		t.Errorf("len(Segments()) = %v, want %v", len(segments), 2)
+	}
+	store.Set("hamlet", "shakespeare")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	// every segment starts with the ID, the sealed ones carry it alone
+	for _, seg := range store.sortedSegments()[1:] {
+		if got, err := findID(seg.file, seg.size, seg.version); err != nil || got != id {
+			t.Errorf("findID() of segment %v = %v, %v, want %v, nil", seg.id, got, err, id)
+		}
+	}
+	if got, err := store.Get("othello"); err != nil || got != "shakespeare" {
+		t.Errorf("Get() = %v, %v, want %v, nil", got, err, "shakespeare")
+	}
+}
@@ -0,0 +1,118 @@
+package caskdb
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// With WithDedup, a large value is written once per segment, in a blob record, and
+// every Set of it writes a ref record pointing to the blob instead of the value:
+//
+//	blob   key: SHA-256 of the value   value: the value
+//	ref    key: the key                value: SHA-256 of the value
+//
+// The blob is written right before the first ref to it in a segment, in the same
+// write. A ref always points to a blob in its own segment, so a segment can be
+// dropped or copied around on its own, without breaking the refs of the others. The
+// blobs are not in the keyDir, they are in the blob index, by their segment and
+// hash.
+//
+// A blob has no owner, it is reclaimed by Merge once no live record refers to it:
+// the merge copies a blob only along with the first live ref to it.
+
+// dedupMinSize is the smallest value written as a blob, the smaller ones are not
+// worth the hash and the ref
+const dedupMinSize = 64
+
+// blobKey identifies a blob by the segment it is in, and the SHA-256 of its value
+type blobKey struct {
+	fileID uint32
+	hash   string
+}
+
+// blobHash returns the hash a blob of the value is stored by
+func blobHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return string(sum[:])
+}
+
+// setRecords returns the records to write for a set of the key: the key's record,
+// preceded by the blob of the value if it goes in one and the active segment doesn't
+// have it yet, see WithDedup. The caller must hold the write lock.
+func (d *DiskStore) setRecords(h recordHeader, key string, value string) ([]recordHeader, []batchOp) {
+	// the records applied as they are, like the ones of Import, are left alone
+	if !d.opts.dedup || h.flags&(flagTombstone|flagBlob|flagRef) != 0 || len(value) < dedupMinSize {
+		h.flags |= d.compressFlag(h.flags)
+		return []recordHeader{h}, []batchOp{{h.flags, key, value}}
+	}
+	hash := blobHash(value)
+	ref := h
+	ref.flags |= flagRef
+	if _, ok := d.blobs[blobKey{d.activeID, hash}]; ok {
+		return []recordHeader{ref}, []batchOp{{ref.flags, key, hash}}
+	}
+	blob := recordHeader{timestamp: h.timestamp, flags: flagBlob}
+	blob.flags |= d.compressFlag(blob.flags)
+	return []recordHeader{blob, ref}, []batchOp{{blob.flags, hash, value}, {ref.flags, key, hash}}
+}
+
+// resolveValue returns the actual value of a record of the segment fileID, read
+// from its blob if it is a ref. The caller must hold the lock.
+func (d *DiskStore) resolveValue(fileID uint32, h recordHeader, value string) (string, error) {
+	if h.flags&flagRef == 0 {
+		return value, nil
+	}
+	data, version, err := d.readBlob(fileID, value)
+	if err != nil {
+		return "", err
+	}
+	if !validChecksum(data, version) {
+		return "", ErrChecksumMismatch
+	}
+	_, _, blob := decodeKV(data, version)
+	return blob, nil
+}
+
+// readBlob reads the record of the blob with the given hash in the segment fileID,
+// like readRecord. The caller must hold the lock.
+func (d *DiskStore) readBlob(fileID uint32, hash string) ([]byte, uint32, error) {
+	kEntry, ok := d.blobs[blobKey{fileID, hash}]
+	if !ok {
+		return nil, 0, fmt.Errorf("caskdb: blob %x of segment %d does not exist", hash, fileID)
+	}
+	return d.readRecord(kEntry)
+}
+
+// decodeRecord is decodeKV for a record of the segment fileID, with the value of a
+// ref resolved. The flagRef of the header is cleared, it is the header of a record
+// with the value itself. The caller must hold the lock.
+func (d *DiskStore) decodeRecord(fileID uint32, data []byte, version uint32) (recordHeader, string, string, error) {
+	h, key, value := decodeKV(data, version)
+	value, err := d.resolveValue(fileID, h, value)
+	h.flags &^= flagRef
+	return h, key, value, err
+}
+
+// rebuildBlobs builds the blob index again by reading all the segments, after they
+// were rewritten. The caller must hold the write lock.
+func (d *DiskStore) rebuildBlobs() error {
+	// none of the rewrites add the blobs to a store which had none
+	if len(d.blobs) == 0 {
+		return nil
+	}
+	blobs := make(map[blobKey]KeyEntry)
+	for _, seg := range d.allSegments() {
+		hSize := headerSizeOf(seg.version)
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+			if h.flags&flagBlob != 0 {
+				blobs[blobKey{seg.id, string(key)}] = NewKeyEntry(seg.id, h.timestamp, uint32(position), hSize+h.keySize+h.valueSize)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	d.blobs = blobs
+	return nil
+}
@@ -0,0 +1,93 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_WithDedup(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("it was the best of times, it was the worst of times. ", 100)
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		if err := store.Set(fmt.Sprintf("copy %d", i), value); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every key takes a ref record, of the header, the key and the hash
+	if limit := int64(len(value) + keys*64); stat.Size() >= limit {
+		t.Errorf("file size = %v, want less than %v with the value stored once", stat.Size(), limit)
+	}
+	for i := 0; i < keys; i++ {
+		if got, err := store.Get(fmt.Sprintf("copy %d", i)); err != nil || got != value {
+			t.Fatalf("Get() = %v, %v, want the value", len(got), err)
+		}
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("copy 42"); err != nil || got != value {
+		t.Errorf("Get() after reopen = %v, %v, want the value", len(got), err)
+	}
+	// the blob is reclaimed by the merge, once no key has the value anymore
+	for i := 0; i < keys-1; i++ {
+		store.Set(fmt.Sprintf("copy %d", i), "abridged")
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if got, err := store.Get(fmt.Sprintf("copy %d", keys-1)); err != nil || got != value {
+		t.Errorf("Get() after Merge() = %v, %v, want the value", len(got), err)
+	}
+	store.Set(fmt.Sprintf("copy %d", keys-1), "abridged")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if stat, _ := os.Stat(fileName); stat.Size() >= int64(len(value)) {
+		t.Errorf("file size after Merge() = %v, want the value reclaimed", stat.Size())
+	}
+	if len(store.blobs) != 0 {
+		t.Errorf("Merge() left %v blobs, want none", len(store.blobs))
+	}
+}
+
+func TestDiskStore_WithDedupRotate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	value := strings.Repeat("call me ishmael. ", 10)
+	store.Set("moby dick", value)
+	store.Rotate()
+	// the new segment gets its own blob, a segment is dropped as a whole
+	store.Set("moby dick", value)
+	if err := store.DropSegment(1); err != nil {
+		t.Fatalf("DropSegment() error = %v", err)
+	}
+	if got, err := store.Get("moby dick"); err != nil || got != value {
+		t.Errorf("Get() = %v, %v, want %v", got, err, value)
+	}
+	if err := store.CompactActive(); err != nil {
+		t.Fatalf("CompactActive() error = %v", err)
+	}
+	if got, err := store.Get("moby dick"); err != nil || got != value {
+		t.Errorf("Get() after CompactActive() = %v, %v, want %v", got, err, value)
+	}
+}
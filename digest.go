@@ -0,0 +1,90 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// digestChain is the rolling digest of the records, see WithDigest. The records
+// written with it are flagChained: each one stores the digest so far, and its checksum
+// covers that, so the checksum of the last record is the digest of all of them.
+//
+// A record which doesn't link to the digest so far, or doesn't match its checksum, is
+// folded into the digest as a whole instead: the digest becomes the CRC-32 of the
+// previous digest followed by the record. That covers the records written without
+// WithDigest, the ones of formatV1, the ones moved by a Merge and the altered ones
+// alike. The digest starts with zero.
+type digestChain struct {
+	sum uint32
+}
+
+// add extends the chain with the record written in the given format version
+func (c *digestChain) add(record []byte, version uint32) {
+	if version != formatV1 && validChecksum(record, version) {
+		h := decodeHeader(record[:headerSize], version)
+		prev, _ := splitChain(h.flags, record[headerSize+h.keySize:])
+		if h.flags&flagChained != 0 && prev == c.sum {
+			c.sum = h.checksum
+			return
+		}
+	}
+	c.sum = crc32.Update(c.sum, crc32.IEEETable, record)
+}
+
+// FileDigest returns the rolling digest of all the records in the store, in the
+// order they are on the disk, or nil without WithDigest. It is 4 bytes, little
+// endian: the checksum of the last record, which chains in every record before it.
+// Altering any record, including the ones which are dead, breaks the chain and
+// changes the digest, unlike the independent checksums of the records. Record it
+// along with an audit trail, and a mismatch later shows that the files were tampered
+// with.
+//
+// The digest is of the files, not the data: Merge, CompactSmallSegments and the
+// retention rewrite or drop the records, and the digest changes with them.
+func (d *DiskStore) FileDigest() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.digest == nil {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint32(nil, d.digest.sum)
+}
+
+// addDigest extends the digest with a record written to the active segment. The
+// caller must hold the write lock.
+func (d *DiskStore) addDigest(record []byte) {
+	if d.digest != nil {
+		d.digest.add(record, d.version)
+	}
+}
+
+// rebuildDigest computes the digest from scratch by reading all the records and
+// following their chain, after the startup or whenever the files were rewritten. It does nothing without
+// WithDigest. The caller must hold the write lock.
+func (d *DiskStore) rebuildDigest() error {
+	if !d.opts.digest {
+		return nil
+	}
+	c := &digestChain{}
+	var buf []byte
+	for _, seg := range d.allSegments() {
+		hSize := headerSizeOf(seg.version)
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, _ []byte) error {
+			totalSize := hSize + h.keySize + h.valueSize
+			if cap(buf) < int(totalSize) {
+				buf = make([]byte, totalSize)
+			}
+			record := buf[:totalSize]
+			if err := readFull(seg.file, record, int64(position)); err != nil {
+				return err
+			}
+			c.add(record, seg.version)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	d.digest = c
+	return nil
+}
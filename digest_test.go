@@ -0,0 +1,119 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_FileDigest(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	empty := store.FileDigest()
+	store.Set("crime and punishment", "dostoevsky")
+	store.Rotate()
+	store.Set("anna karenina", "tolstoy")
+	store.Set("crime and punishment", "fyodor dostoevsky")
+	digest := store.FileDigest()
+	if len(digest) == 0 || bytes.Equal(digest, empty) {
+		t.Errorf("FileDigest() = %x, want a digest other than the empty store's %x", digest, empty)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got := store.FileDigest(); !bytes.Equal(got, digest) {
+		t.Errorf("FileDigest() after reopen = %x, want %x", got, digest)
+	}
+	store.Close()
+
+	// a dead record in the sealed segment, "dostoevsky" turns into "Dostoevsky"
+	name := segmentName(fileName, 1)
+	data, _ := os.ReadFile(name)
+	i := bytes.Index(data, []byte("dostoevsky"))
+	data[i] = 'D'
+	os.WriteFile(name, data, 0666)
+	store, err = NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got := store.FileDigest(); bytes.Equal(got, digest) {
+		t.Errorf("FileDigest() after altering a record = %x, want a different one", got)
+	}
+
+	plain, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer plain.Close()
+	if got := plain.FileDigest(); got != nil {
+		t.Errorf("FileDigest() without WithDigest = %x, want nil", got)
+	}
+}
+
+func TestDiskStore_FileDigestChain(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	b := store.NewBatch()
+	b.Set("hamlet", "shakespeare")
+	b.Set("ulysses", "joyce")
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	store.Delete("othello")
+	digest := store.FileDigest()
+	store.Close()
+
+	// every record stores the checksum of the one before it
+	data, _ := os.ReadFile(fileName)
+	var prev uint32
+	var positions []int
+	for position := fileHeaderSize; position < len(data); {
+		h := decodeHeader(data[position:position+headerSize], currentFormat)
+		record := data[position : position+headerSize+int(h.keySize+h.valueSize)]
+		chain, _ := splitChain(h.flags, record[headerSize+h.keySize:])
+		if h.flags&flagChained == 0 || chain != prev {
+			t.Errorf("record at %v chain = %v, flags = %v, want %v, flagChained", position, chain, h.flags, prev)
+		}
+		if !validChecksum(record, currentFormat) {
+			t.Errorf("validChecksum() = false for the record at %v, want true", position)
+		}
+		prev = h.checksum
+		positions = append(positions, position)
+		position += len(record)
+	}
+	if want := binary.LittleEndian.AppendUint32(nil, prev); !bytes.Equal(digest, want) {
+		t.Errorf("FileDigest() = %x, want the checksum of the last record %x", digest, want)
+	}
+
+	// "joyce" turns into "Joyce", with the checksum fixed up to match
+	start, end := positions[2], positions[3]
+	i := bytes.Index(data, []byte("joyce"))
+	data[i] = 'J'
+	binary.LittleEndian.PutUint32(data[start:], crc32.ChecksumIEEE(data[start+4:end]))
+	os.WriteFile(fileName, data, 0666)
+	store, err = NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got, _ := store.Get("ulysses"); got != "Joyce" {
+		t.Fatalf("Get() = %v, want %v", got, "Joyce")
+	}
+	if got := store.FileDigest(); bytes.Equal(got, digest) {
+		t.Errorf("FileDigest() after altering a record = %x, want a different one", got)
+	}
+}
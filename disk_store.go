@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // defaultWhence helps us with `file.Seek` method to move our cursor to certain byte offset for read
@@ -60,83 +63,661 @@ const defaultWhence = 0
 //
 //		store, _ := NewDiskStore("books.db")
 //	   	store.Set("othello", "shakespeare")
-//	   	author := store.Get("othello")
+//	   	author, _ := store.Get("othello")
 type DiskStore struct {
-	// file object pointing the file_name
-	file *os.File
+	// mu guards all the fields below. Reads take the read lock, anything which
+	// writes to the file or modifies keyDir takes the write lock
+	mu sync.RWMutex
+	// fileName is the path of the file, as given to NewDiskStore
+	fileName string
+	// file object pointing the file_name, the active segment
+	file File
+	// activeID is the segment id of the active segment
+	activeID uint32
+	// segments are the sealed segments, by their id
+	segments map[uint32]*segment
+	// newest is the newest timestamp of the records in the active segment
+	newest uint64
+	// expiry orders the keys with an expiry by their expiry time
+	expiry *expiryIndex
+	// evicted has the keys evicted from the keyDir, nil without WithMaxIndexKeys
+	evicted *evictedFilter
+	// wal is the write-ahead log, nil without WithWAL
+	wal *writeAheadLog
+	// idleFlush checkpoints the WAL after a quiet period, nil without
+	// WithFlushOnIdle
+	idleFlush *time.Timer
+	// digest is the rolling digest of the records, nil without WithDigest
+	digest *digestChain
 	// current cursor position in the file where the data can be written
 	writePosition int
 	// keyDir is a map of key and KeyEntry being the value. KeyEntry contains the position
 	// of the byte offset in the file where the value exists. key_dir map acts as in-memory
 	// index to fetch the values quickly from the disk
-	keyDir map[string]KeyEntry
+	keyDir keyIndex
+	// blobs has the deduplicated values of all the segments, see WithDedup
+	blobs map[blobKey]KeyEntry
+	// recent has the keys written last, nil without WithRecentKeys
+	recent *recentKeys
+	// id is the database ID, empty if the database has none, see WithDatabaseID
+	id string
+	// access has the times of the last reads of the keys, nil without WithColdTier
+	access *accessTimes
+	// version is the format version of the active segment. The records are read
+	// and written in this format
+	version uint32
+	// opts are the options the store was created with
+	opts options
+	// cache is the read cache, nil if it is disabled
+	cache *readCache
+	// asyncQueue holds the SetAsync writes till the background writer gets to them
+	asyncQueue chan asyncWrite
+	// asyncDone is closed when the background writer exits
+	asyncDone chan struct{}
+	// pending has the queued SetAsync writes, nil without WithAsyncReadYourWrites
+	pending *pendingWrites
+	// rotateStop stops the WithRotateInterval rotator, rotateDone is closed when it
+	// exits. Both are nil without the option
+	rotateStop chan struct{}
+	rotateDone chan struct{}
+	metrics    metrics
 }
 
-func isFileExists(fileName string) bool {
-	// https://stackoverflow.com/a/12518877
-	if _, err := os.Stat(fileName); err == nil || errors.Is(err, fs.ErrExist) {
-		return true
+func NewDiskStore(fileName string, opts ...Option) (*DiskStore, error) {
+	ds := &DiskStore{fileName: fileName, opts: defaultOptions()}
+	for _, opt := range opts {
+		opt(&ds.opts)
 	}
-	return false
-}
-
-func NewDiskStore(fileName string) (*DiskStore, error) {
-	ds := &DiskStore{keyDir: make(map[string]KeyEntry)}
-	// if the file exists already, then we will load the key_dir
-	if isFileExists(fileName) {
-		ds.initKeyDir(fileName)
+	ds.keyDir = newKeyIndex(ds.opts)
+	ds.blobs = make(map[blobKey]KeyEntry)
+	if ds.opts.coldAfter > 0 {
+		ds.access = newAccessTimes()
+	}
+	ds.expiry = newExpiryIndex()
+	if ds.opts.maxIndexKeys > 0 {
+		ds.evicted = newEvictedFilter(ds.opts.maxIndexKeys)
+	}
+	if ds.opts.cacheSize > 0 {
+		ds.cache = newReadCache(ds.opts.cacheSize, ds.opts.cacheTTL)
+	}
+	if err := checkFileType(ds.opts.fileSystem, fileName, ds.opts.followSymlinks); err != nil {
+		return nil, err
+	}
+	// a read-only store leaves the trash to the writer
+	if !ds.opts.readOnly {
+		if err := recoverTrash(ds.opts.fileSystem, fileName); err != nil {
+			return nil, err
+		}
+	}
+	if err := ds.openSegments(); err != nil {
+		return nil, err
 	}
 	// we open the file in following modes:
 	//	os.O_APPEND - says that the writes are append only.
 	// 	os.O_RDWR - says we can read and write to the file
 	// 	os.O_CREATE - creates the file if it does not exist
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	flag := os.O_APPEND | os.O_RDWR | os.O_CREATE
+	if ds.opts.mustExist {
+		flag &^= os.O_CREATE
+	}
+	if ds.opts.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := ds.opts.fileSystem.OpenFile(fileName, flag, 0666)
 	if err != nil {
+		ds.closeSegments()
+		if ds.opts.mustExist && errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrDatabaseNotFound, fileName)
+		}
 		return nil, err
 	}
 	ds.file = file
+	// if the files exist already, then we will load the key_dir
+	if err := ds.initKeyDir(); err != nil {
+		file.Close()
+		ds.closeSegments()
+		return nil, err
+	}
+	// a read-only store leaves the WAL to the writer
+	if ds.opts.wal && !ds.opts.readOnly {
+		if err := ds.openWAL(); err != nil {
+			if ds.wal != nil {
+				ds.wal.file.Close()
+			}
+			file.Close()
+			ds.closeSegments()
+			return nil, err
+		}
+	}
+	// the WAL is replayed first, expiring all the sealed segments renumbers the
+	// active one, see renumberActive
+	if err := ds.expireSegments(time.Now()); err != nil {
+		ds.closeWAL()
+		file.Close()
+		ds.closeSegments()
+		return nil, err
+	}
+	ds.expiry.rebuild(ds.keyDir)
+	if ds.wal != nil && ds.opts.flushOnIdle > 0 {
+		// it is armed by the first write
+		ds.idleFlush = time.AfterFunc(ds.opts.flushOnIdle, ds.flushIdle)
+		ds.idleFlush.Stop()
+	}
+	if err := ds.rebuildDigest(); err != nil {
+		ds.closeWAL()
+		file.Close()
+		ds.closeSegments()
+		return nil, err
+	}
+	if err := ds.loadDatabaseID(); err != nil {
+		ds.closeWAL()
+		ds.file.Close()
+		ds.closeSegments()
+		return nil, err
+	}
+	ds.evictCold("")
+	if ds.opts.recentKeys > 0 {
+		ds.recent = newRecentKeys(ds.opts.recentKeys)
+		ds.loadRecentKeys()
+	}
+	ds.asyncQueue = make(chan asyncWrite, ds.opts.asyncQueueSize)
+	ds.asyncDone = make(chan struct{})
+	if ds.opts.asyncReadYourWrites {
+		ds.pending = newPendingWrites()
+	}
+	go ds.runAsyncWriter()
+	if ds.opts.rotateInterval > 0 && !ds.opts.readOnly {
+		ds.rotateStop = make(chan struct{})
+		ds.rotateDone = make(chan struct{})
+		go ds.runRotator(ds.opts.rotateInterval)
+	}
 	return ds, nil
 }
 
-func (d *DiskStore) Get(key string) string {
+// checkFileType makes sure that the database path is a regular file, or doesn't
+// exist yet. A symlink is checked with the file it points to, if followSymlinks is
+// set, otherwise it is refused.
+//
+// Opening anything else is a hazard: a named pipe would make the startup block or
+// read garbage, a symlink could silently point the database at a different file.
+func checkFileType(fsys FileSystem, fileName string, followSymlinks bool) error {
+	info, err := fsys.Lstat(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if !followSymlinks {
+			return fmt.Errorf("%w: %s is a symlink", ErrNotRegularFile, fileName)
+		}
+		if info, err = fsys.Stat(fileName); err != nil {
+			// a dangling symlink would create the file wherever it points to
+			return err
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is %v", ErrNotRegularFile, fileName, info.Mode().Type())
+	}
+	return nil
+}
+
+func (d *DiskStore) Get(key string) (string, error) {
 	// Get retrieves the value from the disk and returns. If the key does not
-	// exist then it returns an empty string
+	// exist then it returns ErrKeyNotFound
 	//
 	// How get works?
 	//	1. Check if there is any KeyEntry record for the key in keyDir
-	//	2. Return an empty string if key doesn't exist
+	//	2. Return ErrKeyNotFound if key doesn't exist
 	//	3. If it exists, then read KeyEntry.totalSize bytes starting from the
 	//     KeyEntry.position from the disk
 	//	4. Decode the bytes into valid KV pair and return the value
 	//
-	kEntry, ok := d.keyDir[key]
+	value, ok, err := d.get(key)
+	if err != nil {
+		return "", err
+	}
 	if !ok {
-		return ""
+		return "", ErrKeyNotFound
 	}
-	// move the current pointer to the right offset
-	// TODO: handle errors
-	d.file.Seek(int64(kEntry.position), defaultWhence)
-	data := make([]byte, kEntry.totalSize)
-	// TODO: handle errors
-	_, err := io.ReadFull(d.file, data)
+	return value, nil
+}
+
+// GetOK is like Get, but it reports a missing key with the boolean instead of an
+// error, just like reading from a Go map:
+//
+//	author, ok := store.GetOK("othello")
+//
+// The miss case doesn't create an error, which adds up at very high rate of
+// lookups. GetOK also returns false if the value couldn't be read from the disk,
+// use Get to find out why.
+func (d *DiskStore) GetOK(key string) (string, bool) {
+	value, ok, err := d.get(key)
+	if err != nil {
+		return "", false
+	}
+	return value, ok
+}
+
+// get is the common part of Get and GetOK. A missing key is not an error, it is
+// reported as false.
+func (d *DiskStore) get(key string) (string, bool, error) {
+	if d.opts.indexOnly {
+		return "", false, ErrValuesDisabled
+	}
+	// a queued write is newer than anything on the disk
+	if d.pending != nil {
+		if value, ok := d.pending.get(key); ok {
+			return value, true, nil
+		}
+	}
+	if err := d.reloadEvicted(key); err != nil {
+		return "", false, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	kEntry, ok := d.lookup(key)
+	if err := indexErr(d.keyDir); err != nil {
+		return "", false, err
+	}
+	if !ok {
+		return "", false, nil
+	}
+	d.touch(key)
+	if d.cache != nil {
+		if value, ok := d.cache.get(key, kEntry); ok {
+			d.metrics.cacheHits.Add(1)
+			return value, true, nil
+		}
+		d.metrics.cacheMisses.Add(1)
+	}
+	if d.opts.seekMetrics {
+		d.metrics.diskGets.Add(1)
+	}
+	data, version, err := d.readRecord(kEntry)
+	if err != nil {
+		return "", false, err
+	}
+	return d.decodeValue(key, kEntry, data, version)
+}
+
+// decodeValue returns the value of the key from its record read from the disk, and
+// caches it. The caller must hold the lock.
+func (d *DiskStore) decodeValue(key string, kEntry KeyEntry, data []byte, version uint32) (string, bool, error) {
+	if !validChecksum(data, version) {
+		if d.opts.corruptionFallback {
+			return d.fallbackValue(key, kEntry)
+		}
+		return "", false, ErrChecksumMismatch
+	}
+	_, storedKey, value, err := d.decodeRecord(kEntry.fileID, data, version)
 	if err != nil {
-		panic("read error")
+		return "", false, err
+	}
+	if err := d.verifyKey(key, storedKey); err != nil {
+		return "", false, err
+	}
+	if d.cache != nil {
+		d.cache.put(key, value, kEntry)
+	}
+	return value, true, nil
+}
+
+// lookup returns the KeyEntry of the key from the keyDir, unless it has expired.
+// The caller must hold the lock.
+func (d *DiskStore) lookup(key string) (KeyEntry, bool) {
+	kEntry, ok := d.keyDir.get(key)
+	if !ok || kEntry.expired(time.Now().Unix()) {
+		return KeyEntry{}, false
+	}
+	return kEntry, true
+}
+
+// Has reports whether the key exists in the store. It only consults the keyDir
+// and never touches the disk, unless the key was evicted, see WithMaxIndexKeys.
+func (d *DiskStore) Has(key string) bool {
+	if err := d.reloadEvicted(key); err != nil {
+		log.Printf("caskdb: reload of the evicted key %q failed: %v", key, err)
 	}
-	_, _, value := decodeKV(data)
-	return value
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.lookup(key)
+	return ok
 }
 
-func (d *DiskStore) Set(key string, value string) {
+// Keys returns all the keys in the store, in no particular order. The expired keys
+// are left out, and so are the evicted keys if they can't be restored, see
+// WithMaxIndexKeys.
+func (d *DiskStore) Keys() []string {
+	if err := d.restoreEvicted(); err != nil {
+		log.Printf("caskdb: restore of the evicted keys failed: %v", err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now().Unix()
+	keys := make([]string, 0, d.keyDir.len())
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if !kEntry.expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// Len returns the number of keys in the store. It counts the expired keys too,
+// till they are removed by PurgeExpired. The evicted keys are not counted if they
+// can't be restored, see WithMaxIndexKeys.
+func (d *DiskStore) Len() int {
+	if err := d.restoreEvicted(); err != nil {
+		log.Printf("caskdb: restore of the evicted keys failed: %v", err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.keyDir.len()
+}
+
+// KeyInfo is the metadata of a key, as kept in the keyDir
+type KeyInfo struct {
+	// Timestamp is the time of the last write to the key, in unix epoch seconds
+	Timestamp uint64
+	// Size is the size of the record on the disk, including the header
+	Size uint32
+}
+
+// Info returns the metadata of the key without reading its value from the disk.
+// The second return value is false if the key does not exist.
+func (d *DiskStore) Info(key string) (KeyInfo, bool) {
+	if err := d.reloadEvicted(key); err != nil {
+		log.Printf("caskdb: reload of the evicted key %q failed: %v", key, err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return KeyInfo{}, false
+	}
+	return KeyInfo{Timestamp: kEntry.timestamp, Size: kEntry.totalSize}, true
+}
+
+func (d *DiskStore) Set(key string, value string) error {
 	// Set stores the key and value on the disk
 	//
 	// The steps to save a KV to disk is simple:
 	// 1. Encode the KV into bytes
 	// 2. Write the bytes to disk by appending to the file
 	// 3. Update KeyDir with the KeyEntry of this key
-	timestamp := uint32(time.Now().Unix())
-	size, data := encodeKV(timestamp, key, value)
-	d.write(data)
-	d.keyDir[key] = NewKeyEntry(timestamp, uint32(d.writePosition), uint32(size))
+	//
+	// With the IndexBeforeSync order, the step 3 is done before the fsync part of the
+	// step 2 and we don't hold the lock while waiting for the fsync. Check
+	// documentation of WithIndexOrder for the details
+	_, err := d.SetAt(key, value)
+	return err
+}
+
+// SetAt is like Set, but it also returns the byte offset where the record was
+// written in the active segment. This is meant for the callers which keep track of
+// where every write landed, like replication or an external index.
+func (d *DiskStore) SetAt(key string, value string) (uint64, error) {
+	h := recordHeader{timestamp: uint64(time.Now().Unix())}
+	d.mu.Lock()
+	offset := uint64(d.writePosition)
+	// with the WAL, there is no fsync of the segment to wait for
+	if d.opts.indexOrder == IndexBeforeSync && d.wal == nil {
+		err := d.setUnsynced(h, key, value)
+		file := d.file
+		d.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if d.opts.syncCoordinator != nil {
+			return offset, d.opts.syncCoordinator.sync(file)
+		}
+		// if the segment got rotated in the meanwhile, it was synced before closing
+		if err := file.Sync(); err != nil && !errors.Is(err, fs.ErrClosed) {
+			return 0, err
+		}
+		return offset, nil
+	}
+	defer d.mu.Unlock()
+	if err := d.set(h, key, value); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// set writes the record of the KV, with the timestamp and the flags of h, and
+// updates the keyDir only after the write is durable. The caller must hold the write
+// lock.
+func (d *DiskStore) set(h recordHeader, key string, value string) error {
+	headers, ops, data, sizes, err := d.encodeSet(h, key, value)
+	if err != nil {
+		return err
+	}
+	write := d.write
+	if d.wal != nil {
+		write = d.writeWAL
+	}
+	if err := write(data); err != nil {
+		return err
+	}
+	d.indexRecords(headers, ops, data, sizes)
+	return indexErr(d.keyDir)
+}
+
+// setUnsynced is like set, but it updates the keyDir without waiting for the fsync.
+// The caller must hold the write lock, and sync the file after releasing it.
+func (d *DiskStore) setUnsynced(h recordHeader, key string, value string) error {
+	headers, ops, data, sizes, err := d.encodeSet(h, key, value)
+	if err != nil {
+		return err
+	}
+	if _, err := d.file.Write(data); err != nil {
+		d.file.Truncate(int64(d.writePosition))
+		return err
+	}
+	d.indexRecords(headers, ops, data, sizes)
+	return indexErr(d.keyDir)
+}
+
+// encodeSet encodes the records of a set of the KV, see setRecords, and makes room
+// for them in the active segment. The caller must hold the write lock.
+func (d *DiskStore) encodeSet(h recordHeader, key string, value string) ([]recordHeader, []batchOp, []byte, []int, error) {
+	if d.opts.readOnly {
+		return nil, nil, nil, nil, ErrReadOnly
+	}
+	if h.flags&flagBlob == 0 {
+		if err := d.checkKey(key); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	for {
+		activeID := d.activeID
+		headers, ops := d.setRecords(h, key, value)
+		var flags uint8
+		for _, rh := range headers {
+			flags |= rh.flags
+		}
+		if err := d.supportFlags(flags); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if d.activeID != activeID {
+			continue
+		}
+		data, sizes := d.encodeBatch(headers, ops)
+		if err := d.reserve(len(data)); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		// a blob in the segment which was just rotated away is not of any use to
+		// the ref, the new segment needs its own
+		if d.activeID == activeID {
+			return headers, ops, data, sizes, nil
+		}
+	}
+}
+
+// indexRecords updates the keyDir with the records just written, in one pass. The
+// caller must hold the write lock.
+func (d *DiskStore) indexRecords(headers []recordHeader, ops []batchOp, data []byte, sizes []int) {
+	offset := 0
+	for i, op := range ops {
+		d.addDigest(data[offset : offset+sizes[i]])
+		d.indexRecord(headers[i], op.key, sizes[i])
+		offset += sizes[i]
+	}
+	d.metrics.keyDirPasses.Add(1)
+}
+
+// Update replaces the value of the key with the one fn returns for the current value,
+// atomically: no other write gets in between the read and the write. fn gets false
+// for a missing key, and returns the new value and whether to keep the key, false
+// deletes it. If fn returns an error, nothing is written and Update returns it.
+//
+// This is the building block for the read-modify-write operations, like a counter
+// increment, an append or a compare-and-swap:
+//
+//	err := store.Update("hamlet", func(current string, exists bool) (string, bool, error) {
+//		return current + ", act 2", true, nil
+//	})
+//
+// fn is called with the write lock held, it must not call the store.
+func (d *DiskStore) Update(key string, fn func(current string, exists bool) (string, bool, error)) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.update(key, fn)
+}
+
+// update is Update, the caller must hold the write lock.
+func (d *DiskStore) update(key string, fn func(value string, ok bool) (string, bool, error)) error {
+	if err := d.reloadEvictedLocked(key); err != nil {
+		return err
+	}
+	value, ok, err := d.valueLocked(key)
+	if err != nil {
+		return err
+	}
+	newValue, keep, err := fn(value, ok)
+	if err != nil {
+		return err
+	}
+	h := recordHeader{timestamp: uint64(time.Now().Unix())}
+	if !keep {
+		// like Delete, a missing key doesn't get a tombstone
+		if !ok {
+			return nil
+		}
+		h.flags = flagTombstone
+		newValue = ""
+	}
+	return d.set(h, key, newValue)
+}
+
+// valueLocked reads the current value of the key from the disk, bypassing the
+// cache. The caller must hold the lock.
+func (d *DiskStore) valueLocked(key string) (string, bool, error) {
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return "", false, nil
+	}
+	data, version, err := d.readRecord(kEntry)
+	if err != nil {
+		return "", false, err
+	}
+	if !validChecksum(data, version) {
+		return "", false, ErrChecksumMismatch
+	}
+	_, storedKey, value, err := d.decodeRecord(kEntry.fileID, data, version)
+	if err != nil {
+		return "", false, err
+	}
+	if err := d.verifyKey(key, storedKey); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// verifyKey makes sure the record read for the key is of the key, see
+// WithVerifyKeyOnRead
+func (d *DiskStore) verifyKey(key string, storedKey string) error {
+	if d.opts.verifyKeyOnRead && storedKey != key {
+		return fmt.Errorf("%w: the record of %q has the key %q", ErrKeyMismatch, key, storedKey)
+	}
+	return nil
+}
+
+// checkKey makes sure the key can be written, see WithUTF8Keys
+func (d *DiskStore) checkKey(key string) error {
+	if d.opts.utf8Keys && !utf8.ValidString(key) {
+		return fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// compressFlag returns flagCompressed if a record with the flags should be
+// compressed, see WithCompression. A tombstone has no value to compress.
+func (d *DiskStore) compressFlag(flags uint8) uint8 {
+	if !d.opts.compression || flags&flagTombstone != 0 {
+		return 0
+	}
+	return flagCompressed
+}
+
+// supportFlags makes sure that the active segment can have a record with the flags.
+// The formatV1 records have no flags, so a formatV1 active segment is rotated to
+// start a new one in the current format.
+func (d *DiskStore) supportFlags(flags uint8) error {
+	if flags == 0 || d.version != formatV1 {
+		return nil
+	}
+	return d.rotate()
+}
+
+// reserve makes sure that a record of the given size fits in the active segment,
+// as per WithMaxFileSize. The caller must hold the write lock.
+func (d *DiskStore) reserve(size int) error {
+	limit := d.opts.maxFileSize
+	if limit <= 0 || int64(d.writePosition)+int64(size) <= limit {
+		return nil
+	}
+	if d.opts.fileFullPolicy == RotateWhenFileFull {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+		if int64(d.writePosition)+int64(size) <= limit {
+			return nil
+		}
+	}
+	return ErrFileFull
+}
+
+// indexRecord updates the keyDir with the record of the given size, just written at
+// the write position. The caller must hold the write lock.
+func (d *DiskStore) indexRecord(h recordHeader, key string, size int) {
+	if h.flags&flagBlob != 0 {
+		d.blobs[blobKey{d.activeID, key}] = NewKeyEntry(d.activeID, h.timestamp, uint32(d.writePosition), uint32(size))
+	} else if h.flags&flagDatabaseID != 0 {
+		// a read-only store picks up the ID written after it was opened
+		if d.id == "" {
+			d.id = key
+		}
+	} else if h.flags&flagTombstone != 0 {
+		d.keyDir.delete(key)
+		d.expiry.remove(key)
+	} else {
+		kEntry := NewKeyEntry(d.activeID, h.timestamp, uint32(d.writePosition), uint32(size))
+		kEntry.expiry = h.expiry
+		d.keyDir.put(key, kEntry)
+		d.expiry.set(key, h.expiry)
+		d.evictCold(key)
+		if d.recent != nil {
+			d.recent.add(key)
+		}
+	}
+	d.updateNewest(h.timestamp)
 	// update last write position, so that next record can be written from this point
 	d.writePosition += size
 }
@@ -145,7 +726,20 @@ func (d *DiskStore) Close() bool {
 	// before we close the file, we need to safely write the contents in the buffers
 	// to the disk. Check documentation of DiskStore.write() to understand
 	// following the operations
+	//
+	// the queued async writes are drained first, so that none of them are lost
+	close(d.asyncQueue)
+	<-d.asyncDone
+	if d.rotateStop != nil {
+		close(d.rotateStop)
+		<-d.rotateDone
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeSegments()
+	closeIndex(d.keyDir)
 	// TODO: handle errors
+	d.closeWAL()
 	d.file.Sync()
 	if err := d.file.Close(); err != nil {
 		// TODO: log the error
@@ -154,56 +748,290 @@ func (d *DiskStore) Close() bool {
 	return true
 }
 
-func (d *DiskStore) write(data []byte) {
+// encodeRecord encodes the record in the format of the file. The flags are dropped
+// in formatV1, see supportFlags.
+func (d *DiskStore) encodeRecord(h recordHeader, key string, value string) (int, []byte) {
+	if d.version == formatV1 {
+		return encodeKVV1(h.timestamp, key, value)
+	}
+	return encodeRecord(h, key, value)
+}
+
+// appendRecordIn appends the record encoded in the given format version to dst, see
+// encodeRecord. A value to be compressed must be compressed already.
+func appendRecordIn(version uint32, dst []byte, h recordHeader, key string, value string) []byte {
+	if version == formatV1 {
+		return appendKVV1(dst, h.timestamp, key, value)
+	}
+	return appendRecord(dst, h, key, value)
+}
+
+func (d *DiskStore) write(data []byte) error {
 	// saving stuff to a file reliably is hard!
 	// if you would like to explore and learn more, then
 	// start from here: https://danluu.com/file-consistency/
 	// and read this too: https://lwn.net/Articles/457667/
+	//
+	// if either of the write or the fsync fails, we cut the file back to where it
+	// was, so that a partial or a non durable record doesn't show up on the next
+	// startup
 	if _, err := d.file.Write(data); err != nil {
-		panic(err)
+		d.file.Truncate(int64(d.writePosition))
+		return err
 	}
 	// calling fsync after every write is important, this assures that our writes
 	// are actually persisted to the disk
 	if err := d.file.Sync(); err != nil {
-		panic(err)
+		d.file.Truncate(int64(d.writePosition))
+		return err
 	}
+	return nil
 }
 
-func (d *DiskStore) initKeyDir(existingFile string) {
+func (d *DiskStore) initKeyDir() error {
 	// we will initialise the keyDir by reading the contents of the file, record by
 	// record. As we read each record, we will also update our keyDir with the
 	// corresponding KeyEntry
 	//
 	// NOTE: this method is a blocking one, if the DB size is yuge then it will take
 	// a lot of time to startup
-	file, _ := os.Open(existingFile)
-	defer file.Close()
-	for {
-		header := make([]byte, headerSize)
-		_, err := io.ReadFull(file, header)
-		if err == io.EOF {
-			break
+	stat, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	progress := d.newLoadProgress(stat.Size())
+	skipped := 0
+	// the sealed segments are loaded first, they have the older records
+	for _, seg := range d.sortedSegments() {
+		if _, seg.newest, err = d.loadSegment(seg.file, seg.size, seg.version, seg.id, progress.segment(seg.size), &skipped); err != nil {
+			return err
 		}
-		// TODO: handle errors
-		if err != nil {
-			break
+	}
+	// a new file starts with the file header, in the current format. A read-only
+	// store leaves it to the writer, see RefreshReadOnly
+	if stat.Size() == 0 && d.opts.readOnly {
+		d.version = currentFormat
+		progress.finish()
+		return nil
+	}
+	if stat.Size() == 0 {
+		d.version = currentFormat
+		if err := d.write(encodeFileHeader(currentFormat)); err != nil {
+			return err
 		}
-		timestamp, keySize, valueSize := decodeHeader(header)
-		key := make([]byte, keySize)
-		value := make([]byte, valueSize)
-		_, err = io.ReadFull(file, key)
-		// TODO: handle errors
-		if err != nil {
-			break
+		d.writePosition = fileHeaderSize
+		progress.finish()
+		return nil
+	}
+	// an existing file could be written in any of the older formats, the file
+	// header tells us which one
+	header := make([]byte, fileHeaderSize)
+	n, err := d.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if d.version, err = decodeFileHeader(header[:n]); err != nil {
+		return err
+	}
+	d.writePosition, d.newest, err = d.loadSegment(d.file, stat.Size(), d.version, d.activeID, progress.segment(stat.Size()), &skipped)
+	if err != nil {
+		return err
+	}
+	if err := indexErr(d.keyDir); err != nil {
+		return err
+	}
+	if d.opts.maxSkippedRecords >= 0 {
+		log.Printf("caskdb: loaded %d keys of %s, skipped %d corrupt records", d.keyDir.len(), d.fileName, skipped)
+	}
+	progress.finish()
+	return nil
+}
+
+// loadSegment loads the records of a segment into the keyDir with scanKeyDir, or
+// recoverKeyDir with WithMaxSkippedRecords. skipped has the number of the corrupt
+// records skipped so far, across the segments. The caller must hold the write lock.
+func (d *DiskStore) loadSegment(r io.ReaderAt, size int64, version uint32, fileID uint32, progress func(offset int64), skipped *int) (int, uint64, error) {
+	if d.opts.maxSkippedRecords < 0 {
+		return scanKeyDir(r, size, version, fileID, d.keyDir, d.blobs, progress)
+	}
+	end, newest, n, err := recoverKeyDir(r, size, version, fileID, d.keyDir, d.blobs, progress)
+	if err != nil {
+		return 0, 0, err
+	}
+	*skipped += n
+	if *skipped > d.opts.maxSkippedRecords {
+		return 0, 0, fmt.Errorf("%w: more than %d corrupt records, repair the store first", ErrTooManyCorrupt, d.opts.maxSkippedRecords)
+	}
+	return end, newest, nil
+}
+
+// RebuildIndex throws away the current keyDir and builds a fresh one by reading
+// all the segments again, exactly like it is done at the startup. This is a repair
+// tool: use it when the index is suspected to be inconsistent or the file was
+// modified by someone else, like another process appending records to it.
+//
+// The write lock is held for the entire rebuild, and the new index is swapped in
+// only after the scan succeeds. On error, the old index is left untouched.
+func (d *DiskStore) RebuildIndex() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rebuildIndex()
+}
+
+// rebuildIndex is RebuildIndex, the caller must hold the write lock.
+func (d *DiskStore) rebuildIndex() error {
+	stat, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	keyDir := newKeyIndex(d.opts)
+	blobs := make(map[blobKey]KeyEntry)
+	for _, seg := range d.sortedSegments() {
+		if _, _, err := scanKeyDir(seg.file, seg.size, seg.version, seg.id, keyDir, blobs, nil); err != nil {
+			closeIndex(keyDir)
+			return err
 		}
-		_, err = io.ReadFull(file, value)
-		// TODO: handle errors
-		if err != nil {
+	}
+	writePosition, newest, err := scanKeyDir(d.file, stat.Size(), d.version, d.activeID, keyDir, blobs, nil)
+	if err == nil {
+		err = indexErr(keyDir)
+	}
+	if err != nil {
+		closeIndex(keyDir)
+		return err
+	}
+	closeIndex(d.keyDir)
+	d.keyDir = keyDir
+	d.blobs = blobs
+	d.expiry.rebuild(keyDir)
+	if d.evicted != nil {
+		d.evicted.reset()
+	}
+	d.writePosition = writePosition
+	d.newest = newest
+	return nil
+}
+
+// scanKeyDir reads all the records from the first size bytes of r, the segment
+// fileID written in the given format version, and adds them to keyDir, and the blobs
+// of WithDedup to blobs unless it is nil. It returns
+// the byte offset where the next record can be written, and the newest timestamp of
+// the records. If the last record is incomplete, the scan stops at the start of it.
+//
+// The value bytes are jumped over, we need only the header and the key to build the
+// keyDir. If progress is not nil, it is called with the offset past every record.
+//
+// A tombstone, or a record which has expired already, removes the key from keyDir.
+func scanKeyDir(r io.ReaderAt, size int64, version uint32, fileID uint32, keyDir keyIndex, blobs map[blobKey]KeyEntry, progress func(offset int64)) (int, uint64, error) {
+	var newest uint64
+	now := time.Now().Unix()
+	end, err := forEachRecord(r, size, version, func(position int, h recordHeader, key []byte) error {
+		totalSize := headerSizeOf(version) + h.keySize + h.valueSize
+		kEntry := NewKeyEntry(fileID, h.timestamp, uint32(position), totalSize)
+		kEntry.expiry = h.expiry
+		loadRecord(keyDir, blobs, kEntry, h.flags, string(key), now)
+		if h.timestamp > newest {
+			newest = h.timestamp
+		}
+		if progress != nil {
+			progress(int64(position) + int64(totalSize))
+		}
+		return nil
+	})
+	return end, newest, err
+}
+
+// loadRecord adds a record read by scanKeyDir to keyDir, or to blobs
+func loadRecord(keyDir keyIndex, blobs map[blobKey]KeyEntry, kEntry KeyEntry, flags uint8, key string, now int64) {
+	switch {
+	case flags&flagBlob != 0:
+		if blobs != nil {
+			blobs[blobKey{kEntry.fileID, key}] = kEntry
+		}
+	case flags&flagDatabaseID != 0:
+		// the database ID is no key, see loadDatabaseID
+	case flags&flagTombstone != 0 || kEntry.expired(now):
+		keyDir.delete(key)
+	default:
+		keyDir.put(key, kEntry)
+	}
+}
+
+// keyReadAhead is the number of bytes read along with a record header, in the hope
+// that the key fits in them, see forEachRecord
+const keyReadAhead = 64
+
+// forEachRecord reads the records from the first size bytes of r one by one, in the
+// order they were written, and calls fn with the position of each record along
+// with its header and key. It returns the byte offset past the last complete
+// record, or the error returned by fn.
+//
+// The values are never read, only the expiry at the start of the value is, into the
+// header. The metadata is left out, see decodeKV for that. The key is valid only
+// till fn returns, its buffer is reused for the next record.
+//
+// We read with ReadAt instead of a plain Read, it does not move the file cursor,
+// which is shared with the other operations. This also lets us jump over the value
+// bytes. The header and the key are read together with a single ReadAt, into a
+// buffer which grows to the largest key: a read of the header also takes the next
+// keyReadAhead bytes, and the rest of the key is read only if it is longer.
+func forEachRecord(r io.ReaderAt, size int64, version uint32, fn func(position int, h recordHeader, key []byte) error) (int, error) {
+	return forEachRecordFrom(r, int64(dataStartOf(version)), size, version, fn)
+}
+
+// forEachRecordFrom is forEachRecord starting at the record at the given offset
+// instead of the first one
+func forEachRecordFrom(r io.ReaderAt, position int64, size int64, version uint32, fn func(position int, h recordHeader, key []byte) error) (int, error) {
+	hSize := int64(headerSizeOf(version))
+	buf := make([]byte, hSize+keyReadAhead)
+	for position+hSize <= size {
+		n := int64(len(buf))
+		if rest := size - position; n > rest {
+			n = rest
+		}
+		if err := readFull(r, buf[:n], position); err != nil {
+			return 0, err
+		}
+		h := decodeHeader(buf[:hSize], version)
+		totalSize := hSize + int64(h.keySize) + int64(h.valueSize)
+		if position+totalSize > size {
 			break
 		}
-		totalSize := headerSize + keySize + valueSize
-		d.keyDir[string(key)] = NewKeyEntry(timestamp, uint32(d.writePosition), totalSize)
-		d.writePosition += int(totalSize)
-		fmt.Printf("loaded key=%s, value=%s\n", key, value)
+		keyEnd := hSize + int64(h.keySize)
+		need := keyEnd
+		if h.flags&flagChained != 0 && h.valueSize >= chainSize {
+			need += chainSize
+		}
+		if h.flags&flagExpiry != 0 && keyEnd+int64(h.valueSize) >= need+expirySize {
+			need += expirySize
+		}
+		if need > n {
+			if need > int64(len(buf)) {
+				grown := make([]byte, need)
+				copy(grown, buf[:n])
+				buf = grown
+			}
+			if err := readFull(r, buf[n:need], position+n); err != nil {
+				return 0, err
+			}
+		}
+		var rest []byte
+		h.chain, rest = splitChain(h.flags, buf[keyEnd:need])
+		h.expiry, _ = splitExpiry(h.flags, rest)
+		if err := fn(int(position), h, buf[hSize:keyEnd]); err != nil {
+			return 0, err
+		}
+		position += totalSize
+	}
+	return int(position), nil
+}
+
+// readFull reads len(p) bytes at off. Unlike a plain ReadAt, an io.EOF along with all
+// the bytes read is not an error, some implementations return that at the end.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		return nil
 	}
+	return err
 }
@@ -1,8 +1,17 @@
 package caskdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDiskStore_Get(t *testing.T) {
@@ -12,7 +21,7 @@ func TestDiskStore_Get(t *testing.T) {
 	}
 	defer os.Remove("test.db")
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
+	if val, _ := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
 	}
 }
@@ -23,8 +32,54 @@ func TestDiskStore_GetInvalid(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
-	if val := store.Get("some key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some key"); err != ErrKeyNotFound || val != "" {
+		t.Errorf("Get() = %v, %v, want %v, %v", val, err, "", ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_GetOK(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("name", "jojo")
+	store.Set("empty", "")
+	tests := []struct {
+		key   string
+		value string
+		found bool
+	}{
+		{"name", "jojo", true},
+		{"empty", "", true},
+		{"some key", "", false},
+	}
+	for _, tt := range tests {
+		value, found := store.GetOK(tt.key)
+		if value != tt.value || found != tt.found {
+			t.Errorf("GetOK() = %v, %v, want %v, %v", value, found, tt.value, tt.found)
+		}
+	}
+}
+
+func TestDiskStore_SetAt(t *testing.T) {
+	for _, order := range []IndexOrder{IndexAfterSync, IndexBeforeSync} {
+		store, err := NewDiskStore("test.db", WithIndexOrder(order))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for _, key := range []string{"crime and punishment", "anna karenina", "crime and punishment"} {
+			offset, err := store.SetAt(key, "value")
+			if err != nil {
+				t.Fatalf("SetAt() error = %v", err)
+			}
+			if kEntry, _ := store.keyDir.get(key); uint64(kEntry.position) != offset {
+				t.Errorf("SetAt() = %v, want %v", offset, kEntry.position)
+			}
+		}
+		store.Close()
+		os.Remove("test.db")
 	}
 }
 
@@ -46,8 +101,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 	}
 	for key, val := range tests {
 		store.Set(key, val)
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
 		}
 	}
 	store.Close()
@@ -56,8 +111,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key, val := range tests {
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
 		}
 	}
 	store.Close()
@@ -93,12 +148,735 @@ func TestDiskStore_Delete(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key := range tests {
-		if store.Get(key) != "" {
-			t.Errorf("Get() = %v, want '' (empty)", store.Get(key))
+		if got, _ := store.Get(key); got != "" {
+			t.Errorf("Get() = %v, want '' (empty)", got)
+		}
+	}
+	if got, _ := store.Get("end"); got != "yes" {
+		t.Errorf("Get() = %v, want %v", got, "yes")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Update(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// every Update appends a page, none of them is lost
+	const writers, updates = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				err := store.Update("war and peace", func(current string, exists bool) (string, bool, error) {
+					return current + "p", true, nil
+				})
+				if err != nil {
+					t.Errorf("Update() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, _ := store.Get("war and peace"); len(val) != writers*updates {
+		t.Errorf("Get() has %v pages, want %v", len(val), writers*updates)
+	}
+
+	// an error leaves the value as it was
+	errAbort := errors.New("abort")
+	if err := store.Update("war and peace", func(string, bool) (string, bool, error) {
+		return "", false, errAbort
+	}); err != errAbort {
+		t.Errorf("Update() error = %v, want %v", err, errAbort)
+	}
+	err = store.Update("war and peace", func(current string, exists bool) (string, bool, error) {
+		if !exists {
+			t.Errorf("Update() exists = false, want true")
+		}
+		return "", false, nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if _, err := store.Get("war and peace"); err != ErrKeyNotFound {
+		t.Errorf("Get() after delete error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_RebuildIndex(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+
+	// another writer appends a valid record behind the store's back
+	file, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	_, data := encodeKV(uint64(time.Now().Unix()), "dune", "frank herbert")
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to append to the db file: %v", err)
+	}
+	file.Close()
+
+	if _, err := store.Get("dune"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex() error = %v", err)
+	}
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	// the writes after the rebuild must land after the external record
+	store.Set("othello", "shakespeare")
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+}
+
+// countingReaderAt counts the bytes read through it
+type countingReaderAt struct {
+	r     io.ReaderAt
+	bytes int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.bytes += n
+	return n, err
+}
+
+func TestDiskStore_IndexOnly(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	value := strings.Repeat("x", 4096)
+	tests := []string{"crime and punishment", "anna karenina", "war and peace", "hamlet"}
+	for _, key := range tests {
+		store.Set(key, value)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithIndexOnly(true))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("hamlet"); err != ErrValuesDisabled {
+		t.Errorf("Get() error = %v, want %v", err, ErrValuesDisabled)
+	}
+	if !store.Has("hamlet") {
+		t.Errorf("Has() = false, want true")
+	}
+	if store.Len() != len(tests) {
+		t.Errorf("Len() = %v, want %v", store.Len(), len(tests))
+	}
+	if len(store.Keys()) != len(tests) {
+		t.Errorf("Keys() = %v, want %v", store.Keys(), tests)
+	}
+	info, ok := store.Info("hamlet")
+	if !ok || info.Size != uint32(headerSize+len("hamlet")+len(value)) {
+		t.Errorf("Info() = %v, %v, want size %v", info, ok, headerSize+len("hamlet")+len(value))
+	}
+
+	// the scan builds the same keyDir as decoding all the records, without reading
+	// the values
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the db file: %v", err)
+	}
+	wantKeyDir := make(mapIndex)
+	for position := fileHeaderSize; position < len(data); {
+		h, key, _ := decodeKV(data[position:], currentFormat)
+		size := headerSize + int(h.keySize+h.valueSize)
+		wantKeyDir.put(key, NewKeyEntry(1, h.timestamp, uint32(position), uint32(size)))
+		position += size
+	}
+	file, err := os.Open("test.db")
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	defer file.Close()
+	counting := &countingReaderAt{r: file}
+	keyDir := make(mapIndex)
+	if _, _, err := scanKeyDir(counting, int64(len(data)), currentFormat, 1, keyDir, nil, nil); err != nil {
+		t.Fatalf("scanKeyDir() error = %v", err)
+	}
+	if !reflect.DeepEqual(keyDir, wantKeyDir) {
+		t.Errorf("scanKeyDir() = %v, want %v", keyDir, wantKeyDir)
+	}
+	if counting.bytes >= len(data)/10 {
+		t.Errorf("scanKeyDir() read %v bytes of the %v in the file", counting.bytes, len(data))
+	}
+}
+
+func TestDiskStore_LegacyFormat(t *testing.T) {
+	// a file written by the original format has no file header, and its records
+	// have a 4 byte timestamp and no checksum
+	var data []byte
+	for _, kv := range [][2]string{{"hamlet", "shakespeare"}, {"dune", "frank herbert"}, {"hamlet", "shakespeare!"}} {
+		_, record := encodeKVV1(uint64(time.Now().Unix()), kv[0], kv[1])
+		data = append(data, record...)
+	}
+	if err := os.WriteFile("test.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the db file: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if store.version != formatV1 {
+		t.Errorf("version = %v, want %v", store.version, formatV1)
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare!" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare!")
+	}
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	// the new writes to an old file keep using the old format
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range map[string]string{"hamlet": "shakespeare!", "dune": "frank herbert", "othello": "shakespeare"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_ChecksumMismatch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	// flip the last byte of the value
+	kEntry, _ := store.keyDir.get("hamlet")
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte{'?'}, int64(kEntry.position+kEntry.totalSize-1)); err != nil {
+		t.Fatalf("failed to corrupt the db file: %v", err)
+	}
+	file.Close()
+	if _, err := store.Get("hamlet"); err != ErrChecksumMismatch {
+		t.Errorf("Get() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+// failingSyncFile is a File whose fsync always fails, as if the machine
+// crashed before the write reached the disk
+type failingSyncFile struct {
+	File
+}
+
+func (f failingSyncFile) Sync() error {
+	return errors.New("fsync failed")
+}
+
+func TestDiskStore_IndexAfterSync(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithIndexOrder(IndexAfterSync))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	stat, _ := os.Stat("test.db")
+
+	file := store.file
+	store.file = failingSyncFile{file}
+	if err := store.Set("dune", "frank herbert"); err == nil {
+		t.Errorf("Set() error = nil, want the fsync error")
+	}
+	if store.Has("dune") {
+		t.Errorf("Has() = true, want false")
+	}
+	store.file = file
+	store.Close()
+
+	// the file must not have any trace of the failed write
+	if after, _ := os.Stat("test.db"); after.Size() != stat.Size() {
+		t.Errorf("file size = %v, want %v", after.Size(), stat.Size())
+	}
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Has("dune") {
+		t.Errorf("Has() = true after reopen, want false")
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	// the later writes go where the failed write was
+	store.Set("othello", "shakespeare")
+	if val, _ := store.Get("othello"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_IndexBeforeSync(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithIndexOrder(IndexBeforeSync))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+
+	file := store.file
+	store.file = failingSyncFile{file}
+	defer func() { store.file = file }()
+	if err := store.Set("dune", "frank herbert"); err == nil {
+		t.Errorf("Set() error = nil, want the fsync error")
+	}
+	// the write is visible even though it is not durable
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+}
+
+func TestDiskStore_Symlink(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	if err := os.Symlink("test.db", "link.db"); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	defer os.Remove("link.db")
+
+	if _, err := NewDiskStore("link.db"); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotRegularFile)
+	}
+	store, err = NewDiskStore("link.db", WithFollowSymlinks(true))
+	if err != nil {
+		t.Fatalf("NewDiskStore() error = %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_Directory(t *testing.T) {
+	if _, err := NewDiskStore(t.TempDir()); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotRegularFile)
+	}
+}
+
+func TestDiskStore_WithMaxFileSize(t *testing.T) {
+	const limit = 110
+	store, err := NewDiskStore("test.db", WithMaxFileSize(limit))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	// every record is 21 + 6 + 11 = 38 bytes, after the 8 bytes of the file header
+	// only two of them fit
+	for i := 0; i < 2; i++ {
+		if err := store.Set("hamlet", "shakespeare"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if err := store.Set("hamlet", "shakespeare"); err != ErrFileFull {
+		t.Errorf("Set() error = %v, want %v", err, ErrFileFull)
+	}
+	if stat, _ := os.Stat("test.db"); stat.Size() > limit {
+		t.Errorf("file size = %v, want at most %v", stat.Size(), limit)
+	}
+	// a smaller record still fits
+	if err := store.Set("dune", ""); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if got, _ := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
+
+func TestDiskStore_RotateWhenFileFull(t *testing.T) {
+	const limit = 100
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithMaxFileSize(limit), WithFileFullPolicy(RotateWhenFileFull))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 5; i++ {
+		if err := store.Set(fmt.Sprintf("hamlet %d", i), "shakespeare"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	for _, name := range []string{fileName, segmentName(fileName, 1), segmentName(fileName, 2)} {
+		if stat, err := os.Stat(name); err != nil || stat.Size() > limit {
+			t.Errorf("segment %v = %v, %v, want at most %v bytes", name, stat, err, limit)
+		}
+	}
+	if got, _ := store.Get("hamlet 0"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	// a record larger than the cap fits nowhere
+	if err := store.Set("hamlet", strings.Repeat("x", limit)); err != ErrFileFull {
+		t.Errorf("Set() error = %v, want %v", err, ErrFileFull)
+	}
+}
+
+func BenchmarkScanKeyDir(b *testing.B) {
+	var data []byte
+	data = append(data, encodeFileHeader(currentFormat)...)
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 1000; i++ {
+		_, record := encodeKV(uint64(i), fmt.Sprintf("user:%d:profile", i), value)
+		data = append(data, record...)
+	}
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, err := scanKeyDir(r, int64(len(data)), currentFormat, 1, make(mapIndex), nil, nil); err != nil {
+			b.Fatalf("scanKeyDir() error = %v", err)
+		}
+	}
+}
+
+func TestDiskStore_WithWAL(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithWAL())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	// the records after the checkpoint are only in the WAL and the unsynced segment
+	store.Rotate()
+	store.Set("anna karenina", "tolstoy")
+	store.Set("hamlet", "shakespeare")
+	wal, err := os.ReadFile(fileName + walSuffix)
+	if err != nil {
+		t.Fatalf("failed to read the WAL: %v", err)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	store.Close()
+
+	// a crash before the last record and a half made it to the segment
+	_, record := encodeKV(0, "hamlet", "shakespeare")
+	os.WriteFile(fileName, data[:len(data)-len(record)-5], 0666)
+	os.WriteFile(fileName+walSuffix, wal, 0666)
+	store, err = NewDiskStore(fileName, WithWAL())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	if stat, _ := os.Stat(fileName + walSuffix); stat.Size() != fileHeaderSize {
+		t.Errorf("WAL size after the replay = %v, want %v", stat.Size(), fileHeaderSize)
+	}
+}
+
+func TestDiskStore_WithWALAfterMerge(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithWAL())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	store.Rotate()
+	store.Set("anna karenina", "tolstoy")
+	// the merge leaves no sealed segments, the active one gets the id it would get
+	// at the next startup
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	wal, _ := os.ReadFile(fileName + walSuffix)
+	data, _ := os.ReadFile(fileName)
+	store.Close()
+
+	// a crash before the last record made it to the segment
+	_, record := encodeKV(0, "hamlet", "shakespeare")
+	os.WriteFile(fileName, data[:len(data)-len(record)], 0666)
+	os.WriteFile(fileName+walSuffix, wal, 0666)
+	store, err = NewDiskStore(fileName, WithWAL())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range map[string]string{"crime and punishment": "dostoevsky", "anna karenina": "tolstoy", "hamlet": "shakespeare"} {
+		if got, err := store.Get(key); got != val {
+			t.Errorf("Get() = %v, %v, want %v", got, err, val)
+		}
+	}
+}
+
+func TestDiskStore_WithCompression(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithCompression())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("all happy families are alike; ", 100)
+	store.Set("anna karenina", value)
+	store.Close()
+	if stat, _ := os.Stat(fileName); stat.Size() >= int64(len(value)) {
+		t.Errorf("file size = %v, want less than the value size %v", stat.Size(), len(value))
+	}
+
+	// the option only governs the new writes, the compressed record is still read
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, _ := store.Get("anna karenina"); got != value {
+		t.Errorf("Get() without WithCompression = %.20q..., want %.20q...", got, value)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithCompression())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range map[string]string{"anna karenina": value, "hamlet": "shakespeare"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get(%v) = %.20q, want %.20q", key, got, val)
 		}
 	}
-	if store.Get("end") != "yes" {
-		t.Errorf("Get() = %v, want %v", store.Get("end"), "yes")
+}
+
+func TestDiskStore_WithUTF8Keys(t *testing.T) {
+	invalid := "hamlet\xff"
+	store, err := NewDiskStore("test.db", WithUTF8Keys(true))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if err := store.Set(invalid, "shakespeare"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Set() error = %v, want %v", err, ErrInvalidKey)
+	}
+	if err := store.Delete(invalid); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrInvalidKey)
+	}
+	if err := store.SetAsync(invalid, "shakespeare"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("SetAsync() error = %v, want %v", err, ErrInvalidKey)
+	}
+	if err := store.Set("hamlet ✒", "shakespeare"); err != nil {
+		t.Errorf("Set() of a valid key error = %v", err)
 	}
 	store.Close()
+
+	// the binary keys are fine by default
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Set(invalid, "shakespeare"); err != nil {
+		t.Errorf("Set() without WithUTF8Keys error = %v", err)
+	}
+	if got, _ := store.Get(invalid); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
+
+func TestDiskStore_WithCorruptionFallback(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Rotate()
+	store.Set("anna karenina", "leo tolstoy")
+	store.Set("hamlet", "shakespeare")
+	store.Delete("hamlet")
+	store.Set("hamlet", "william shakespeare")
+	store.Close()
+
+	// corrupt the latest records of both the keys
+	data, _ := os.ReadFile(fileName)
+	for _, value := range []string{"leo tolstoy", "william shakespeare"} {
+		data[bytes.LastIndex(data, []byte(value))] ^= 0xff
+	}
+	os.WriteFile(fileName, data, 0666)
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if _, err := store.Get("anna karenina"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get() without WithCorruptionFallback error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithCorruptionFallback(true))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("anna karenina"); got != "tolstoy" || err != nil {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "tolstoy")
+	}
+	// the key was deleted before the corrupt write, there is nothing to fall back to
+	if _, err := store.Get("hamlet"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get() of a key deleted before error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestDiskStore_EmptyFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(fileName, nil, 0666); err != nil {
+		t.Fatalf("failed to create the file: %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("NewDiskStore() of an empty file error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	if data, _ := os.ReadFile(fileName); !bytes.HasPrefix(data, encodeFileHeader(currentFormat)) {
+		t.Errorf("file starts with %q, want the file header", data[:fileHeaderSize])
+	}
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, _ := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	store.Close()
+
+	// a torn file header
+	os.WriteFile(fileName, fileMagic[:3], 0666)
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("NewDiskStore() of a torn file header error = %v, want %v", err, ErrBadMagic)
+	}
+}
+
+func TestDiskStore_WithFlushOnIdle(t *testing.T) {
+	idle := 50 * time.Millisecond
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithWAL(), WithFlushOnIdle(idle))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	walSize := func() int64 {
+		stat, err := os.Stat(fileName + walSuffix)
+		if err != nil {
+			t.Fatalf("failed to stat the WAL: %v", err)
+		}
+		return stat.Size()
+	}
+	store.Set("hamlet", "shakespeare")
+	if size := walSize(); size == fileHeaderSize {
+		t.Errorf("WAL size right after the write = %v, want the record in it", size)
+	}
+	// the segment is synced and the WAL is emptied once the writes go quiet
+	deadline := time.Now().Add(5 * time.Second)
+	for walSize() != fileHeaderSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("WAL size after %v of idleness = %v, want %v", idle, walSize(), fileHeaderSize)
+		}
+		time.Sleep(idle)
+	}
+	if got, _ := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
+
+func TestDiskStore_WithVerifyKeyOnRead(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"), WithVerifyKeyOnRead(verify))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("hamlet", "shakespeare")
+		store.Set("dune", "frank herbert")
+		// a corrupt index, hamlet points to the record of dune
+		kEntry, _ := store.keyDir.get("dune")
+		store.keyDir.put("hamlet", kEntry)
+		val, err := store.Get("hamlet")
+		if verify && !errors.Is(err, ErrKeyMismatch) {
+			t.Errorf("Get() = %v, %v, want %v", val, err, ErrKeyMismatch)
+		}
+		if !verify && val != "frank herbert" {
+			t.Errorf("Get() without the check = %v, %v, want %v", val, err, "frank herbert")
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_WithMustExist(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	if _, err := NewDiskStore(fileName, WithMustExist(true)); !errors.Is(err, ErrDatabaseNotFound) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrDatabaseNotFound)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("NewDiskStore() created the file, stat error = %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	store, err = NewDiskStore(fileName, WithMustExist(true))
+	if err != nil {
+		t.Fatalf("NewDiskStore() of an existing file error = %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
 }
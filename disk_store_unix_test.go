@@ -0,0 +1,28 @@
+//go:build !windows
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDiskStore_FIFO(t *testing.T) {
+	if err := syscall.Mkfifo("test.db", 0666); err != nil {
+		t.Fatalf("failed to create the fifo: %v", err)
+	}
+	defer os.Remove("test.db")
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotRegularFile)
+	}
+	if err := os.Symlink("test.db", "link.db"); err != nil {
+		t.Fatalf("failed to create the symlink: %v", err)
+	}
+	defer os.Remove("link.db")
+	// following the symlink doesn't let a fifo through
+	if _, err := NewDiskStore("link.db", WithFollowSymlinks(true)); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotRegularFile)
+	}
+}
@@ -0,0 +1,165 @@
+package caskdb
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"time"
+)
+
+// DumpTo writes a compacted copy of the store to w. The dump has only the latest
+// value of every key, no overwritten records, and it is in the native format: the
+// file header followed by the records. So the dump is a valid database file by
+// itself, and it can also be fed to Import of another store, say over a socket,
+// to clone this store. The database ID goes first, if the store has one: the
+// database file made of the dump shares the ID, see WithDatabaseID, while the store
+// it is imported to keeps its own.
+//
+// The read lock is held for the entire dump, so the dump is a consistent snapshot
+// of the store. The writes wait till the dump is over.
+func (d *DiskStore) DumpTo(w io.Writer) error {
+	if d.opts.indexOnly {
+		return ErrValuesDisabled
+	}
+	if err := d.restoreEvicted(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, err := w.Write(encodeFileHeader(currentFormat)); err != nil {
+		return err
+	}
+	if record := d.idRecord(currentFormat); record != nil {
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	var err error
+	now := time.Now().Unix()
+	d.keyDir.forEach(func(_ string, kEntry KeyEntry) bool {
+		if kEntry.expired(now) {
+			return true
+		}
+		var data []byte
+		var version uint32
+		if data, version, err = d.readRecord(kEntry); err != nil {
+			return false
+		}
+		if !validChecksum(data, version) {
+			err = ErrChecksumMismatch
+			return false
+		}
+		// the records of an older format are converted to the current one
+		h, key, value, decodeErr := d.decodeRecord(kEntry.fileID, data, version)
+		if decodeErr != nil {
+			err = decodeErr
+			return false
+		}
+		_, record := encodeRecord(h, key, value)
+		_, err = w.Write(record)
+		return err == nil
+	})
+	return err
+}
+
+// ApplyRecord writes a single record, encoded in the current format, to the store.
+// Unlike Set, the timestamp and the flags of the record are kept as they are. It returns
+// ErrInvalidRecord if the data is not a complete record and ErrChecksumMismatch if
+// it is corrupt.
+func (d *DiskStore) ApplyRecord(data []byte) error {
+	if len(data) < headerSize {
+		return ErrInvalidRecord
+	}
+	h := decodeHeader(data[:headerSize], currentFormat)
+	if uint64(len(data)) != uint64(headerSize)+uint64(h.keySize)+uint64(h.valueSize) {
+		return ErrInvalidRecord
+	}
+	if !validChecksum(data, currentFormat) {
+		return ErrChecksumMismatch
+	}
+	h, key, value := decodeKV(data, currentFormat)
+	// the store keeps its own database ID
+	if h.flags&flagDatabaseID != 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.set(unchained(h), key, value)
+}
+
+// unchained drops the link of the digest from the header of a record from another
+// store. It links to the records of that store, this one links its own, or none
+// without WithDigest.
+func unchained(h recordHeader) recordHeader {
+	h.flags &^= flagChained
+	h.chain = 0
+	return h
+}
+
+// Import reads a database from r, as written by DumpTo or any database file, and
+// applies all of its records to the store in order. The format version is read
+// from the file header, so the files of an older format can be imported as well.
+// The database ID of r is left out, the store keeps its own.
+func (d *DiskStore) Import(r io.Reader) error {
+	// the formatV1 files don't have a file header, so the bytes we read here could
+	// be the start of the first record
+	start := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(r, start)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	version, err := decodeFileHeader(start[:n])
+	if err != nil {
+		return err
+	}
+	if version == formatV1 {
+		r = io.MultiReader(bytes.NewReader(start[:n]), r)
+	}
+	hSize := headerSizeOf(version)
+	for {
+		header := make([]byte, hSize)
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return ErrInvalidRecord
+		}
+		if err != nil {
+			return err
+		}
+		h := decodeHeader(header, version)
+		size := uint64(hSize) + uint64(h.keySize) + uint64(h.valueSize)
+		// the positions and the sizes in the keyDir are 32 bits, no record is larger
+		if size > math.MaxUint32 {
+			return ErrInvalidRecord
+		}
+		// the sizes are not checked till the checksum is, so the buffer grows as the
+		// bytes come in, instead of trusting them for one large allocation
+		buf := bytes.NewBuffer(header)
+		_, err = io.CopyN(buf, r, int64(size)-int64(hSize))
+		if err == io.EOF {
+			return ErrInvalidRecord
+		}
+		if err != nil {
+			return err
+		}
+		data := buf.Bytes()
+		if !validChecksum(data, version) {
+			return ErrChecksumMismatch
+		}
+		h, key, value := decodeKV(data, version)
+		if h.flags&flagDatabaseID != 0 {
+			continue
+		}
+		d.mu.Lock()
+		err = d.set(unchained(h), key, value)
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
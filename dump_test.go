@@ -0,0 +1,165 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDiskStore_DumpTo(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+		"othello":              "shakespeare",
+		"brave new world":      "huxley",
+		"dune":                 "frank herbert",
+	}
+	for key := range tests {
+		store.Set(key, "old value")
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+
+	clone, err := NewDiskStore("clone.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("clone.db")
+	defer clone.Close()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(store.DumpTo(w))
+	}()
+	if err := clone.Import(r); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	for key, val := range tests {
+		if got, _ := clone.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+		want, _ := store.Info(key)
+		if got, _ := clone.Info(key); got.Timestamp != want.Timestamp {
+			t.Errorf("Info() timestamp = %v, want %v", got.Timestamp, want.Timestamp)
+		}
+	}
+	if clone.Len() != len(tests) {
+		t.Errorf("Len() = %v, want %v", clone.Len(), len(tests))
+	}
+}
+
+func TestDiskStore_DumpToSkipsDeadRecords(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	for i := 0; i < 10; i++ {
+		store.Set("hamlet", "shakespeare")
+	}
+	var buf bytes.Buffer
+	if err := store.DumpTo(&buf); err != nil {
+		t.Fatalf("DumpTo() error = %v", err)
+	}
+	size, _ := encodeKV(0, "hamlet", "shakespeare")
+	if buf.Len() != fileHeaderSize+size {
+		t.Errorf("DumpTo() wrote %v bytes, want %v", buf.Len(), fileHeaderSize+size)
+	}
+}
+
+func TestDiskStore_ApplyRecord(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	_, record := encodeKV(42, "hamlet", "shakespeare")
+	if err := store.ApplyRecord(record); err != nil {
+		t.Fatalf("ApplyRecord() error = %v", err)
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if info, _ := store.Info("hamlet"); info.Timestamp != 42 {
+		t.Errorf("Info() timestamp = %v, want %v", info.Timestamp, 42)
+	}
+	if err := store.ApplyRecord(record[:len(record)-1]); err != ErrInvalidRecord {
+		t.Errorf("ApplyRecord() error = %v, want %v", err, ErrInvalidRecord)
+	}
+	record[len(record)-1] = '?'
+	if err := store.ApplyRecord(record); err != ErrChecksumMismatch {
+		t.Errorf("ApplyRecord() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestDiskStore_ImportHugeRecord(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// a header which claims a value of about 4GiB, with a few bytes behind it
+	_, record := encodeKV(0, "hamlet", "shakespeare")
+	binary.LittleEndian.PutUint32(record[17:21], math.MaxUint32-64)
+	stream := append(encodeFileHeader(currentFormat), record...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := store.Import(bytes.NewReader(stream)); err != ErrInvalidRecord {
+		t.Errorf("Import() error = %v, want %v", err, ErrInvalidRecord)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Import() allocated %v bytes, want at most %v", allocated, 1<<20)
+	}
+}
+
+func TestDiskStore_ImportChained(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"), WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("ulysses", "joyce")
+	var buf bytes.Buffer
+	if err := store.DumpTo(&buf); err != nil {
+		t.Fatalf("DumpTo() error = %v", err)
+	}
+	cloneName := filepath.Join(dir, "clone.db")
+	clone, err := NewDiskStore(cloneName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := clone.Import(&buf); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	clone.Close()
+	// without WithDigest, the clone has no links of its own
+	data, _ := os.ReadFile(cloneName)
+	for position := fileHeaderSize; position < len(data); {
+		h := decodeHeader(data[position:position+headerSize], currentFormat)
+		if h.flags&flagChained != 0 {
+			t.Errorf("record at %v flags = %v, want no flagChained", position, h.flags)
+		}
+		position += headerSize + int(h.keySize+h.valueSize)
+	}
+}
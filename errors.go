@@ -0,0 +1,86 @@
+package caskdb
+
+import "errors"
+
+// ErrKeyNotFound is returned by Get when the key does not exist in the store
+var ErrKeyNotFound = errors.New("caskdb: key not found")
+
+// ErrValuesDisabled is returned by Get when the store was opened with
+// WithIndexOnly, which does not serve the values
+var ErrValuesDisabled = errors.New("caskdb: values are disabled in index only mode")
+
+// ErrQueueFull is returned by SetAsync when the async queue is full and the store
+// was opened with the RejectWhenFull policy
+var ErrQueueFull = errors.New("caskdb: async write queue is full")
+
+// ErrChecksumMismatch is returned when a record read from the disk does not match
+// its checksum, i.e. the record is corrupt. See WithCorruptionFallback
+var ErrChecksumMismatch = errors.New("caskdb: record checksum mismatch")
+
+// ErrUnknownFormat is returned when the file header has a format version which
+// this version of caskdb does not know of
+var ErrUnknownFormat = errors.New("caskdb: unknown file format version")
+
+// ErrBadMagic is returned when a file is not empty, but too short to have the file
+// header or any record, see decodeFileHeader
+var ErrBadMagic = errors.New("caskdb: file is too short to have the file header")
+
+// ErrInvalidRecord is returned when the bytes given to be applied as a record are
+// not a complete record
+var ErrInvalidRecord = errors.New("caskdb: invalid record")
+
+// ErrMisaligned is reported by Verify when the records do not line up with the
+// file, see Verify
+var ErrMisaligned = errors.New("caskdb: record boundaries do not line up with the file")
+
+// ErrNotRegularFile is returned by NewDiskStore when the database path is not a
+// regular file, like a directory, a named pipe or a device. It is also returned for
+// a symlink, unless WithFollowSymlinks allows it.
+var ErrNotRegularFile = errors.New("caskdb: not a regular file")
+
+// ErrRepairInPlace is returned by Repair when the destination is the database file
+// itself, Repair never modifies the store
+var ErrRepairInPlace = errors.New("caskdb: repair destination is the database file")
+
+// ErrFileFull is returned by the writes which don't fit in the active segment under
+// the WithMaxFileSize limit, with the RejectWhenFileFull policy. With the
+// RotateWhenFileFull policy, it is returned only for a record too large to fit even
+// in an empty segment.
+var ErrFileFull = errors.New("caskdb: database file is full")
+
+// ErrReadOnly is returned by the writes to a store opened with WithReadOnly
+var ErrReadOnly = errors.New("caskdb: store is read-only")
+
+// ErrStale is returned by RefreshReadOnly when the files changed beyond the appends
+// to the active segment, like a rotation or a merge by the writer. The store has to
+// be reopened to catch up.
+var ErrStale = errors.New("caskdb: store changed on the disk, reopen it")
+
+// ErrInvalidKey is returned by the writes of a key which is not valid UTF-8, when
+// the store was opened with WithUTF8Keys
+var ErrInvalidKey = errors.New("caskdb: invalid key")
+
+// ErrNotCounter is returned by CounterStore when the value of a key is not a
+// counter
+var ErrNotCounter = errors.New("caskdb: value is not a counter")
+
+// ErrSegmentLive is returned by DropSegment when the records of the segment are
+// still needed
+var ErrSegmentLive = errors.New("caskdb: segment has live records")
+
+// ErrTooManyCorrupt is returned by NewDiskStore when the files have more corrupt
+// records than WithMaxSkippedRecords allows
+var ErrTooManyCorrupt = errors.New("caskdb: too many corrupt records")
+
+// ErrKeyMismatch is returned by the reads when the record the keyDir points to is of
+// another key, with WithVerifyKeyOnRead
+var ErrKeyMismatch = errors.New("caskdb: record is of another key")
+
+// ErrDatabaseNotFound is returned by NewDiskStore when the database file does not
+// exist, with WithMustExist
+var ErrDatabaseNotFound = errors.New("caskdb: database file does not exist")
+
+// ErrStaleWatermark is returned by ShipSince for a watermark past the end of the
+// store, one from before a rewrite of the files like Merge. The follower has to start
+// over from the zero watermark.
+var ErrStaleWatermark = errors.New("caskdb: watermark is past the end of the store")
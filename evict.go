@@ -0,0 +1,222 @@
+package caskdb
+
+import (
+	"sort"
+	"time"
+)
+
+// With WithMaxIndexKeys, the keyDir holds at most about that many keys, and the
+// KeyEntries of the cold keys are evicted from it. The records stay on the disk
+// untouched, only the index forgets about them, so no data is lost. When an evicted
+// key is read next, its KeyEntry is found again by scanning the segments from the
+// newest to the oldest, and put back in the keyDir.
+//
+// The keyDir alone can't tell an evicted key apart from a missing one, so the
+// evicted keys are added to a bloom filter. A lookup of a key which is neither in
+// the keyDir nor in the filter is a miss straight away. A false positive of the
+// filter only costs a scan.
+//
+// The operations which need all the keys, like Keys, Len, Merge and DumpTo, load the
+// evicted keys back first by rebuilding the keyDir, which takes a full scan and
+// needs the memory for all the keys till the next eviction.
+
+// evictFraction is the part of the keyDir which is evicted at once, when it grows
+// past the limit. Evicting in batches keeps the cost of finding the cold keys low
+const evictFraction = 10
+
+// evictCold evicts the coldest keys if the keyDir has grown past the limit. The
+// cold keys are the ones written the longest time ago. The reads are not tracked,
+// they don't take the write lock. The key keep is never evicted, it is the one just
+// put in the keyDir: a reloaded key is as cold as they get, and evicting it right
+// away would lose it for the caller. The caller must hold the write lock.
+func (d *DiskStore) evictCold(keep string) {
+	limit := d.opts.maxIndexKeys
+	if limit <= 0 || d.keyDir.len() <= limit {
+		return
+	}
+	n := d.keyDir.len() - limit + limit/evictFraction
+	timestamps := make([]uint64, 0, d.keyDir.len())
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if key != keep {
+			timestamps = append(timestamps, kEntry.timestamp)
+		}
+		return true
+	})
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	cutoff := timestamps[n-1]
+	keys := make([]string, 0, n)
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.timestamp < cutoff && key != keep {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	// the keys with the cutoff timestamp make up the rest
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if len(keys) == n {
+			return false
+		}
+		if kEntry.timestamp == cutoff && key != keep {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		d.keyDir.delete(key)
+		d.expiry.remove(key)
+		d.evicted.add(key)
+	}
+}
+
+// reloadEvicted puts the KeyEntry of the key back in the keyDir, if it was evicted.
+func (d *DiskStore) reloadEvicted(key string) error {
+	if d.evicted == nil {
+		return nil
+	}
+	d.mu.RLock()
+	_, ok := d.keyDir.get(key)
+	maybe := !ok && d.evicted.mayContain(key)
+	d.mu.RUnlock()
+	if !maybe {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reloadEvictedLocked(key)
+}
+
+// reloadEvictedLocked is reloadEvicted, the caller must hold the write lock.
+func (d *DiskStore) reloadEvictedLocked(key string) error {
+	if d.evicted == nil || !d.evicted.mayContain(key) {
+		return nil
+	}
+	if _, ok := d.keyDir.get(key); ok {
+		return nil
+	}
+	kEntry, ok, err := d.findLatest(key)
+	if err != nil || !ok {
+		return err
+	}
+	d.keyDir.put(key, kEntry)
+	d.expiry.set(key, kEntry.expiry)
+	d.evictCold(key)
+	return nil
+}
+
+// findLatest scans the segments for the latest record of the key. It returns false
+// if there is none, or if the latest is a tombstone or has expired. The caller must
+// hold the lock.
+func (d *DiskStore) findLatest(key string) (KeyEntry, bool, error) {
+	segments := d.allSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		var found bool
+		var latest recordHeader
+		var position int
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(p int, h recordHeader, k []byte) error {
+			if string(k) == key && h.flags&flagBlob == 0 {
+				found, latest, position = true, h, p
+			}
+			return nil
+		})
+		if err != nil {
+			return KeyEntry{}, false, err
+		}
+		if !found {
+			continue
+		}
+		kEntry := NewKeyEntry(seg.id, latest.timestamp, uint32(position), headerSizeOf(seg.version)+latest.keySize+latest.valueSize)
+		kEntry.expiry = latest.expiry
+		if latest.flags&flagTombstone != 0 || kEntry.expired(time.Now().Unix()) {
+			return KeyEntry{}, false, nil
+		}
+		return kEntry, true, nil
+	}
+	return KeyEntry{}, false, nil
+}
+
+// restoreEvicted loads all the evicted keys back in the keyDir, for the operations
+// which need all of them.
+func (d *DiskStore) restoreEvicted() error {
+	if d.evicted == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.restoreEvictedLocked()
+}
+
+// restoreEvictedLocked is restoreEvicted, the caller must hold the write lock.
+func (d *DiskStore) restoreEvictedLocked() error {
+	if d.evicted == nil || d.evicted.empty() {
+		return nil
+	}
+	return d.rebuildIndex()
+}
+
+// evictedFilter is a bloom filter of the evicted keys. The keys can't be removed
+// from it, it is cleared when the keyDir is rebuilt with all the keys.
+type evictedFilter struct {
+	bits []uint64
+	// added is the number of keys added since the last reset
+	added int
+}
+
+// evictedFilterHashes is the number of bits set for every key
+const evictedFilterHashes = 4
+
+// newEvictedFilter returns a filter sized for about the given number of keys
+func newEvictedFilter(keys int) *evictedFilter {
+	// 16 bits per key keeps the false positives well under 1%
+	words := keys * 16 / 64
+	if words < 1024 {
+		words = 1024
+	}
+	return &evictedFilter{bits: make([]uint64, words)}
+}
+
+// positions calls fn with the bit positions of the key, by double hashing the two
+// halves of its 64-bit FNV-1a hash
+func (f *evictedFilter) positions(key string, fn func(bit uint64)) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h1, h2 := h&0xffffffff, h>>32|1
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < evictedFilterHashes; i++ {
+		fn((h1 + i*h2) % size)
+	}
+}
+
+func (f *evictedFilter) add(key string) {
+	f.positions(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+	f.added++
+}
+
+func (f *evictedFilter) mayContain(key string) bool {
+	if f.added == 0 {
+		return false
+	}
+	found := true
+	f.positions(key, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (f *evictedFilter) empty() bool {
+	return f.added == 0
+}
+
+func (f *evictedFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+	f.added = 0
+}
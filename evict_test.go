@@ -0,0 +1,113 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_WithMaxIndexKeys(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithMaxIndexKeys(100))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	// the older the timestamp, the colder the key
+	for i := 0; i < 300; i++ {
+		_, record := encodeKV(uint64(1000+i), fmt.Sprintf("key %d", i), fmt.Sprintf("value %d", i))
+		if err := store.ApplyRecord(record); err != nil {
+			t.Fatalf("ApplyRecord() error = %v", err)
+		}
+	}
+	if got := store.keyDir.len(); got > 100 {
+		t.Errorf("keyDir.len() = %v, want at most %v", got, 100)
+	}
+	if _, ok := store.keyDir.get("key 0"); ok {
+		t.Fatalf("keyDir.get() = true, want the cold key evicted")
+	}
+	if got, err := store.Get("key 0"); err != nil || got != "value 0" {
+		t.Errorf("Get() = %v, %v, want %v, nil", got, err, "value 0")
+	}
+	if _, ok := store.keyDir.get("key 0"); !ok {
+		t.Errorf("keyDir.get() = false, want the entry reloaded")
+	}
+	if _, err := store.Get("some key"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Delete("key 1")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithMaxIndexKeys(100))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("key 1"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v for a deleted key", err, ErrKeyNotFound)
+	}
+	for _, i := range []int{2, 150, 299} {
+		if got, _ := store.Get(fmt.Sprintf("key %d", i)); got != fmt.Sprintf("value %d", i) {
+			t.Errorf("Get() = %v, want %v", got, fmt.Sprintf("value %d", i))
+		}
+	}
+	if got := len(store.Keys()); got != 299 {
+		t.Errorf("len(Keys()) = %v, want %v", got, 299)
+	}
+}
+
+func TestDiskStore_WithMaxIndexKeysAtLimit(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithMaxIndexKeys(100))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the older the timestamp, the colder the key
+	i := 0
+	add := func() {
+		_, record := encodeKV(uint64(1000+i), fmt.Sprintf("key %d", i), fmt.Sprintf("value %d", i))
+		if err := store.ApplyRecord(record); err != nil {
+			t.Fatalf("ApplyRecord() error = %v", err)
+		}
+		i++
+	}
+	// fill writes new keys till the keyDir is at the limit again
+	fill := func() {
+		for store.keyDir.len() < 100 {
+			add()
+		}
+	}
+	// one past the limit evicts the coldest keys
+	fill()
+	add()
+	fill()
+	if _, ok := store.keyDir.get("key 0"); ok {
+		t.Fatalf("keyDir.get() = true, want the cold key evicted")
+	}
+	if got, err := store.Get("key 0"); err != nil || got != "value 0" {
+		t.Errorf("Get() = %v, %v, want %v, nil", got, err, "value 0")
+	}
+	fill()
+	if err := store.Delete("key 1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Get("key 1"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v for a deleted key", err, ErrKeyNotFound)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithMaxIndexKeys(100))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("key 1"); err != ErrKeyNotFound {
+		t.Errorf("Get() after reopen error = %v, want %v for a deleted key", err, ErrKeyNotFound)
+	}
+	if got, err := store.Get("key 0"); err != nil || got != "value 0" {
+		t.Errorf("Get() after reopen = %v, %v, want %v, nil", got, err, "value 0")
+	}
+}
@@ -0,0 +1,162 @@
+package caskdb
+
+import (
+	"container/heap"
+	"time"
+)
+
+// SetWithTTL is like Set, but the key expires after the ttl. Once it expires, the
+// key is not visible to Get and the other reads, and it is gone after the next
+// startup. PurgeExpired removes the expired keys from the keyDir right away.
+//
+// The expiry is kept in the record, in unix epoch seconds, so it is rounded down to
+// the second.
+func (d *DiskStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	now := time.Now()
+	h := recordHeader{
+		timestamp: uint64(now.Unix()),
+		flags:     flagExpiry,
+		expiry:    uint64(now.Add(ttl).Unix()),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.set(h, key, value)
+}
+
+// Delete removes the key from the store, by writing a tombstone record for it. The
+// space of the older records of the key is reclaimed by Merge. Deleting a key which
+// does not exist is not an error.
+func (d *DiskStore) Delete(key string) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.reloadEvictedLocked(key); err != nil {
+		return err
+	}
+	if _, ok := d.keyDir.get(key); !ok {
+		return nil
+	}
+	h := recordHeader{timestamp: uint64(time.Now().Unix()), flags: flagTombstone}
+	return d.set(h, key, "")
+}
+
+// PurgeExpired removes the expired keys from the keyDir, and returns how many were
+// removed. Only the expired keys are looked at, see expiryIndex, so it is cheap to
+// call often even with millions of keys.
+//
+// Nothing is written to the disk, the records have the expiry already and they are
+// skipped at the next startup.
+func (d *DiskStore) PurgeExpired() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.purgeExpired(time.Now().Unix())
+}
+
+// purgeExpired is PurgeExpired as of now, in unix epoch seconds. The caller must
+// hold the write lock.
+func (d *DiskStore) purgeExpired(now int64) int {
+	purged := 0
+	for d.expiry.len() > 0 {
+		item := d.expiry.items[0]
+		if int64(item.expiry) > now {
+			break
+		}
+		d.expiry.remove(item.key)
+		d.keyDir.delete(item.key)
+		purged++
+	}
+	return purged
+}
+
+// expiryIndex keeps the keys with an expiry in a min-heap ordered by the expiry
+// time, so that the expired keys can be found without scanning the whole keyDir. It
+// also maps every key to its place in the heap, which lets an overwrite or a delete
+// move or remove the key in O(log n).
+//
+// The keys without an expiry are not in it, and they cost nothing.
+type expiryIndex struct {
+	items expiryHeap
+	byKey map[string]*expiryItem
+}
+
+type expiryItem struct {
+	key    string
+	expiry uint64
+	// index is the position of the item in the heap
+	index int
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{byKey: make(map[string]*expiryItem)}
+}
+
+// set sets the expiry of the key, zero removes the key from the index
+func (e *expiryIndex) set(key string, expiry uint64) {
+	if expiry == 0 {
+		e.remove(key)
+		return
+	}
+	if item, ok := e.byKey[key]; ok {
+		item.expiry = expiry
+		heap.Fix(&e.items, item.index)
+		return
+	}
+	item := &expiryItem{key: key, expiry: expiry}
+	e.byKey[key] = item
+	heap.Push(&e.items, item)
+}
+
+func (e *expiryIndex) remove(key string) {
+	item, ok := e.byKey[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&e.items, item.index)
+	delete(e.byKey, key)
+}
+
+func (e *expiryIndex) len() int {
+	return len(e.items)
+}
+
+// rebuild throws away the index and builds it again from keyDir
+func (e *expiryIndex) rebuild(keyDir keyIndex) {
+	*e = *newExpiryIndex()
+	keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.expiry != 0 {
+			item := &expiryItem{key: key, expiry: kEntry.expiry, index: len(e.items)}
+			e.byKey[key] = item
+			e.items = append(e.items, item)
+		}
+		return true
+	})
+	heap.Init(&e.items)
+}
+
+// expiryHeap implements heap.Interface
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry < h[j].expiry }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
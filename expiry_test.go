@@ -0,0 +1,146 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SetWithTTL(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.SetWithTTL("crime and punishment", "dostoevsky", time.Hour)
+	store.SetWithTTL("anna karenina", "tolstoy", -time.Hour)
+	if got, _ := store.Get("crime and punishment"); got != "dostoevsky" {
+		t.Errorf("Get() = %v, want %v", got, "dostoevsky")
+	}
+	if _, err := store.Get("anna karenina"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v for an expired key", err, ErrKeyNotFound)
+	}
+	if store.Has("anna karenina") {
+		t.Errorf("Has() = true, want false for an expired key")
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if got, _ := store.Get("crime and punishment"); got != "dostoevsky" {
+		t.Errorf("Get() after reopen = %v, want %v", got, "dostoevsky")
+	}
+	if store.Len() != 1 {
+		t.Errorf("Len() after reopen = %v, want %v", store.Len(), 1)
+	}
+}
+
+func TestDiskStore_PurgeExpired(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	for i := 0; i < 1000; i++ {
+		store.SetWithTTL(fmt.Sprintf("live %d", i), "value", time.Hour)
+	}
+	for i := 0; i < 3; i++ {
+		store.SetWithTTL(fmt.Sprintf("expired %d", i), "value", -time.Hour)
+	}
+	store.Set("no ttl", "value")
+	// an expired key written again with a longer ttl moves in the expiry index
+	store.SetWithTTL("rewritten", "value", -time.Hour)
+	store.SetWithTTL("rewritten", "value", time.Hour)
+	// and one written without one leaves it
+	store.SetWithTTL("persisted", "value", -time.Hour)
+	store.Set("persisted", "value")
+
+	if got := store.PurgeExpired(); got != 3 {
+		t.Errorf("PurgeExpired() = %v, want %v", got, 3)
+	}
+	if got := store.expiry.len(); got != 1001 {
+		t.Errorf("expiry.len() = %v, want %v", got, 1001)
+	}
+	if got := store.Len(); got != 1003 {
+		t.Errorf("Len() = %v, want %v", got, 1003)
+	}
+	for _, key := range []string{"no ttl", "rewritten", "persisted", "live 42"} {
+		if !store.Has(key) {
+			t.Errorf("Has(%q) = false, want true", key)
+		}
+	}
+	if got := store.PurgeExpired(); got != 0 {
+		t.Errorf("PurgeExpired() = %v, want %v", got, 0)
+	}
+	// an hour later, all the keys with a ttl expire
+	if got := store.purgeExpired(time.Now().Add(2 * time.Hour).Unix()); got != 1001 {
+		t.Errorf("purgeExpired() = %v, want %v", got, 1001)
+	}
+}
+
+func TestDiskStore_DeleteTombstone(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("crime and punishment", "dostoevsky")
+	store.SetWithTTL("anna karenina", "tolstoy", time.Hour)
+	store.Delete("crime and punishment")
+	store.Delete("anna karenina")
+	if err := store.Delete("some key"); err != nil {
+		t.Errorf("Delete() error = %v, want nil for a missing key", err)
+	}
+	if store.expiry.len() != 0 {
+		t.Errorf("expiry.len() = %v, want 0", store.expiry.len())
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("crime and punishment"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v for a deleted key", err, ErrKeyNotFound)
+	}
+	if got := store.Keys(); len(got) != 1 || got[0] != "hamlet" {
+		t.Errorf("Keys() = %v, want [hamlet]", got)
+	}
+}
+
+func TestDiskStore_DeleteLegacyFormat(t *testing.T) {
+	// the formatV1 records have no flags, the tombstone goes to a new segment
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	_, record := encodeKVV1(uint64(time.Now().Unix()), "hamlet", "shakespeare")
+	if err := os.WriteFile(fileName, record, 0666); err != nil {
+		t.Fatalf("failed to write the db file: %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Delete("hamlet"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if store.version != currentFormat {
+		t.Errorf("version = %v, want %v", store.version, currentFormat)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Has("hamlet") {
+		t.Errorf("Has() = true, want false for a deleted key")
+	}
+}
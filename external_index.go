@@ -0,0 +1,429 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// externalIndex keeps the keyDir on the disk, for the stores with more keys than
+// fit in the RAM even in a compactIndex, see WithExternalIndex. It has:
+//
+//   - runs, files with the entries of the keys sorted by the key, the oldest first.
+//     A deleted key has an entry too, which hides it in the older runs
+//   - sparse, for every run, the first key of every block of externalIndexBlock
+//     entries of it, and where the block starts in the file
+//   - buffer, the recent puts and deletes, not yet in a run
+//
+// Once the buffer has bufferSize keys, it is written out sorted as a new run, and
+// none of the older runs are touched. The runs are then merged like in an external
+// sort: once there are runFanIn runs of the same level, they are merged into a single
+// run of the next level, in one k-way pass over them. So every entry is rewritten
+// about log(N/bufferSize) times in all, not at every flush. A lookup checks the
+// buffer, and then the runs from the newest, each with a binary search over its
+// sparse entries and a single ReadAt of a block. So the memory in use is the buffer,
+// plus a sparse entry per block, however many keys there are.
+//
+// A put can't tell whether the key is new without a lookup, so the number of the
+// live keys is not kept up to date by the writes. len counts it in a pass over the
+// runs instead, and keeps it till the next put or delete.
+//
+// The lookups don't modify the index, so they run concurrently under the store's
+// read lock like with the other indexes. There is no way to report an I/O error of
+// a run through keyIndex, the index records the first one instead, see indexErr, and
+// the store returns it from its next read or write. The buffer is not flushed any
+// more after an error, the writes stay in the memory.
+type externalIndex struct {
+	dir    string
+	runs   []*indexRun
+	buffer map[string]bufferedEntry
+	// bufferSize is the number of the keys buffered before they are flushed to a run
+	bufferSize int
+	// blockSize is the number of the entries in a block of a run
+	blockSize int
+	// mu guards live and failure, len and the lookups change them under the store's
+	// read lock
+	mu sync.Mutex
+	// live is the number of the live keys, -1 till len counts them again
+	live    int
+	failure error
+}
+
+// indexRun is a sorted run of the externalIndex
+type indexRun struct {
+	file    *os.File
+	size    int64
+	sparse  []sparseEntry
+	entries int
+	// level is the number of the merges the entries went through, see runFanIn
+	level int
+}
+
+// sparseEntry is the first key of a block of a run, and the offset of the block
+type sparseEntry struct {
+	key    string
+	offset int64
+}
+
+// bufferedEntry is a put of the key, or a delete
+type bufferedEntry struct {
+	kEntry  KeyEntry
+	deleted bool
+}
+
+const (
+	// externalIndexBuffer is the number of the keys buffered in the memory
+	externalIndexBuffer = 64 * 1024
+	// externalIndexBlock is the number of the entries read for a lookup
+	externalIndexBlock = 64
+	// runFanIn is the number of the runs of a level merged together into one run of
+	// the next level
+	runFanIn = 8
+	// runEntryHeaderSize is the size of an entry of a run without the key: the key
+	// size, the deleted flag, the segment id, the timestamp, the position, the total
+	// size and the expiry
+	runEntryHeaderSize = 4 + 1 + 4 + 8 + 4 + 4 + 8
+)
+
+func newExternalIndex(dir string, bufferSize int, blockSize int) *externalIndex {
+	return &externalIndex{
+		dir:        dir,
+		buffer:     make(map[string]bufferedEntry),
+		bufferSize: bufferSize,
+		blockSize:  blockSize,
+	}
+}
+
+func (x *externalIndex) get(key string) (KeyEntry, bool) {
+	if b, ok := x.buffer[key]; ok {
+		return b.kEntry, !b.deleted
+	}
+	for i := len(x.runs) - 1; i >= 0; i-- {
+		b, ok, err := x.runs[i].get(key)
+		if err != nil {
+			x.fail(fmt.Errorf("caskdb: reading the external index: %w", err))
+			return KeyEntry{}, false
+		}
+		if ok {
+			return b.kEntry, !b.deleted
+		}
+	}
+	return KeyEntry{}, false
+}
+
+// get looks up the key in the run only
+func (r *indexRun) get(key string) (bufferedEntry, bool, error) {
+	i := sort.Search(len(r.sparse), func(i int) bool { return r.sparse[i].key > key }) - 1
+	if i < 0 {
+		return bufferedEntry{}, false, nil
+	}
+	end := r.size
+	if i+1 < len(r.sparse) {
+		end = r.sparse[i+1].offset
+	}
+	block := make([]byte, end-r.sparse[i].offset)
+	if err := readFull(r.file, block, r.sparse[i].offset); err != nil {
+		return bufferedEntry{}, false, err
+	}
+	for len(block) > 0 {
+		k, b, n := decodeRunEntry(block)
+		if k == key {
+			return b, true, nil
+		}
+		if k > key {
+			break
+		}
+		block = block[n:]
+	}
+	return bufferedEntry{}, false, nil
+}
+
+func (x *externalIndex) put(key string, kEntry KeyEntry) {
+	x.buffer[key] = bufferedEntry{kEntry: kEntry}
+	x.resetLive()
+	x.maybeFlush()
+}
+
+func (x *externalIndex) delete(key string) {
+	x.buffer[key] = bufferedEntry{deleted: true}
+	x.resetLive()
+	x.maybeFlush()
+}
+
+func (x *externalIndex) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.live >= 0 {
+		return x.live
+	}
+	live := 0
+	err := mergeRuns(x.runs, x.buffer, func(_ string, b bufferedEntry) bool {
+		if !b.deleted {
+			live++
+		}
+		return true
+	})
+	if err != nil {
+		if x.failure == nil {
+			x.failure = fmt.Errorf("caskdb: reading the external index: %w", err)
+		}
+		return live
+	}
+	x.live = live
+	return live
+}
+
+// resetLive makes len count the live keys again
+func (x *externalIndex) resetLive() {
+	x.mu.Lock()
+	x.live = -1
+	x.mu.Unlock()
+}
+
+func (x *externalIndex) forEach(fn func(key string, kEntry KeyEntry) bool) {
+	err := mergeRuns(x.runs, x.buffer, func(key string, b bufferedEntry) bool {
+		return b.deleted || fn(key, b.kEntry)
+	})
+	if err != nil {
+		x.fail(fmt.Errorf("caskdb: reading the external index: %w", err))
+	}
+}
+
+// fail records the I/O error, only the first one is kept
+func (x *externalIndex) fail(err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.failure == nil {
+		x.failure = err
+	}
+}
+
+// err returns the first I/O error the index ran into, see indexErr
+func (x *externalIndex) err() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.failure
+}
+
+// maybeFlush writes the buffer out to a new run once it is full, and merges the runs
+// as needed
+func (x *externalIndex) maybeFlush() {
+	if len(x.buffer) < x.bufferSize || x.err() != nil {
+		return
+	}
+	if err := x.flush(); err != nil {
+		x.fail(fmt.Errorf("caskdb: writing the external index: %w", err))
+	}
+}
+
+// flush writes the buffer to a new run of level zero, and empties it. Then the runs
+// of a level are merged, as long as there are runFanIn of them.
+func (x *externalIndex) flush() error {
+	run, err := x.writeRun(0, nil, x.buffer, len(x.runs) == 0)
+	if err != nil {
+		return err
+	}
+	x.runs = append(x.runs, run)
+	x.buffer = make(map[string]bufferedEntry)
+	// the levels only go down from the oldest run to the newest, so the runs of the
+	// same level are always the newest ones
+	for n := len(x.runs); n >= runFanIn && x.runs[n-runFanIn].level == x.runs[n-1].level; n = len(x.runs) {
+		merging := x.runs[n-runFanIn:]
+		run, err := x.writeRun(merging[0].level+1, merging, nil, n == runFanIn)
+		if err != nil {
+			return err
+		}
+		for _, r := range merging {
+			r.close()
+		}
+		x.runs = append(x.runs[:n-runFanIn], run)
+	}
+	return nil
+}
+
+// writeRun merges the runs and the buffer into a new run, see mergeRuns. The deleted
+// keys are left out if oldest is set: the new run is the oldest one, there is nothing
+// older for them to hide.
+func (x *externalIndex) writeRun(level int, runs []*indexRun, buffer map[string]bufferedEntry, oldest bool) (*indexRun, error) {
+	file, err := os.CreateTemp(x.dir, "caskdb-index-*")
+	if err != nil {
+		return nil, err
+	}
+	run := &indexRun{file: file, level: level}
+	w := bufio.NewWriter(file)
+	var buf []byte
+	var writeErr error
+	err = mergeRuns(runs, buffer, func(key string, b bufferedEntry) bool {
+		if b.deleted && oldest {
+			return true
+		}
+		if run.entries%x.blockSize == 0 {
+			run.sparse = append(run.sparse, sparseEntry{key, run.size})
+		}
+		buf = appendRunEntry(buf[:0], key, b)
+		if _, writeErr = w.Write(buf); writeErr != nil {
+			return false
+		}
+		run.size += int64(len(buf))
+		run.entries++
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		run.close()
+		return nil, err
+	}
+	return run, nil
+}
+
+// runCursor walks the entries of a run, or of the buffer, in the order of the keys
+type runCursor struct {
+	r *bufio.Reader
+	// keys are the keys of the buffer left to walk, if r is nil
+	keys   []string
+	buffer map[string]bufferedEntry
+	key    string
+	entry  bufferedEntry
+	done   bool
+}
+
+// next moves the cursor to the next entry, or sets done past the last one
+func (c *runCursor) next() error {
+	if c.r == nil {
+		if len(c.keys) == 0 {
+			c.done = true
+			return nil
+		}
+		c.key, c.entry = c.keys[0], c.buffer[c.keys[0]]
+		c.keys = c.keys[1:]
+		return nil
+	}
+	key, b, err := readRunEntry(c.r)
+	if err == io.EOF {
+		c.done = true
+		return nil
+	}
+	c.key, c.entry = key, b
+	return err
+}
+
+// mergeRuns calls fn for every key of the runs and the buffer, in the order of the
+// keys, till fn returns false. The runs are the oldest first, and the buffer is newer
+// than all of them: fn gets the newest entry of a key, deleted or not. It is a k-way
+// merge, every run is read once sequentially.
+func mergeRuns(runs []*indexRun, buffer map[string]bufferedEntry, fn func(key string, b bufferedEntry) bool) error {
+	cursors := make([]*runCursor, 0, len(runs)+1)
+	for _, run := range runs {
+		cursors = append(cursors, &runCursor{r: bufio.NewReader(io.NewSectionReader(run.file, 0, run.size))})
+	}
+	if len(buffer) > 0 {
+		keys := make([]string, 0, len(buffer))
+		for key := range buffer {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		cursors = append(cursors, &runCursor{keys: keys, buffer: buffer})
+	}
+	for _, c := range cursors {
+		if err := c.next(); err != nil {
+			return err
+		}
+	}
+	for {
+		// the smallest key, of the newest cursor on a tie
+		var least *runCursor
+		for _, c := range cursors {
+			if !c.done && (least == nil || c.key <= least.key) {
+				least = c
+			}
+		}
+		if least == nil {
+			return nil
+		}
+		key, b := least.key, least.entry
+		for _, c := range cursors {
+			if !c.done && c.key == key {
+				if err := c.next(); err != nil {
+					return err
+				}
+			}
+		}
+		if !fn(key, b) {
+			return nil
+		}
+	}
+}
+
+// close closes and removes all the runs, the index is not of any use after
+func (x *externalIndex) close() error {
+	var err error
+	for _, run := range x.runs {
+		if closeErr := run.close(); err == nil {
+			err = closeErr
+		}
+	}
+	x.runs = nil
+	return err
+}
+
+// close closes and removes the file of the run
+func (r *indexRun) close() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
+
+func appendRunEntry(dst []byte, key string, b bufferedEntry) []byte {
+	var deleted byte
+	if b.deleted {
+		deleted = 1
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(key)))
+	dst = append(dst, deleted)
+	dst = binary.LittleEndian.AppendUint32(dst, b.kEntry.fileID)
+	dst = binary.LittleEndian.AppendUint64(dst, b.kEntry.timestamp)
+	dst = binary.LittleEndian.AppendUint32(dst, b.kEntry.position)
+	dst = binary.LittleEndian.AppendUint32(dst, b.kEntry.totalSize)
+	dst = binary.LittleEndian.AppendUint64(dst, b.kEntry.expiry)
+	return append(dst, key...)
+}
+
+// decodeRunEntry decodes the entry at the start of data, and returns its size
+func decodeRunEntry(data []byte) (string, bufferedEntry, int) {
+	keySize := int(binary.LittleEndian.Uint32(data[0:4]))
+	b := bufferedEntry{
+		deleted: data[4] != 0,
+		kEntry: KeyEntry{
+			fileID:    binary.LittleEndian.Uint32(data[5:9]),
+			timestamp: binary.LittleEndian.Uint64(data[9:17]),
+			position:  binary.LittleEndian.Uint32(data[17:21]),
+			totalSize: binary.LittleEndian.Uint32(data[21:25]),
+			expiry:    binary.LittleEndian.Uint64(data[25:33]),
+		},
+	}
+	size := runEntryHeaderSize + keySize
+	return string(data[runEntryHeaderSize:size]), b, size
+}
+
+// readRunEntry reads the next entry of a run from r, io.EOF past the last one
+func readRunEntry(r *bufio.Reader) (string, bufferedEntry, error) {
+	header := make([]byte, runEntryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", bufferedEntry{}, err
+	}
+	entry := make([]byte, runEntryHeaderSize+int(binary.LittleEndian.Uint32(header[0:4])))
+	copy(entry, header)
+	if _, err := io.ReadFull(r, entry[runEntryHeaderSize:]); err != nil {
+		return "", bufferedEntry{}, err
+	}
+	key, b, _ := decodeRunEntry(entry)
+	return key, b, nil
+}
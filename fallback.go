@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"log"
+	"time"
+)
+
+// fallbackValue returns the value of the newest intact record of the key older than
+// the corrupt one, see WithCorruptionFallback. The caller must hold the lock.
+func (d *DiskStore) fallbackValue(key string, corrupt KeyEntry) (string, bool, error) {
+	segments := d.allSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		if seg.id > corrupt.fileID {
+			continue
+		}
+		// the records of the key in the segment, before the corrupt one
+		var positions []int
+		var headers []recordHeader
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, k []byte) error {
+			if seg.id == corrupt.fileID && position >= int(corrupt.position) {
+				return nil
+			}
+			if string(k) == key && h.flags&flagBlob == 0 {
+				positions = append(positions, position)
+				headers = append(headers, h)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", false, err
+		}
+		for j := len(positions) - 1; j >= 0; j-- {
+			h := headers[j]
+			kEntry := NewKeyEntry(seg.id, h.timestamp, uint32(positions[j]), headerSizeOf(seg.version)+h.keySize+h.valueSize)
+			kEntry.expiry = h.expiry
+			// the key didn't exist right before the corrupt write
+			if h.flags&flagTombstone != 0 || kEntry.expired(time.Now().Unix()) {
+				return "", false, ErrChecksumMismatch
+			}
+			data, version, err := d.readRecord(kEntry)
+			if err != nil {
+				return "", false, err
+			}
+			if !validChecksum(data, version) {
+				continue
+			}
+			log.Printf("caskdb: record of %q at segment %d offset %d is corrupt, serving the one at segment %d offset %d", key, corrupt.fileID, corrupt.position, seg.id, positions[j])
+			_, _, value, err := d.decodeRecord(seg.id, data, version)
+			if err != nil {
+				return "", false, err
+			}
+			return value, true, nil
+		}
+	}
+	return "", false, ErrChecksumMismatch
+}
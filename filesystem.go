@@ -0,0 +1,279 @@
+package caskdb
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileSystem is the set of file system operations the store needs. By default the
+// store works on the real files through the os package, WithFileSystem swaps it
+// for something else, like MemFS, which keeps the files in memory. Having it as an
+// interface also makes it easy to inject the failures in tests.
+type FileSystem interface {
+	// OpenFile is like os.OpenFile
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// Stat is like os.Stat
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat is like os.Lstat
+	Lstat(name string) (fs.FileInfo, error)
+	// Rename is like os.Rename
+	Rename(oldName string, newName string) error
+	// Remove is like os.Remove
+	Remove(name string) error
+	// ReadDirNames returns the names of the files in the directory, in no
+	// particular order
+	ReadDirNames(dir string) ([]string, error)
+}
+
+// File is the set of operations the store does on an open file, *os.File
+// implements it.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// osFS is the FileSystem backed by the os package
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) ReadDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+// MemFS is a FileSystem which keeps all the files in memory. It is handy for the
+// tests and for the stores which don't need persistence. The directories are not
+// modelled, any name is a valid file name. It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFileData
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memFileData)}
+}
+
+// memFileData is the contents of a file, shared by all of its open handles
+type memFileData struct {
+	mu      sync.RWMutex
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok:
+		f = &memFileData{name: filepath.Base(name), modTime: time.Now()}
+		m.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.mu.Lock()
+		f.data = nil
+		f.mu.Unlock()
+	}
+	return &memFile{f: f, readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	f, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.stat(), nil
+}
+
+// Lstat is same as Stat, MemFS has no symlinks
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) Rename(oldName string, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[oldName]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldName)
+	f.mu.Lock()
+	f.name = filepath.Base(newName)
+	f.mu.Unlock()
+	m.files[newName] = f
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// ReadDirNames returns the names of the files whose path is in dir
+func (m *MemFS) ReadDirNames(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == filepath.Clean(dir) {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names, nil
+}
+
+func (f *memFileData) stat() fs.FileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return memFileInfo{name: f.name, size: int64(len(f.data)), modTime: f.modTime, data: f}
+}
+
+// memFile is an open handle of a MemFS file. All the writes are appends, which is
+// the only way the store writes to a file.
+type memFile struct {
+	f        *memFileData
+	readOnly bool
+	closed   bool
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if m.closed {
+		return 0, fs.ErrClosed
+	}
+	m.f.mu.RLock()
+	defer m.f.mu.RUnlock()
+	if off >= int64(len(m.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if m.closed {
+		return 0, fs.ErrClosed
+	}
+	if m.readOnly {
+		return 0, fs.ErrPermission
+	}
+	m.f.mu.Lock()
+	defer m.f.mu.Unlock()
+	m.f.data = append(m.f.data, p...)
+	m.f.modTime = time.Now()
+	return len(p), nil
+}
+
+func (m *memFile) Stat() (fs.FileInfo, error) {
+	if m.closed {
+		return nil, fs.ErrClosed
+	}
+	return m.f.stat(), nil
+}
+
+func (m *memFile) Sync() error {
+	if m.closed {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (m *memFile) Truncate(size int64) error {
+	if m.closed {
+		return fs.ErrClosed
+	}
+	m.f.mu.Lock()
+	defer m.f.mu.Unlock()
+	if size < int64(len(m.f.data)) {
+		m.f.data = m.f.data[:size]
+	} else {
+		m.f.data = append(m.f.data, make([]byte, size-int64(len(m.f.data)))...)
+	}
+	return nil
+}
+
+func (m *memFile) Close() error {
+	if m.closed {
+		return fs.ErrClosed
+	}
+	m.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	// data identifies the file, see sameFile
+	data *memFileData
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return 0666 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return i.data }
+
+// sameFile reports whether the two describe the same file, like os.SameFile, which
+// also works for the files of MemFS. The files of the other FileSystems which don't
+// tell the files apart are taken to be the same.
+func sameFile(a fs.FileInfo, b fs.FileInfo) bool {
+	if data, ok := a.Sys().(*memFileData); ok {
+		return data == b.Sys()
+	}
+	if a.Sys() == nil || b.Sys() == nil {
+		return true
+	}
+	return os.SameFile(a, b)
+}
@@ -0,0 +1,104 @@
+package caskdb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_MemFS(t *testing.T) {
+	memFS := NewMemFS()
+	store, err := NewDiskStore("test.db", WithFileSystem(memFS))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		if err := store.Set(key, val); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	store.Set("hamlet", "shakespeare!")
+	tests["hamlet"] = "shakespeare!"
+	store.Close()
+
+	if _, err := os.Stat("test.db"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the store wrote to the disk: %v", err)
+	}
+
+	store, err = NewDiskStore("test.db", WithFileSystem(memFS))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+// faultyFS fails the operations of MemFS as configured
+type faultyFS struct {
+	*MemFS
+	openErr error
+	syncErr error
+}
+
+type faultyFile struct {
+	File
+	syncErr error
+}
+
+func (f *faultyFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if f.openErr != nil {
+		return nil, f.openErr
+	}
+	file, err := f.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{file, f.syncErr}, nil
+}
+
+func (f *faultyFile) Sync() error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	return f.File.Sync()
+}
+
+func TestDiskStore_FileSystemErrors(t *testing.T) {
+	errDisk := errors.New("disk on fire")
+	if _, err := NewDiskStore("test.db", WithFileSystem(&faultyFS{MemFS: NewMemFS(), openErr: errDisk})); err != errDisk {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, errDisk)
+	}
+	// even the file header can't be written
+	if _, err := NewDiskStore("test.db", WithFileSystem(&faultyFS{MemFS: NewMemFS(), syncErr: errDisk})); err != errDisk {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, errDisk)
+	}
+
+	faulty := &faultyFS{MemFS: NewMemFS()}
+	store, err := NewDiskStore("test.db", WithFileSystem(faulty))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.file.(*faultyFile).syncErr = errDisk
+	if err := store.Set("dune", "frank herbert"); err != errDisk {
+		t.Errorf("Set() error = %v, want %v", err, errDisk)
+	}
+	if val, _ := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if _, err := store.Get("dune"); err != ErrKeyNotFound {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -36,76 +36,400 @@ package caskdb
 //    func encodeKV(timestamp uint32, key string, value string) (int, []byte)
 //    func decodeKV(data []byte) (uint32, string, string)
 
-import "encoding/binary"
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// The format has evolved since the first version, and the files written by the
+// older versions must stay readable. Every file written by the current version
+// starts with a small file header, which carries the magic bytes and the format
+// version:
+//
+//	┌──────────────┬─────────────┐
+//	│ magic(4B)    │ version(4B) │
+//	└──────────────┴─────────────┘
+//
+// The files written before the file header existed do not have it, and they start
+// straight away with the first record. We treat such files as formatV1.
+//
+// An empty file is a fresh store, it gets the file header in the current format.
+// A file shorter than the file header is neither: a formatV1 record alone is longer
+// than that. It is likely a fresh file torn while its header was written, or not a
+// database file at all, and it is refused with ErrBadMagic.
+const (
+	// formatV1 is the original format, with a 12 byte header of timestamp, key size
+	// and value size, and no file header
+	formatV1 uint32 = 1
+	// formatV2 adds a checksum, widens the timestamp to 8 bytes and adds a flags
+	// byte. The file starts with the file header
+	formatV2 uint32 = 2
+	// currentFormat is the format used for the new files
+	currentFormat = formatV2
+)
+
+// fileMagic are the first bytes of every file with a file header
+var fileMagic = []byte("CASK")
+
+// fileHeaderSize is the size of the file header: magic(4B) + version(4B)
+const fileHeaderSize = 8
 
 // headerSize specifies the total header size. Our key value pair, when stored on disk
 // looks like this:
 //
-//	┌───────────┬──────────┬────────────┬─────┬───────┐
-//	│ timestamp │ key_size │ value_size │ key │ value │
-//	└───────────┴──────────┴────────────┴─────┴───────┘
+//	┌────────┬─────┬───────┐
+//	│ header │ key │ value │
+//	└────────┴─────┴───────┘
 //
 // This is analogous to a typical database's row (or a record). The total length of
 // the row is variable, depending on the contents of the key and value.
 //
-// The first three fields form the header:
+// The header has the following fields:
+//
+//	┌─────────┬───────────────┬───────────┬──────────────┬────────────────┐
+//	│ crc(4B) │ timestamp(8B) │ flags(1B) │ key_size(4B) │ value_size(4B) │
+//	└─────────┴───────────────┴───────────┴──────────────┴────────────────┘
+//
+// giving our header a fixed length of 21 bytes. The crc field stores the CRC-32
+// checksum of everything that follows it in the record, i.e. rest of the header,
+// key and value. If any of those bytes get corrupted on the disk, the checksum
+// won't match. Timestamp field stores the time the record we inserted in unix epoch
+// seconds. Flags mark the records of the record level features, see flagTombstone.
+// Key size and value size fields store the length of bytes occupied by the key and
+// value. The maximum integer stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1),
+// roughly ~4.2GB. So, the size of each key or value cannot exceed this.
+// Theoretically, a single row can be as large as ~8.4GB.
+const headerSize = 21
+
+// The flags of a record. The records of formatV1 have none.
+const (
+	// flagTombstone marks the record of a deleted key, see Delete. It has no value
+	flagTombstone uint8 = 1 << iota
+	// flagExpiry marks a record which expires, see SetWithTTL. The value starts with
+	// the expiry time in unix epoch seconds, as 8 bytes, followed by the actual
+	// value. The value size includes the expiry
+	flagExpiry
+	// flagMeta marks a record with the user metadata, see SetWithMeta. The
+	// metadata comes after the expiry, if any, as a 4 byte size followed by the
+	// bytes. The value size includes it
+	flagMeta
+	// flagCompressed marks a record whose actual value, past the expiry and the
+	// metadata, is compressed with DEFLATE, see WithCompression. The reads honor the
+	// flag of the record, whatever the options of the store are
+	flagCompressed
+	// flagBlob marks a record with a value stored once for all the keys set to it,
+	// see WithDedup. The key is the SHA-256 of the value, it is not in the keyDir
+	flagBlob
+	// flagRef marks a record whose actual value is in a blob, see WithDedup. The
+	// value, past the expiry and the metadata, is the SHA-256 of the blob's
+	flagRef
+	// flagChained marks a record which links to the one before it in the files, see
+	// WithDigest. The value starts with the checksum of the previous record, as 4
+	// bytes, ahead of the expiry. The value size includes it, and so does the
+	// checksum of the record, which chains in all the records before
+	flagChained
+	// flagDatabaseID marks the record which carries the database ID at the start of
+	// a segment, see WithDatabaseID. The key is the ID and there is no value, it is
+	// not in the keyDir
+	flagDatabaseID
+)
+
+// chainSize is the size of the previous checksum in the value of a flagChained
+// record
+const chainSize = 4
+
+// expirySize is the size of the expiry in the value of a flagExpiry record
+const expirySize = 8
+
+// metaSizeSize is the size of the metadata size in the value of a flagMeta record
+const metaSizeSize = 4
+
+// headerSizeV1 is the header size of formatV1. The header looks like:
 //
 //	┌───────────────┬──────────────┬────────────────┐
 //	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
 //	└───────────────┴──────────────┴────────────────┘
-//
-// These three fields store unsigned integers of size 4 bytes, giving our header a
-// fixed length of 12 bytes. Timestamp field stores the time the record we
-// inserted in unix epoch seconds. Key size and value size fields store the length of
-// bytes occupied by the key and value. The maximum integer
-// stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of
-// each key or value cannot exceed this. Theoretically, a single row can be as large
-// as ~8.4GB.
-const headerSize = 12
+const headerSizeV1 = 12
+
+// recordHeader is the decoded header of any format version. The fields missing in
+// the older versions are left zero.
+type recordHeader struct {
+	checksum  uint32
+	timestamp uint64
+	flags     uint8
+	keySize   uint32
+	valueSize uint32
+	// expiry is read from the value, see flagExpiry. Zero means no expiry
+	expiry uint64
+	// meta is read from the value, see flagMeta
+	meta []byte
+	// chain is the checksum of the previous record, read from the value, see
+	// flagChained
+	chain uint32
+}
 
 // KeyEntry keeps the metadata about the KV, specially the position of
 // the byte offset in the file. Whenever we insert/update a key, we create a new
 // KeyEntry object and insert that into keyDir.
 type KeyEntry struct {
+	// The id of the segment which has the record, see Rotate
+	fileID uint32
 	// Timestamp at which we wrote the KV pair to the disk. The value
 	// is current time in seconds since the epoch.
-	timestamp uint32
+	timestamp uint64
 	// The position is the byte offset in the file where the data
 	// exists
 	position uint32
 	// Total size of bytes of the value. We use this value to know
 	// how many bytes we need to read from the file
 	totalSize uint32
+	// The time the key expires, in seconds since the epoch. Zero means
+	// it never expires, see SetWithTTL
+	expiry uint64
+}
+
+func NewKeyEntry(fileID uint32, timestamp uint64, position uint32, totalSize uint32) KeyEntry {
+	return KeyEntry{fileID, timestamp, position, totalSize, 0}
+}
+
+// expired reports whether the key has expired as of now, in unix epoch seconds
+func (k KeyEntry) expired(now int64) bool {
+	return k.expiry != 0 && int64(k.expiry) <= now
 }
 
-func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
-	return KeyEntry{timestamp, position, totalSize}
+// headerSizeOf returns the record header size of the given format version
+func headerSizeOf(version uint32) uint32 {
+	if version == formatV1 {
+		return headerSizeV1
+	}
+	return headerSize
 }
 
-func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
+// dataStartOf returns the offset of the first record in a file of the given
+// format version
+func dataStartOf(version uint32) int {
+	if version == formatV1 {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+func encodeFileHeader(version uint32) []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header[0:4], fileMagic)
+	binary.LittleEndian.PutUint32(header[4:8], version)
+	return header
+}
+
+// decodeFileHeader returns the format version of a file, given its first bytes. A
+// file without the magic bytes is a formatV1 file, and one too short for them is
+// ErrBadMagic.
+func decodeFileHeader(header []byte) (uint32, error) {
+	if len(header) > 0 && len(header) < fileHeaderSize {
+		return 0, ErrBadMagic
+	}
+	if len(header) < fileHeaderSize || string(header[0:4]) != string(fileMagic) {
+		return formatV1, nil
+	}
+	version := binary.LittleEndian.Uint32(header[4:8])
+	if version != formatV2 {
+		return 0, ErrUnknownFormat
+	}
+	return version, nil
+}
+
+// encodeHeader encodes the header in the current format. The checksum is left zero,
+// it covers the key and value too, so encodeKV fills it in.
+func encodeHeader(timestamp uint64, flags uint8, keySize uint32, valueSize uint32) []byte {
 	header := make([]byte, headerSize)
-	binary.LittleEndian.PutUint32(header[0:4], timestamp)
-	binary.LittleEndian.PutUint32(header[4:8], keySize)
-	binary.LittleEndian.PutUint32(header[8:12], valueSize)
+	binary.LittleEndian.PutUint64(header[4:12], timestamp)
+	header[12] = flags
+	binary.LittleEndian.PutUint32(header[13:17], keySize)
+	binary.LittleEndian.PutUint32(header[17:21], valueSize)
 	return header
 }
 
-func decodeHeader(header []byte) (uint32, uint32, uint32) {
-	timestamp := binary.LittleEndian.Uint32(header[0:4])
-	keySize := binary.LittleEndian.Uint32(header[4:8])
-	valueSize := binary.LittleEndian.Uint32(header[8:12])
-	return timestamp, keySize, valueSize
+// decodeHeader decodes the header written in the given format version and maps it
+// to the current in-memory representation
+func decodeHeader(header []byte, version uint32) recordHeader {
+	if version == formatV1 {
+		return recordHeader{
+			timestamp: uint64(binary.LittleEndian.Uint32(header[0:4])),
+			keySize:   binary.LittleEndian.Uint32(header[4:8]),
+			valueSize: binary.LittleEndian.Uint32(header[8:12]),
+		}
+	}
+	return recordHeader{
+		checksum:  binary.LittleEndian.Uint32(header[0:4]),
+		timestamp: binary.LittleEndian.Uint64(header[4:12]),
+		flags:     header[12],
+		keySize:   binary.LittleEndian.Uint32(header[13:17]),
+		valueSize: binary.LittleEndian.Uint32(header[17:21]),
+	}
+}
+
+// encodeKV encodes the KV in the current format
+func encodeKV(timestamp uint64, key string, value string) (int, []byte) {
+	return encodeRecord(recordHeader{timestamp: timestamp}, key, value)
+}
+
+// encodeRecord is like encodeKV, but it also encodes the flags of h, along with the
+// expiry and the metadata if their flags are set. The value is compressed if h has
+// flagCompressed. The sizes in h are ignored.
+func encodeRecord(h recordHeader, key string, value string) (int, []byte) {
+	if h.flags&flagCompressed != 0 {
+		value = compressValue(value)
+	}
+	data := appendRecord(make([]byte, 0, recordSize(h, key, value, currentFormat)), h, key, value)
+	return len(data), data
+}
+
+// valueSizeOf returns the value size in the header of a record of the current
+// format, with the previous checksum, the expiry and the metadata
+func valueSizeOf(h recordHeader, value string) int {
+	valueSize := len(value)
+	if h.flags&flagChained != 0 {
+		valueSize += chainSize
+	}
+	if h.flags&flagExpiry != 0 {
+		valueSize += expirySize
+	}
+	if h.flags&flagMeta != 0 {
+		valueSize += metaSizeSize + len(h.meta)
+	}
+	return valueSize
+}
+
+// recordSize returns the size of the record encoded in the given format version. A
+// value to be compressed must be compressed already.
+func recordSize(h recordHeader, key string, value string, version uint32) int {
+	if version == formatV1 {
+		return headerSizeV1 + len(key) + len(value)
+	}
+	return headerSize + len(key) + valueSizeOf(h, value)
+}
+
+// appendRecord appends the record encoded in the current format to dst, see
+// encodeRecord. Unlike encodeRecord, the value is not compressed here, a value to be
+// compressed must be compressed already.
+func appendRecord(dst []byte, h recordHeader, key string, value string) []byte {
+	start := len(dst)
+	// the checksum is filled in at the end, it covers everything after it
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	dst = binary.LittleEndian.AppendUint64(dst, h.timestamp)
+	dst = append(dst, h.flags)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(key)))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(valueSizeOf(h, value)))
+	dst = append(dst, key...)
+	if h.flags&flagChained != 0 {
+		dst = binary.LittleEndian.AppendUint32(dst, h.chain)
+	}
+	if h.flags&flagExpiry != 0 {
+		dst = binary.LittleEndian.AppendUint64(dst, h.expiry)
+	}
+	if h.flags&flagMeta != 0 {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(h.meta)))
+		dst = append(dst, h.meta...)
+	}
+	dst = append(dst, value...)
+	binary.LittleEndian.PutUint32(dst[start:start+4], crc32.ChecksumIEEE(dst[start+4:]))
+	return dst
+}
+
+// encodeKVV1 encodes the KV in formatV1. We need it to keep appending to the files
+// written in the older format.
+func encodeKVV1(timestamp uint64, key string, value string) (int, []byte) {
+	data := appendKVV1(make([]byte, 0, headerSizeV1+len(key)+len(value)), timestamp, key, value)
+	return len(data), data
+}
+
+// appendKVV1 appends the KV encoded in formatV1 to dst
+func appendKVV1(dst []byte, timestamp uint64, key string, value string) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(timestamp))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(key)))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(value)))
+	dst = append(dst, key...)
+	return append(dst, value...)
+}
+
+// decodeKV decodes the record written in the given format version. The previous
+// checksum, the expiry and the metadata are moved from the value to the header, and
+// a compressed value is decompressed.
+func decodeKV(data []byte, version uint32) (recordHeader, string, string) {
+	size := headerSizeOf(version)
+	header := decodeHeader(data[0:size], version)
+	key := string(data[size : size+header.keySize])
+	value := data[size+header.keySize : size+header.keySize+header.valueSize]
+	header.chain, value = splitChain(header.flags, value)
+	header.expiry, value = splitExpiry(header.flags, value)
+	header.meta, value = splitMeta(header.flags, value)
+	if header.flags&flagCompressed != 0 {
+		// the checksum covers the compressed bytes, so a value which doesn't
+		// decompress was never valid. It is returned as it is
+		if plain, err := decompressValue(value); err == nil {
+			return header, key, string(plain)
+		}
+	}
+	return header, key, string(value)
+}
+
+// compressValue compresses the value of a flagCompressed record
+func compressValue(value string) string {
+	var buf bytes.Buffer
+	// BestSpeed, the writes are on the hot path and the values are small
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	io.WriteString(w, value)
+	w.Close()
+	return buf.String()
+}
+
+// decompressValue decompresses the value of a flagCompressed record
+func decompressValue(value []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// splitChain splits the value of a record into the previous checksum and the rest,
+// if the flags have flagChained
+func splitChain(flags uint8, value []byte) (uint32, []byte) {
+	if flags&flagChained == 0 || len(value) < chainSize {
+		return 0, value
+	}
+	return binary.LittleEndian.Uint32(value[:chainSize]), value[chainSize:]
+}
+
+// splitExpiry splits the value of a record, past the previous checksum, into the
+// expiry and the actual value, if the flags have flagExpiry
+func splitExpiry(flags uint8, value []byte) (uint64, []byte) {
+	if flags&flagExpiry == 0 || len(value) < expirySize {
+		return 0, value
+	}
+	return binary.LittleEndian.Uint64(value[:expirySize]), value[expirySize:]
 }
 
-func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
-	header := encodeHeader(timestamp, uint32(len(key)), uint32(len(value)))
-	data := append([]byte(key), []byte(value)...)
-	return headerSize + len(data), append(header, data...)
+// splitMeta splits the value of a record, past the expiry, into the metadata and
+// the actual value, if the flags have flagMeta
+func splitMeta(flags uint8, value []byte) ([]byte, []byte) {
+	if flags&flagMeta == 0 || len(value) < metaSizeSize {
+		return nil, value
+	}
+	size := binary.LittleEndian.Uint32(value[:metaSizeSize])
+	if uint64(len(value)) < uint64(metaSizeSize)+uint64(size) {
+		return nil, value
+	}
+	end := metaSizeSize + size
+	return value[metaSizeSize:end:end], value[end:]
 }
 
-func decodeKV(data []byte) (uint32, string, string) {
-	timestamp, keySize, valueSize := decodeHeader(data[0:headerSize])
-	key := string(data[headerSize : headerSize+keySize])
-	value := string(data[headerSize+keySize : headerSize+keySize+valueSize])
-	return timestamp, key, value
+// validChecksum reports whether the checksum stored in the record matches its
+// contents. The formatV1 records don't have a checksum, and they are always valid.
+func validChecksum(data []byte, version uint32) bool {
+	if version == formatV1 {
+		return true
+	}
+	return binary.LittleEndian.Uint32(data[0:4]) == crc32.ChecksumIEEE(data[4:])
 }
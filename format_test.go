@@ -6,20 +6,26 @@ import (
 
 func Test_encodeHeader(t *testing.T) {
 	tests := []struct {
-		timestamp uint32
+		timestamp uint64
+		flags     uint8
 		keySize   uint32
 		valueSize uint32
 	}{
-		{10, 10, 10},
-		{0, 0, 0},
-		{10000, 10000, 10000},
+		{10, 0, 10, 10},
+		{0, 0, 0, 0},
+		{10000, 1, 10000, 10000},
+		{1 << 40, 0, 10, 10},
 	}
 	for _, tt := range tests {
-		data := encodeHeader(tt.timestamp, tt.keySize, tt.valueSize)
-		timestamp, keySize, valueSize := decodeHeader(data)
+		data := encodeHeader(tt.timestamp, tt.flags, tt.keySize, tt.valueSize)
+		h := decodeHeader(data, currentFormat)
+		timestamp, flags, keySize, valueSize := h.timestamp, h.flags, h.keySize, h.valueSize
 		if timestamp != tt.timestamp {
 			t.Errorf("encodeHeader() timestamp = %v, want %v", timestamp, tt.timestamp)
 		}
+		if flags != tt.flags {
+			t.Errorf("encodeHeader() flags = %v, want %v", flags, tt.flags)
+		}
 		if keySize != tt.keySize {
 			t.Errorf("encodeHeader() keySize = %v, want %v", keySize, tt.keySize)
 		}
@@ -31,7 +37,7 @@ func Test_encodeHeader(t *testing.T) {
 
 func Test_encodeKV(t *testing.T) {
 	tests := []struct {
-		timestamp uint32
+		timestamp uint64
 		key       string
 		value     string
 		size      int
@@ -42,7 +48,11 @@ func Test_encodeKV(t *testing.T) {
 	}
 	for _, tt := range tests {
 		size, data := encodeKV(tt.timestamp, tt.key, tt.value)
-		timestamp, key, value := decodeKV(data)
+		h, key, value := decodeKV(data, currentFormat)
+		timestamp := h.timestamp
+		if !validChecksum(data, currentFormat) {
+			t.Errorf("encodeKV() checksum is invalid")
+		}
 		if timestamp != tt.timestamp {
 			t.Errorf("encodeKV() timestamp = %v, want %v", timestamp, tt.timestamp)
 		}
@@ -57,3 +67,53 @@ func Test_encodeKV(t *testing.T) {
 		}
 	}
 }
+
+func Test_decodeKVV1(t *testing.T) {
+	tests := []struct {
+		timestamp uint64
+		key       string
+		value     string
+		size      int
+	}{
+		{10, "hello", "world", headerSizeV1 + 10},
+		{0, "", "", headerSizeV1},
+		{100, "🔑", "", headerSizeV1 + 4},
+	}
+	for _, tt := range tests {
+		size, data := encodeKVV1(tt.timestamp, tt.key, tt.value)
+		h, key, value := decodeKV(data, formatV1)
+		if h.timestamp != tt.timestamp {
+			t.Errorf("decodeKV() timestamp = %v, want %v", h.timestamp, tt.timestamp)
+		}
+		if key != tt.key {
+			t.Errorf("decodeKV() key = %v, want %v", key, tt.key)
+		}
+		if value != tt.value {
+			t.Errorf("decodeKV() value = %v, want %v", value, tt.value)
+		}
+		if size != tt.size {
+			t.Errorf("encodeKVV1() size = %v, want %v", size, tt.size)
+		}
+	}
+}
+
+func Test_decodeFileHeader(t *testing.T) {
+	tests := []struct {
+		header  []byte
+		version uint32
+		err     error
+	}{
+		{encodeFileHeader(formatV2), formatV2, nil},
+		{[]byte("hello world!"), formatV1, nil},
+		// too short for either the file header or a formatV1 record
+		{[]byte("he"), 0, ErrBadMagic},
+		{[]byte("CASK"), 0, ErrBadMagic},
+		{append([]byte("CASK"), 9, 0, 0, 0), 0, ErrUnknownFormat},
+	}
+	for _, tt := range tests {
+		version, err := decodeFileHeader(tt.header)
+		if version != tt.version || err != tt.err {
+			t.Errorf("decodeFileHeader() = %v, %v, want %v, %v", version, err, tt.version, tt.err)
+		}
+	}
+}
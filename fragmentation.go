@@ -0,0 +1,79 @@
+package caskdb
+
+import (
+	"log"
+	"strings"
+)
+
+// FragStat is the space usage of a group of keys, see FragmentationByPrefix
+type FragStat struct {
+	// LiveKeys is the number of keys in the group
+	LiveKeys int
+	// LiveBytes is the size of the latest records of the keys, i.e. the bytes we
+	// still need
+	LiveBytes int64
+	// DeadBytes is the size of the records which were overwritten since, and can be
+	// reclaimed by compacting the file
+	DeadBytes int64
+}
+
+// FragmentationByPrefix groups the keys by their prefix up to the first sep, and
+// reports the live and dead bytes of every group. With keys like "user:42" and
+// "session:42" and sep as ":", the groups are "user" and "session". The keys
+// without sep are grouped under "".
+//
+// The live bytes come from the keyDir, but the dead records are not in it, so all
+// the segments are scanned to find them. The scan reads only the headers and the
+// keys, and it holds the read lock till it is over. A segment which can't be read
+// is logged and left out of the stats.
+//
+// This helps in finding the namespace causing the bloat, and the ones worth
+// compacting.
+func (d *DiskStore) FragmentationByPrefix(sep string) map[string]FragStat {
+	if err := d.restoreEvicted(); err != nil {
+		log.Printf("caskdb: restore of the evicted keys failed: %v", err)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	stats := make(map[string]FragStat)
+	for _, seg := range d.allSegments() {
+		// the stats of a segment are added once all of it is read, so a failed one
+		// doesn't count in part
+		segStats := make(map[string]FragStat)
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+			group := keyPrefix(string(key), sep)
+			stat := segStats[group]
+			size := int64(headerSizeOf(seg.version) + h.keySize + h.valueSize)
+			if kEntry, ok := d.keyDir.get(string(key)); ok && kEntry.fileID == seg.id && kEntry.position == uint32(position) {
+				stat.LiveKeys++
+				stat.LiveBytes += size
+			} else {
+				stat.DeadBytes += size
+			}
+			segStats[group] = stat
+			return nil
+		})
+		if err != nil {
+			log.Printf("caskdb: fragmentation scan of segment %d failed: %v", seg.id, err)
+			continue
+		}
+		for group, segStat := range segStats {
+			stat := stats[group]
+			stat.LiveKeys += segStat.LiveKeys
+			stat.LiveBytes += segStat.LiveBytes
+			stat.DeadBytes += segStat.DeadBytes
+			stats[group] = stat
+		}
+	}
+	return stats
+}
+
+// keyPrefix returns the part of the key before the first sep, or "" if the key has
+// no sep
+func keyPrefix(key string, sep string) string {
+	i := strings.Index(key, sep)
+	if sep == "" || i == -1 {
+		return ""
+	}
+	return key[:i]
+}
@@ -0,0 +1,46 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_FragmentationByPrefix(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	// session keys are overwritten a lot, user keys are written once
+	for i := 0; i < 10; i++ {
+		store.Set(fmt.Sprintf("user:%d", i), "profile")
+	}
+	for n := 0; n < 10; n++ {
+		for i := 0; i < 10; i++ {
+			store.Set(fmt.Sprintf("session:%d", i), fmt.Sprintf("token-%d", n))
+		}
+	}
+	store.Set("nosep", "value")
+
+	stats := store.FragmentationByPrefix(":")
+	user, session := stats["user"], stats["session"]
+	if user.LiveKeys != 10 || session.LiveKeys != 10 {
+		t.Errorf("FragmentationByPrefix() live keys = %v, %v, want 10, 10", user.LiveKeys, session.LiveKeys)
+	}
+	if user.DeadBytes != 0 {
+		t.Errorf("FragmentationByPrefix() user dead bytes = %v, want 0", user.DeadBytes)
+	}
+	recordSize, _ := encodeKV(0, "session:0", "token-0")
+	if session.DeadBytes != int64(9*10*recordSize) {
+		t.Errorf("FragmentationByPrefix() session dead bytes = %v, want %v", session.DeadBytes, 9*10*recordSize)
+	}
+	if session.LiveBytes != int64(10*recordSize) {
+		t.Errorf("FragmentationByPrefix() session live bytes = %v, want %v", session.LiveBytes, 10*recordSize)
+	}
+	if stats[""].LiveKeys != 1 {
+		t.Errorf("FragmentationByPrefix() no prefix live keys = %v, want 1", stats[""].LiveKeys)
+	}
+}
@@ -0,0 +1,233 @@
+package caskdb
+
+// keyIndex is the in-memory index behind keyDir. It maps a key to the KeyEntry of
+// its latest record. There are three implementations:
+//
+//   - mapIndex, a plain Go map. It is simple and fast, and is the default
+//   - compactIndex, which is built for a large number of keys, see WithCompactIndex
+//   - externalIndex, which keeps the keys on the disk, see WithExternalIndex
+//
+// A keyIndex is not safe for concurrent use, the DiskStore lock guards it.
+type keyIndex interface {
+	get(key string) (KeyEntry, bool)
+	put(key string, kEntry KeyEntry)
+	delete(key string)
+	len() int
+	// forEach calls fn for every key in the index, in no particular order, till fn
+	// returns false. The index must not be modified from fn.
+	forEach(fn func(key string, kEntry KeyEntry) bool)
+}
+
+// newKeyIndex returns an empty index as per the options
+func newKeyIndex(o options) keyIndex {
+	if o.externalIndexDir != "" {
+		return newExternalIndex(o.externalIndexDir, externalIndexBuffer, externalIndexBlock)
+	}
+	if o.compactIndex {
+		return newCompactIndex()
+	}
+	return make(mapIndex)
+}
+
+// closeIndex releases what the index holds besides the memory, once it is replaced
+// or the store is closed
+func closeIndex(index keyIndex) {
+	if x, ok := index.(*externalIndex); ok {
+		x.close()
+	}
+}
+
+// indexErr returns the I/O error the index ran into, if any. Only the externalIndex
+// does I/O, and it can't return the errors from its methods, see externalIndex.
+func indexErr(index keyIndex) error {
+	if x, ok := index.(*externalIndex); ok {
+		return x.err()
+	}
+	return nil
+}
+
+type mapIndex map[string]KeyEntry
+
+func (m mapIndex) get(key string) (KeyEntry, bool) {
+	kEntry, ok := m[key]
+	return kEntry, ok
+}
+
+func (m mapIndex) put(key string, kEntry KeyEntry) {
+	m[key] = kEntry
+}
+
+func (m mapIndex) delete(key string) {
+	delete(m, key)
+}
+
+func (m mapIndex) len() int {
+	return len(m)
+}
+
+func (m mapIndex) forEach(fn func(key string, kEntry KeyEntry) bool) {
+	for key, kEntry := range m {
+		if !fn(key, kEntry) {
+			return
+		}
+	}
+}
+
+// compactIndex trades a bit of lookup speed for a lot less memory. A Go map of
+// string keys costs a string header and a separate heap allocation for every key,
+// and the garbage collector has to trace all of them. With millions of keys, that
+// is a lot of RAM and GC work.
+//
+// compactIndex instead keeps:
+//
+//   - arena, a single byte slice with all the keys appended one after another
+//   - entries, a slice of fixed size structs pointing to the key in the arena along
+//     with its KeyEntry
+//   - slots, an open addressing hash table of indexes into entries
+//
+// None of them contain pointers, so the GC never looks inside them, and there are
+// only three allocations no matter how many keys there are.
+//
+// Deleting a key leaves its bytes in the arena and its entry in entries, they are
+// reclaimed when the table grows next.
+type compactIndex struct {
+	arena   []byte
+	entries []compactEntry
+	// slots holds entry index + 1, so that the zero value means an empty slot
+	slots []uint32
+	// live is the number of keys in the index, len(entries) includes the deleted
+	live int
+	// used is the number of slots taken, including the ones of deleted keys
+	used int
+}
+
+type compactEntry struct {
+	keyOffset uint32
+	keySize   uint32
+	kEntry    KeyEntry
+}
+
+const (
+	compactIndexInitialSlots = 1024
+	// deletedSlot marks the slot of a deleted key. The probing has to continue past
+	// it, unlike an empty slot
+	deletedSlot = ^uint32(0)
+)
+
+func newCompactIndex() *compactIndex {
+	return &compactIndex{slots: make([]uint32, compactIndexInitialSlots)}
+}
+
+// hashKey is the 32-bit FNV-1a hash of the key. It is written out here, since the
+// hash/fnv one needs the key as a byte slice and allocates on every lookup
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (c *compactIndex) keyAt(e *compactEntry) string {
+	return string(c.arena[e.keyOffset : e.keyOffset+e.keySize])
+}
+
+// find returns the slot of the key, and whether the key exists. If it doesn't, the
+// returned slot is where it should be inserted.
+func (c *compactIndex) find(key string) (int, bool) {
+	mask := uint32(len(c.slots) - 1)
+	insertAt := -1
+	for i := hashKey(key) & mask; ; i = (i + 1) & mask {
+		slot := c.slots[i]
+		switch {
+		case slot == 0:
+			if insertAt == -1 {
+				insertAt = int(i)
+			}
+			return insertAt, false
+		case slot == deletedSlot:
+			if insertAt == -1 {
+				insertAt = int(i)
+			}
+		default:
+			// the compiler doesn't allocate a string for this comparison
+			e := &c.entries[slot-1]
+			if string(c.arena[e.keyOffset:e.keyOffset+e.keySize]) == key {
+				return int(i), true
+			}
+		}
+	}
+}
+
+func (c *compactIndex) get(key string) (KeyEntry, bool) {
+	i, ok := c.find(key)
+	if !ok {
+		return KeyEntry{}, false
+	}
+	return c.entries[c.slots[i]-1].kEntry, true
+}
+
+func (c *compactIndex) put(key string, kEntry KeyEntry) {
+	i, ok := c.find(key)
+	if ok {
+		c.entries[c.slots[i]-1].kEntry = kEntry
+		return
+	}
+	if c.slots[i] == 0 {
+		c.used++
+	}
+	c.entries = append(c.entries, compactEntry{uint32(len(c.arena)), uint32(len(key)), kEntry})
+	c.arena = append(c.arena, key...)
+	c.slots[i] = uint32(len(c.entries))
+	c.live++
+	// keep the load factor under 3/4, the probe sequences get long after that
+	if c.used*4 >= len(c.slots)*3 {
+		c.rehash()
+	}
+}
+
+func (c *compactIndex) delete(key string) {
+	i, ok := c.find(key)
+	if !ok {
+		return
+	}
+	c.slots[i] = deletedSlot
+	c.live--
+}
+
+func (c *compactIndex) len() int {
+	return c.live
+}
+
+func (c *compactIndex) forEach(fn func(key string, kEntry KeyEntry) bool) {
+	for _, slot := range c.slots {
+		if slot == 0 || slot == deletedSlot {
+			continue
+		}
+		e := &c.entries[slot-1]
+		if !fn(c.keyAt(e), e.kEntry) {
+			return
+		}
+	}
+}
+
+// rehash rebuilds the table with only the live keys, dropping the deleted ones from
+// the arena and entries. The table doubles if it is more than half full of live keys.
+func (c *compactIndex) rehash() {
+	size := len(c.slots)
+	if c.live*2 >= size {
+		size *= 2
+	}
+	old := c
+	c = &compactIndex{
+		arena:   make([]byte, 0, len(old.arena)),
+		entries: make([]compactEntry, 0, old.live),
+		slots:   make([]uint32, size),
+	}
+	old.forEach(func(key string, kEntry KeyEntry) bool {
+		c.put(key, kEntry)
+		return true
+	})
+	*old = *c
+}
@@ -0,0 +1,257 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_compactIndex(t *testing.T) {
+	want := make(mapIndex)
+	got := newCompactIndex()
+	// enough keys to make the table grow a few times
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		kEntry := NewKeyEntry(1, uint64(i), uint32(i), uint32(i))
+		want.put(key, kEntry)
+		got.put(key, kEntry)
+	}
+	// overwrite some, delete some
+	for i := 0; i < 10000; i += 3 {
+		key := fmt.Sprintf("key-%d", i)
+		kEntry := NewKeyEntry(1, uint64(i), uint32(i+1), uint32(i))
+		want.put(key, kEntry)
+		got.put(key, kEntry)
+	}
+	for i := 0; i < 10000; i += 7 {
+		key := fmt.Sprintf("key-%d", i)
+		want.delete(key)
+		got.delete(key)
+	}
+	if got.len() != want.len() {
+		t.Errorf("len() = %v, want %v", got.len(), want.len())
+	}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		wantEntry, wantOK := want.get(key)
+		gotEntry, gotOK := got.get(key)
+		if gotEntry != wantEntry || gotOK != wantOK {
+			t.Errorf("get(%v) = %v, %v, want %v, %v", key, gotEntry, gotOK, wantEntry, wantOK)
+		}
+	}
+	visited := 0
+	got.forEach(func(key string, kEntry KeyEntry) bool {
+		visited++
+		if wantEntry, _ := want.get(key); kEntry != wantEntry {
+			t.Errorf("forEach() %v = %v, want %v", key, kEntry, wantEntry)
+		}
+		return true
+	})
+	if visited != want.len() {
+		t.Errorf("forEach() visited %v keys, want %v", visited, want.len())
+	}
+	// the deleted keys can be added back
+	got.put("key-0", KeyEntry{})
+	if _, ok := got.get("key-0"); !ok {
+		t.Errorf("get() = false, want true")
+	}
+}
+
+func TestDiskStore_CompactIndex(t *testing.T) {
+	store, err := NewDiskStore("test.db", WithCompactIndex(true))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	store.Close()
+	store, err = NewDiskStore("test.db", WithCompactIndex(true))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if store.Len() != len(tests) {
+		t.Errorf("Len() = %v, want %v", store.Len(), len(tests))
+	}
+}
+
+func benchmarkIndexMemory(b *testing.B, newIndex func() keyIndex) {
+	const keys = 1000000
+	for n := 0; n < b.N; n++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		index := newIndex()
+		for i := 0; i < keys; i++ {
+			index.put(fmt.Sprintf("user:%d:profile", i), NewKeyEntry(1, uint64(i), uint32(i), 100))
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "heap-bytes/key")
+		b.ReportMetric(float64(after.HeapObjects-before.HeapObjects), "heap-objects")
+		runtime.KeepAlive(index)
+	}
+}
+
+func BenchmarkMapIndex_Memory(b *testing.B) {
+	benchmarkIndexMemory(b, func() keyIndex { return make(mapIndex) })
+}
+
+func BenchmarkCompactIndex_Memory(b *testing.B) {
+	benchmarkIndexMemory(b, func() keyIndex { return newCompactIndex() })
+}
+
+func Test_externalIndex(t *testing.T) {
+	const keys, bufferSize, blockSize = 10000, 100, 16
+	want := make(mapIndex)
+	got := newExternalIndex(t.TempDir(), bufferSize, blockSize)
+	defer got.close()
+	// the keys in a random order, the runs are sorted by the index
+	for _, i := range rand.Perm(keys) {
+		key := fmt.Sprintf("key-%d", i)
+		kEntry := NewKeyEntry(1, uint64(i), uint32(i), uint32(i))
+		want.put(key, kEntry)
+		got.put(key, kEntry)
+	}
+	for i := 0; i < keys; i += 3 {
+		key := fmt.Sprintf("key-%d", i)
+		kEntry := NewKeyEntry(2, uint64(i), uint32(i+1), uint32(i))
+		want.put(key, kEntry)
+		got.put(key, kEntry)
+	}
+	for i := 0; i < keys; i += 7 {
+		key := fmt.Sprintf("key-%d", i)
+		want.delete(key)
+		got.delete(key)
+	}
+	if got.len() != want.len() {
+		t.Errorf("len() = %v, want %v", got.len(), want.len())
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		wantEntry, wantOK := want.get(key)
+		gotEntry, gotOK := got.get(key)
+		if gotEntry != wantEntry || gotOK != wantOK {
+			t.Errorf("get(%v) = %v, %v, want %v, %v", key, gotEntry, gotOK, wantEntry, wantOK)
+		}
+	}
+	visited := 0
+	got.forEach(func(key string, kEntry KeyEntry) bool {
+		visited++
+		if wantEntry, _ := want.get(key); kEntry != wantEntry {
+			t.Errorf("forEach() %v = %v, want %v", key, kEntry, wantEntry)
+		}
+		return true
+	})
+	if visited != want.len() {
+		t.Errorf("forEach() visited %v keys, want %v", visited, want.len())
+	}
+	// only the buffer and a key per block are in the memory
+	if len(got.buffer) >= bufferSize {
+		t.Errorf("buffer has %v keys, want less than %v", len(got.buffer), bufferSize)
+	}
+	sparse, limit := 0, 0
+	for _, run := range got.runs {
+		sparse += len(run.sparse)
+		limit += run.entries/blockSize + 1
+	}
+	if sparse > limit {
+		t.Errorf("sparse has %v keys, want at most %v", sparse, limit)
+	}
+	// the runs are merged as they pile up, not rewritten at every flush
+	if most := runFanIn * 3; len(got.runs) >= most {
+		t.Errorf("runs = %v, want less than %v", len(got.runs), most)
+	}
+	if err := got.err(); err != nil {
+		t.Errorf("err() = %v, want nil", err)
+	}
+}
+
+func TestDiskStore_ExternalIndexError(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"), WithExternalIndex(dir))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// a small buffer, so that the keys go to the runs
+	store.keyDir = newExternalIndex(dir, 4, 2)
+	for i := 0; i < 10; i++ {
+		if err := store.Set(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	x := store.keyDir.(*externalIndex)
+	// as if the disk failed under the run
+	x.runs[0].file.Close()
+	if _, err := store.Get("key-0"); err == nil {
+		t.Errorf("Get() error = nil, want the error of the run")
+	}
+	if err := store.Set("key-0", "value"); err == nil {
+		t.Errorf("Set() error = nil, want the error of the run")
+	}
+	if err := store.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex() error = %v", err)
+	}
+	if got, err := store.Get("key-0"); err != nil || got != "value" {
+		t.Errorf("Get() after RebuildIndex() = %v, %v, want %v, nil", got, err, "value")
+	}
+}
+
+func TestDiskStore_ExternalIndex(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	store, err := NewDiskStore(fileName, WithExternalIndex(dir))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	store.Delete("war and peace")
+	delete(tests, "war and peace")
+	store.Close()
+	store, err = NewDiskStore(fileName, WithExternalIndex(dir))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if store.Len() != len(tests) {
+		t.Errorf("Len() = %v, want %v", store.Len(), len(tests))
+	}
+}
+
+func BenchmarkExternalIndex_Memory(b *testing.B) {
+	dir := b.TempDir()
+	benchmarkIndexMemory(b, func() keyIndex { return newExternalIndex(dir, externalIndexBuffer, externalIndexBlock) })
+}
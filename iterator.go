@@ -0,0 +1,57 @@
+package caskdb
+
+// Iterator goes over the keys of the store one at a time, driven by the caller:
+//
+//	it := store.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		value, err := it.Value()
+//		...
+//	}
+//
+// The keys are snapshotted when the Iterator is created, in no particular order, so
+// the writes which happen during the iteration don't change the keys it goes over.
+// The values are not part of the snapshot: Value reads the latest value of the key,
+// and returns ErrKeyNotFound if the key was deleted since.
+//
+// An Iterator is not safe for concurrent use, but the store can be used
+// concurrently with it.
+type Iterator struct {
+	store *DiskStore
+	keys  []string
+	// i is the index of the current key, -1 before the first Next
+	i int
+}
+
+// Iterator returns an Iterator over the keys in the store right now.
+func (d *DiskStore) Iterator() *Iterator {
+	return &Iterator{store: d, keys: d.Keys(), i: -1}
+}
+
+// Next moves to the next key, and reports whether there is one. It returns false
+// once all the keys are done, or after Close.
+func (it *Iterator) Next() bool {
+	if it.i >= len(it.keys) {
+		return false
+	}
+	it.i++
+	return it.i < len(it.keys)
+}
+
+// Key returns the current key. It must be called only after Next returned true.
+func (it *Iterator) Key() string {
+	return it.keys[it.i]
+}
+
+// Value returns the value of the current key, like Get. It must be called only after
+// Next returned true.
+func (it *Iterator) Value() (string, error) {
+	return it.store.Get(it.keys[it.i])
+}
+
+// Close releases the snapshot of the keys. Next returns false after it. Closing an
+// Iterator before it is done is fine, and so is closing it twice.
+func (it *Iterator) Close() {
+	it.keys = nil
+	it.i = 0
+}
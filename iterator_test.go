@@ -0,0 +1,68 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Iterator(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+
+	it := store.Iterator()
+	defer it.Close()
+	// the writes during the iteration don't change the keys it goes over
+	store.Set("dune", "frank herbert")
+	got := make(map[string]string)
+	for it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			t.Fatalf("Value() error = %v", err)
+		}
+		got[it.Key()] = value
+	}
+	if len(got) != len(tests) {
+		t.Errorf("Iterator() went over %v keys, want %v", len(got), len(tests))
+	}
+	for key, val := range tests {
+		if got[key] != val {
+			t.Errorf("Value() = %v, want %v", got[key], val)
+		}
+	}
+	if it.Next() {
+		t.Errorf("Next() = true after the iteration is done, want false")
+	}
+}
+
+func TestDiskStore_IteratorClose(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+
+	it := store.Iterator()
+	if !it.Next() {
+		t.Fatalf("Next() = false, want true")
+	}
+	it.Close()
+	if it.Next() {
+		t.Errorf("Next() = true after Close, want false")
+	}
+	it.Close()
+}
@@ -5,15 +5,15 @@ import "testing"
 func TestMemoryStore_Get(t *testing.T) {
 	store := NewMemoryStore()
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
+	if val, _ := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
 	}
 }
 
 func TestMemoryStore_InvalidGet(t *testing.T) {
 	store := NewMemoryStore()
-	if val := store.Get("some rando key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some rando key"); err != ErrKeyNotFound || val != "" {
+		t.Errorf("Get() = %v, %v, want %v, %v", val, err, "", ErrKeyNotFound)
 	}
 }
 
@@ -0,0 +1,389 @@
+package caskdb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mergeSuffix is appended to the file name to get the name of the temporary file
+// Merge writes to
+const mergeSuffix = ".merge"
+
+// Merge compacts the store by getting rid of the dead records, the ones which were
+// overwritten since. It writes the live records of all the segments to a new file,
+// swaps it in place of the active segment and removes the sealed segments.
+//
+// The merge streams: it goes over the records in the order they were written, and a
+// record is live if the keyDir still points to its segment and offset. It is copied to the new
+// file as it is and forgotten. A blob of WithDedup is copied along with the first
+// live record which refers to it, the ones nothing refers to anymore are left out. So at any point, there is only one record in the
+// memory, which lets us merge the files much larger than the RAM. The naive way of
+// collecting the latest value of every key in a map first would need all of them in
+// the memory at once.
+//
+// The write lock is held for the entire merge. If the merge fails midway, the
+// current file is left untouched.
+//
+// If the file is a symlink, it is replaced with the merged file and the symlink is
+// gone.
+func (d *DiskStore) Merge() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// the evicted keys are live too
+	if err := d.restoreEvictedLocked(); err != nil {
+		return err
+	}
+	if d.opts.coldAfter > 0 {
+		return d.mergeTiered()
+	}
+	return d.replaceFile(d.version, d.copyLive)
+}
+
+// replaceFile replaces all the segments with a single new file. fill writes the new
+// file, in the given format version, and returns its keyDir and the offset where the
+// next record can be written in it. The new file is written to a temporary file
+// first, and swapped in only once it is durable. The caller must hold the write lock.
+func (d *DiskStore) replaceFile(version uint32, fill func(dst File) (keyIndex, int, error)) error {
+	return d.replaceFiles(version, func(dst File) (keyIndex, int, *segment, error) {
+		keyDir, writePosition, err := fill(dst)
+		return keyDir, writePosition, nil, err
+	})
+}
+
+// replaceFiles is replaceFile, where fill can also write a sealed segment which goes
+// right before the new file, like the cold tier of mergeTiered. The sealed segment
+// gets the id of the active segment, and the new file the one after. fill leaves it
+// in place under its name and durable, so it is there before the new file is
+// swapped in. The caller must hold the write lock.
+func (d *DiskStore) replaceFiles(version uint32, fill func(dst File) (keyIndex, int, *segment, error)) error {
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if err := d.emptyTrash(); err != nil {
+		return err
+	}
+	old := d.sortedSegments()
+	tmpName := d.fileName + mergeSuffix
+	tmp, err := d.opts.fileSystem.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	keyDir, writePosition, sealed, err := fill(tmp)
+	// fill reads the live records through the keyDir, and builds the new one
+	if err == nil {
+		err = indexErr(d.keyDir)
+	}
+	if err == nil {
+		err = indexErr(keyDir)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		closeIndex(keyDir)
+		d.opts.fileSystem.Remove(tmpName)
+		d.removeSegmentFile(sealed)
+		return err
+	}
+	if trashed, err := d.trashSegments(old); err != nil {
+		d.abortReplace(old[:trashed], tmpName, sealed)
+		return err
+	}
+	if swapped, err := d.swapFile(tmpName); err != nil {
+		if !swapped {
+			d.abortReplace(old, tmpName, sealed)
+		}
+		return err
+	}
+	if sealed != nil {
+		d.segments[sealed.id] = sealed
+		d.activeID = sealed.id + 1
+	}
+	closeIndex(d.keyDir)
+	d.keyDir = keyDir
+	// the new records could have the same KeyEntry as the cached old ones
+	if d.cache != nil {
+		d.cache = newReadCache(d.opts.cacheSize, d.opts.cacheTTL)
+	}
+	d.expiry.rebuild(keyDir)
+	if d.evicted != nil {
+		d.evicted.reset()
+	}
+	d.version = version
+	d.writePosition = writePosition
+	d.newest = 0
+	keyDir.forEach(func(_ string, kEntry KeyEntry) bool {
+		if kEntry.fileID == d.activeID {
+			d.updateNewest(kEntry.timestamp)
+		}
+		return true
+	})
+	// the new file was synced, the WAL entries are of the old one
+	if err := d.checkpointWAL(); err != nil {
+		return err
+	}
+	// the new file has all the data, the sealed segments are not needed anymore
+	for _, seg := range old {
+		delete(d.segments, seg.id)
+		// a failure is harmless, the trash is emptied by the next replacement or the
+		// startup
+		d.opts.fileSystem.Remove(seg.name + trashSuffix)
+	}
+	if err := d.renumberActive(); err != nil {
+		return err
+	}
+	if err := d.rebuildBlobs(); err != nil {
+		return err
+	}
+	return d.rebuildDigest()
+}
+
+// removeSegmentFile closes and removes the file of a sealed segment which was never
+// put in use, if there is one
+func (d *DiskStore) removeSegmentFile(seg *segment) {
+	if seg == nil {
+		return
+	}
+	seg.file.Close()
+	d.opts.fileSystem.Remove(seg.name)
+}
+
+// copyLive copies the live records to dst, in the same format. It returns the
+// keyDir of the records in dst, and the offset where the next record can be
+// written in dst.
+func (d *DiskStore) copyLive(dst File) (keyIndex, int, error) {
+	return d.copyLiveIn(dst, d.version, d.activeID, nil)
+}
+
+// copyLiveIn is copyLive in the given format version, the records of the segments
+// in another one are converted to it. The KeyEntries of dst get the segment id
+// fileID. The keys for which skip returns true are left out, skip can be nil.
+func (d *DiskStore) copyLiveIn(dst File, version uint32, fileID uint32, skip func(key string, kEntry KeyEntry) bool) (keyIndex, int, error) {
+	keyDir := newKeyIndex(d.opts)
+	writePosition := dataStartOf(version)
+	if version != formatV1 {
+		if _, err := dst.Write(encodeFileHeader(version)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if record := d.idRecord(version); record != nil {
+		if _, err := dst.Write(record); err != nil {
+			return nil, 0, err
+		}
+		writePosition += len(record)
+	}
+	// a single buffer is reused for all the records, it only grows to the size of
+	// the largest one
+	var buf []byte
+	// the blobs copied so far, by their hash, see WithDedup
+	copied := make(map[string]bool)
+	for _, seg := range d.allSegments() {
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+			kEntry, ok := d.keyDir.get(string(key))
+			if !ok || kEntry.fileID != seg.id || kEntry.position != uint32(position) {
+				return nil
+			}
+			if skip != nil && skip(string(key), kEntry) {
+				return nil
+			}
+			if cap(buf) < int(kEntry.totalSize) {
+				buf = make([]byte, kEntry.totalSize)
+			}
+			record := buf[:kEntry.totalSize]
+			if _, err := seg.file.ReadAt(record, int64(position)); err != nil {
+				return err
+			}
+			// an old segment could be of an older format than the active one
+			if seg.version != version {
+				h, key, value, err := d.decodeRecord(seg.id, record, seg.version)
+				if err != nil {
+					return err
+				}
+				if record, err = encodeRecordIn(version, h, key, value); err != nil {
+					return err
+				}
+			} else if h.flags&flagRef != 0 {
+				// the blob goes right before the first live ref to it
+				_, _, hash := decodeKV(record, version)
+				if !copied[hash] {
+					blob, _, err := d.readBlob(seg.id, hash)
+					if err != nil {
+						return err
+					}
+					if _, err := dst.Write(blob); err != nil {
+						return err
+					}
+					writePosition += len(blob)
+					copied[hash] = true
+				}
+			}
+			if _, err := dst.Write(record); err != nil {
+				return err
+			}
+			newEntry := NewKeyEntry(fileID, kEntry.timestamp, uint32(writePosition), uint32(len(record)))
+			newEntry.expiry = kEntry.expiry
+			keyDir.put(string(key), newEntry)
+			writePosition += len(record)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return keyDir, writePosition, nil
+}
+
+// swapFile replaces the store's file with newName, and opens it in place of the
+// current one. The current file is closed first, Windows can't rename over an open
+// file. It reports whether newName took the place of the file, even along with an
+// error of opening it. If it didn't, newName is left for the caller to remove.
+func (d *DiskStore) swapFile(newName string) (bool, error) {
+	fsys := d.opts.fileSystem
+	if err := d.file.Close(); err != nil {
+		return false, err
+	}
+	renameErr := fsys.Rename(newName, d.fileName)
+	// on a failed rename, we open the old file again
+	file, err := fsys.OpenFile(d.fileName, os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		return renameErr == nil, err
+	}
+	d.file = file
+	return renameErr == nil, renameErr
+}
+
+// The sealed segments replaced by replaceFiles have to go along with the swap of the
+// new file in place of the active segment: if they are still around at the next
+// startup, they are loaded before the new file, and bring back the keys it doesn't
+// have, like the deleted ones. A rename can't swap the file and remove the segments
+// in one step, so the segments are renamed out of the way first, to
+// `<segment name>.trash`, which the startup doesn't load:
+//
+//	1. the new file is written and synced to `<file name>.merge`
+//	2. the replaced segments are renamed to `<segment name>.trash`
+//	3. the new file is renamed over the active segment
+//	4. the trash is removed
+//
+// If we crash at the step 2, the new file is still there, and the startup puts the
+// segments back, see recoverTrash. Past the step 3, the new file is gone and the
+// startup removes the trash.
+
+// trashSuffix is appended to the name of a replaced segment, till it is removed
+const trashSuffix = ".trash"
+
+// trashSegments closes the segments and renames them to the trash. It returns the
+// number of the segments renamed, all of them unless there is an error. The caller
+// must hold the write lock.
+func (d *DiskStore) trashSegments(segments []*segment) (int, error) {
+	for i, seg := range segments {
+		// the file is closed before renaming, Windows can't rename an open file
+		seg.file.Close()
+		if err := d.opts.fileSystem.Rename(seg.name, seg.name+trashSuffix); err != nil {
+			if reopened, openErr := d.openSegment(seg.id); openErr == nil {
+				reopened.newest = seg.newest
+				d.segments[seg.id] = reopened
+			}
+			return i, err
+		}
+	}
+	return len(segments), nil
+}
+
+// abortReplace undoes a replaceFiles which failed before the swap: the trashed
+// segments are put back in place and opened again, and the new files are removed.
+// If a segment can't be put back, the new file is left behind for the startup to
+// put the segment back, see recoverTrash. The caller must hold the write lock.
+func (d *DiskStore) abortReplace(trashed []*segment, tmpName string, sealed *segment) {
+	fsys := d.opts.fileSystem
+	restored := true
+	for _, seg := range trashed {
+		if err := fsys.Rename(seg.name+trashSuffix, seg.name); err != nil {
+			restored = false
+			continue
+		}
+		if reopened, err := d.openSegment(seg.id); err == nil {
+			reopened.newest = seg.newest
+			d.segments[seg.id] = reopened
+		}
+	}
+	if restored {
+		fsys.Remove(tmpName)
+	}
+	d.removeSegmentFile(sealed)
+}
+
+// listTrash returns the ids of the segments of fileName in the trash
+func listTrash(fsys FileSystem, fileName string) ([]uint32, error) {
+	names, err := fsys.ReadDirNames(filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(fileName) + "."
+	var ids []uint32
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, trashSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name[len(prefix):], trashSuffix), 10, 32)
+		if err != nil || segmentName(prefix[:len(prefix)-1], uint32(id))+trashSuffix != name {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// recoverTrash deals with the trash left behind by replaceFiles. If the new file
+// wasn't swapped in, which is the case while it is still there, the segments are put
+// back and the new file is removed. Otherwise the segments were replaced, and the
+// trash is removed. It runs at the startup, before the segments are opened.
+func recoverTrash(fsys FileSystem, fileName string) error {
+	ids, err := listTrash(fsys, fileName)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = fsys.Stat(fileName + mergeSuffix)
+	swapped := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !swapped {
+		return err
+	}
+	for _, id := range ids {
+		name := segmentName(fileName, id)
+		if swapped {
+			err = fsys.Remove(name + trashSuffix)
+		} else {
+			err = fsys.Rename(name+trashSuffix, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !swapped {
+		return fsys.Remove(fileName + mergeSuffix)
+	}
+	return nil
+}
+
+// emptyTrash removes the trash left behind by an earlier replaceFiles which failed
+// to remove it. It has to be gone before a new file is written, or a crash writing it
+// would have the startup put the trash back. The caller must hold the write lock.
+func (d *DiskStore) emptyTrash() error {
+	fsys := d.opts.fileSystem
+	ids, err := listTrash(fsys, d.fileName)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := fsys.Remove(segmentName(d.fileName, id) + trashSuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
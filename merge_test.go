@@ -0,0 +1,124 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Merge(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for i := 0; i < 10; i++ {
+		for key := range tests {
+			store.Set(key, fmt.Sprintf("draft %d", i))
+		}
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	before, _ := os.Stat("test.db")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	after, _ := os.Stat("test.db")
+	if after.Size() >= before.Size() {
+		t.Errorf("Merge() file size = %v, want less than %v", after.Size(), before.Size())
+	}
+	if _, err := os.Stat("test.db" + mergeSuffix); !os.IsNotExist(err) {
+		t.Errorf("Merge() left behind the temporary file")
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	// the store keeps working after the merge
+	store.Set("dune", "frank herbert")
+	tests["dune"] = "frank herbert"
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestDiskStore_MergeBoundedMemory(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	// 64MB of data, half of it dead, with 64KB values
+	value := strings.Repeat("x", 64<<10)
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 512; i++ {
+			store.Set(fmt.Sprintf("key-%d", i), value)
+		}
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	// sample the heap while the merge runs
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		for {
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > max {
+					max = stats.HeapAlloc
+				}
+			}
+		}
+	}()
+	err = store.Merge()
+	close(done)
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	// the whole data set is 32MB of live values, we should not be anywhere close
+	if growth := int64(<-peak) - int64(baseline); growth > 8<<20 {
+		t.Errorf("Merge() grew the heap by %v bytes, want under %v", growth, 8<<20)
+	}
+	for i := 0; i < 512; i++ {
+		if got, _ := store.Get(fmt.Sprintf("key-%d", i)); got != value {
+			t.Fatalf("Get() = %v bytes, want %v bytes", len(got), len(value))
+		}
+	}
+}
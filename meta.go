@@ -0,0 +1,52 @@
+package caskdb
+
+import "time"
+
+// SetWithMeta is like Set, but it also stores meta along with the value, like a
+// content type or a version tag. The metadata is read back with GetWithMeta, it
+// saves the applications from encoding it into the value itself. A record without
+// the metadata, the ones written by Set or with an empty meta, takes no extra space.
+func (d *DiskStore) SetWithMeta(key string, value string, meta []byte) error {
+	h := recordHeader{timestamp: uint64(time.Now().Unix())}
+	if len(meta) > 0 {
+		h.flags = flagMeta
+		h.meta = meta
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.set(h, key, value)
+}
+
+// GetWithMeta is like Get, but it also returns the metadata stored by SetWithMeta.
+// The metadata is nil for a record written without it. The read cache only has the
+// values, so GetWithMeta always reads from the disk.
+func (d *DiskStore) GetWithMeta(key string) (string, []byte, error) {
+	if d.opts.indexOnly {
+		return "", nil, ErrValuesDisabled
+	}
+	if err := d.reloadEvicted(key); err != nil {
+		return "", nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	kEntry, ok := d.lookup(key)
+	if !ok {
+		return "", nil, ErrKeyNotFound
+	}
+	d.touch(key)
+	data, version, err := d.readRecord(kEntry)
+	if err != nil {
+		return "", nil, err
+	}
+	if !validChecksum(data, version) {
+		return "", nil, ErrChecksumMismatch
+	}
+	h, storedKey, value, err := d.decodeRecord(kEntry.fileID, data, version)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := d.verifyKey(key, storedKey); err != nil {
+		return "", nil, err
+	}
+	return value, h.meta, nil
+}
@@ -0,0 +1,73 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_SetWithMeta(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.SetWithMeta("hamlet", "shakespeare", []byte("text/plain"))
+	store.SetWithMeta("dune", "frank herbert", nil)
+	store.Set("othello", "shakespeare")
+
+	// the records without the metadata are of the same size as before
+	for key, value := range map[string]string{"dune": "frank herbert", "othello": "shakespeare"} {
+		info, _ := store.Info(key)
+		if want := uint32(headerSize + len(key) + len(value)); info.Size != want {
+			t.Errorf("Info() size = %v, want %v", info.Size, want)
+		}
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := []struct {
+		key   string
+		value string
+		meta  string
+	}{
+		{"hamlet", "shakespeare", "text/plain"},
+		{"dune", "frank herbert", ""},
+		{"othello", "shakespeare", ""},
+	}
+	for _, tt := range tests {
+		value, meta, err := store.GetWithMeta(tt.key)
+		if err != nil || value != tt.value || string(meta) != tt.meta {
+			t.Errorf("GetWithMeta() = %v, %q, %v, want %v, %q, nil", value, meta, err, tt.value, tt.meta)
+		}
+		if got, _ := store.Get(tt.key); got != tt.value {
+			t.Errorf("Get() = %v, want %v", got, tt.value)
+		}
+	}
+	// a plain Set drops the metadata
+	store.Set("hamlet", "william shakespeare")
+	if _, meta, _ := store.GetWithMeta("hamlet"); meta != nil {
+		t.Errorf("GetWithMeta() meta = %q, want nil", meta)
+	}
+	if _, _, err := store.GetWithMeta("some key"); err != ErrKeyNotFound {
+		t.Errorf("GetWithMeta() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func Test_encodeRecordMeta(t *testing.T) {
+	h := recordHeader{timestamp: 42, flags: flagExpiry | flagMeta, expiry: 1000, meta: []byte("v2")}
+	_, data := encodeRecord(h, "hamlet", "shakespeare")
+	if !validChecksum(data, currentFormat) {
+		t.Errorf("validChecksum() = false, want true")
+	}
+	got, key, value := decodeKV(data, currentFormat)
+	if key != "hamlet" || value != "shakespeare" || got.expiry != h.expiry || string(got.meta) != "v2" {
+		t.Errorf("decodeKV() = %v, %v, %v, want %v, %v, %v", got, key, value, h, "hamlet", "shakespeare")
+	}
+}
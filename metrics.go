@@ -0,0 +1,84 @@
+package caskdb
+
+import "sync/atomic"
+
+// Metrics is a point-in-time snapshot of the store's counters. The counters keep
+// increasing for the lifetime of the store.
+type Metrics struct {
+	// AsyncQueueDepth is the number of SetAsync writes waiting to be written
+	AsyncQueueDepth int
+	// AsyncQueueSize is the capacity of the async queue, see WithAsyncQueueSize
+	AsyncQueueSize int
+	// AsyncDropped counts the SetAsync calls rejected with ErrQueueFull
+	AsyncDropped uint64
+	// AsyncBlocked counts the SetAsync calls which had to wait for a free slot
+	AsyncBlocked uint64
+	// AsyncFailed counts the queued writes which failed to be written to the disk
+	AsyncFailed uint64
+	// CacheHits counts the Gets served from the read cache
+	CacheHits uint64
+	// CacheMisses counts the Gets which had to go to the disk, while the read cache
+	// is enabled
+	CacheMisses uint64
+	// KeyDirPasses counts the updates of the keyDir under the write lock: one for
+	// every single key write, and one for a whole Batch
+	KeyDirPasses uint64
+	// DiskGets counts the Gets which read the record from the disk, with
+	// WithSeekMetrics
+	DiskGets uint64
+	// DiskReads counts the reads of the records from the disk, with
+	// WithSeekMetrics. While only Gets run, DiskReads / DiskGets is the number of
+	// the reads per Get
+	DiskReads uint64
+}
+
+// metrics holds the live counters. They are updated without holding the store's
+// lock, hence atomics.
+type metrics struct {
+	asyncDropped atomic.Uint64
+	asyncBlocked atomic.Uint64
+	asyncFailed  atomic.Uint64
+	cacheHits    atomic.Uint64
+	cacheMisses  atomic.Uint64
+	keyDirPasses atomic.Uint64
+	diskGets     atomic.Uint64
+	diskReads    atomic.Uint64
+}
+
+// Metrics returns the current values of the store's counters.
+func (d *DiskStore) Metrics() Metrics {
+	return Metrics{
+		AsyncQueueDepth: len(d.asyncQueue),
+		AsyncQueueSize:  cap(d.asyncQueue),
+		AsyncDropped:    d.metrics.asyncDropped.Load(),
+		AsyncBlocked:    d.metrics.asyncBlocked.Load(),
+		AsyncFailed:     d.metrics.asyncFailed.Load(),
+		CacheHits:       d.metrics.cacheHits.Load(),
+		CacheMisses:     d.metrics.cacheMisses.Load(),
+		KeyDirPasses:    d.metrics.keyDirPasses.Load(),
+		DiskGets:        d.metrics.diskGets.Load(),
+		DiskReads:       d.metrics.diskReads.Load(),
+	}
+}
+
+// ResetMetrics sets all the counters to zero, to measure from a fresh start, like
+// for a benchmark run. The counters are reset one by one, an update racing with the
+// reset could be counted before or after it. AsyncQueueDepth and AsyncQueueSize are
+// not counters and are left as they are.
+func (d *DiskStore) ResetMetrics() {
+	d.metrics.asyncDropped.Store(0)
+	d.metrics.asyncBlocked.Store(0)
+	d.metrics.asyncFailed.Store(0)
+	d.metrics.cacheHits.Store(0)
+	d.metrics.cacheMisses.Store(0)
+	d.metrics.keyDirPasses.Store(0)
+	d.metrics.diskGets.Store(0)
+	d.metrics.diskReads.Store(0)
+}
+
+// countRead counts a read of the records from the disk, see WithSeekMetrics
+func (d *DiskStore) countRead() {
+	if d.opts.seekMetrics {
+		d.metrics.diskReads.Add(1)
+	}
+}
@@ -0,0 +1,35 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_WithSeekMetrics(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"), WithSeekMetrics(), WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("moby dick", strings.Repeat("call me ishmael. ", 10))
+
+	tests := []struct {
+		key   string
+		reads uint64
+	}{
+		{"hamlet", 1},
+		// the value is in a blob
+		{"moby dick", 2},
+	}
+	for _, tt := range tests {
+		store.ResetMetrics()
+		if _, err := store.Get(tt.key); err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if m := store.Metrics(); m.DiskGets != 1 || m.DiskReads != tt.reads {
+			t.Errorf("Metrics() gets, reads of %v = %v, %v, want 1, %v", tt.key, m.DiskGets, m.DiskReads, tt.reads)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package caskdb
+
+import "sort"
+
+// batchReadGap is the largest gap between two records read with a single ReadAt,
+// see WithBatchedReads
+const batchReadGap = 4096
+
+// MGet returns the values of the keys which exist, by key. The keys which don't are
+// left out of the map. All the reads happen under a single read lock, so the values
+// are as of the same point in time, and with WithBatchedReads, they are batched into
+// fewer syscalls.
+func (d *DiskStore) MGet(keys []string) (map[string]string, error) {
+	if d.opts.indexOnly {
+		return nil, ErrValuesDisabled
+	}
+	values := make(map[string]string, len(keys))
+	var missing []string
+	for _, key := range keys {
+		// a queued write is newer than anything on the disk
+		if d.pending != nil {
+			if value, ok := d.pending.get(key); ok {
+				values[key] = value
+				continue
+			}
+		}
+		if err := d.reloadEvicted(key); err != nil {
+			return nil, err
+		}
+		missing = append(missing, key)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var reads []keyRead
+	for _, key := range missing {
+		kEntry, ok := d.lookup(key)
+		if !ok {
+			continue
+		}
+		d.touch(key)
+		if d.cache != nil {
+			if value, ok := d.cache.get(key, kEntry); ok {
+				d.metrics.cacheHits.Add(1)
+				values[key] = value
+				continue
+			}
+			d.metrics.cacheMisses.Add(1)
+		}
+		reads = append(reads, keyRead{key: key, kEntry: kEntry})
+	}
+	read := d.readEach
+	if d.opts.batchedReads {
+		read = d.readBatched
+	}
+	if err := read(reads); err != nil {
+		return nil, err
+	}
+	for _, r := range reads {
+		value, ok, err := d.decodeValue(r.key, r.kEntry, r.data, r.version)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[r.key] = value
+		}
+	}
+	return values, nil
+}
+
+// keyRead is the read of the record of a key, for MGet
+type keyRead struct {
+	key    string
+	kEntry KeyEntry
+	// data is the record and version its format, filled in by the read
+	data    []byte
+	version uint32
+}
+
+// readEach reads the records one at a time, with a ReadAt each. The caller must
+// hold the lock.
+func (d *DiskStore) readEach(reads []keyRead) error {
+	for i := range reads {
+		var err error
+		if reads[i].data, reads[i].version, err = d.readRecord(reads[i].kEntry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBatched reads the records in the order of their positions, with a single
+// ReadAt for the records close to each other, see WithBatchedReads. The caller must
+// hold the lock.
+func (d *DiskStore) readBatched(reads []keyRead) error {
+	order := make([]int, len(reads))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := reads[order[i]].kEntry, reads[order[j]].kEntry
+		if a.fileID != b.fileID {
+			return a.fileID < b.fileID
+		}
+		return a.position < b.position
+	})
+	// a span is a range of a segment read at once, with the reads in it
+	type span struct {
+		fileID     uint32
+		start, end int64
+		reads      []int
+	}
+	var spans []span
+	for _, i := range order {
+		kEntry := reads[i].kEntry
+		start, end := int64(kEntry.position), int64(kEntry.position)+int64(kEntry.totalSize)
+		if n := len(spans); n > 0 && spans[n-1].fileID == kEntry.fileID && start <= spans[n-1].end+batchReadGap {
+			last := &spans[n-1]
+			if end > last.end {
+				last.end = end
+			}
+			last.reads = append(last.reads, i)
+			continue
+		}
+		spans = append(spans, span{fileID: kEntry.fileID, start: start, end: end, reads: []int{i}})
+	}
+	// all the reads are submitted to the kernel before waiting on any of them
+	for _, s := range spans {
+		file, _, err := d.segmentFile(s.fileID)
+		if err != nil {
+			return err
+		}
+		adviseWillNeed(file, s.start, s.end-s.start)
+	}
+	for _, s := range spans {
+		file, version, err := d.segmentFile(s.fileID)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, s.end-s.start)
+		d.countRead()
+		if err := readFull(file, buf, s.start); err != nil {
+			return err
+		}
+		for _, i := range s.reads {
+			offset := int64(reads[i].kEntry.position) - s.start
+			reads[i].data = buf[offset : offset+int64(reads[i].kEntry.totalSize)]
+			reads[i].version = version
+		}
+	}
+	return nil
+}
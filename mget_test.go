@@ -0,0 +1,86 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_MGet(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batched=%v", batched), func(t *testing.T) {
+			var opts []Option
+			if batched {
+				opts = append(opts, WithBatchedReads())
+			}
+			store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"), opts...)
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			want := make(map[string]string)
+			var keys []string
+			for i := 0; i < 100; i++ {
+				key, val := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+				store.Set(key, val)
+				want[key] = val
+				keys = append(keys, key)
+				// a large value splits the batches
+				if i%10 == 0 {
+					store.Set("big", string(make([]byte, 2*batchReadGap)))
+				}
+				if i == 50 {
+					store.Rotate()
+				}
+			}
+			store.Set("key-7", "overwritten")
+			want["key-7"] = "overwritten"
+			store.Delete("key-8")
+			delete(want, "key-8")
+			keys = append(keys, "missing", "key-3")
+
+			rand.New(rand.NewSource(1)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+			got, err := store.MGet(keys)
+			if err != nil {
+				t.Fatalf("MGet() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("MGet() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkDiskStore_MGet(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%v", batched), func(b *testing.B) {
+			var opts []Option
+			if batched {
+				opts = append(opts, WithBatchedReads())
+			}
+			store, err := NewDiskStore(filepath.Join(b.TempDir(), "test.db"), opts...)
+			if err != nil {
+				b.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			batch := store.NewBatch()
+			for i := 0; i < 10000; i++ {
+				batch.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			}
+			batch.Commit()
+			r := rand.New(rand.NewSource(1))
+			keys := make([]string, 1000)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", r.Intn(10000))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.MGet(keys); err != nil {
+					b.Fatalf("MGet() error = %v", err)
+				}
+			}
+		})
+	}
+}
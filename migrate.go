@@ -0,0 +1,49 @@
+package caskdb
+
+import "fmt"
+
+// Migrate rewrites the store in the given format version, like formatV2 to get the
+// checksums and the 8 byte timestamps of the records of an old store. The live
+// records of all the segments are converted and written to a new file, which is
+// swapped in place of the active segment, like Merge does: it is written and synced
+// first under a temporary name, and renamed over the file only once it is durable,
+// so a crash midway leaves the store as it was. The dead records are dropped along
+// the way.
+//
+// The new writes continue in the target version. A store can be migrated back to
+// formatV1 only if none of its live records use the features formatV1 doesn't
+// have, like an expiry or the metadata, and it has no database ID. The write lock is held for the entire
+// migration.
+func (d *DiskStore) Migrate(targetVersion int) error {
+	if targetVersion != int(formatV1) && targetVersion != int(formatV2) {
+		return fmt.Errorf("%w: %d", ErrUnknownFormat, targetVersion)
+	}
+	version := uint32(targetVersion)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if version == formatV1 && d.id != "" {
+		return fmt.Errorf("caskdb: formatV1 can't store the database id")
+	}
+	// the evicted keys are live too
+	if err := d.restoreEvictedLocked(); err != nil {
+		return err
+	}
+	return d.replaceFile(version, func(dst File) (keyIndex, int, error) {
+		return d.copyLiveIn(dst, version, d.activeID, nil)
+	})
+}
+
+// encodeRecordIn encodes the record in the given format version. The value is the
+// actual one, a flagCompressed record is compressed again in formatV2.
+func encodeRecordIn(version uint32, h recordHeader, key string, value string) ([]byte, error) {
+	if version != formatV1 {
+		_, record := encodeRecord(h, key, value)
+		return record, nil
+	}
+	// the compression is not a part of the value, it can be left out
+	if h.flags&^flagCompressed != 0 {
+		return nil, fmt.Errorf("caskdb: record of %q has flags %#x which formatV1 can't store", key, h.flags)
+	}
+	_, record := encodeKVV1(h.timestamp, key, value)
+	return record, nil
+}
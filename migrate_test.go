@@ -0,0 +1,62 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Migrate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	var data []byte
+	for _, kv := range [][2]string{{"hamlet", "shakespeare"}, {"dune", "frank herbert"}, {"hamlet", "shakespeare!"}} {
+		_, record := encodeKVV1(uint64(time.Now().Unix()), kv[0], kv[1])
+		data = append(data, record...)
+	}
+	if err := os.WriteFile(fileName, data, 0666); err != nil {
+		t.Fatalf("failed to write the db file: %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Migrate(3); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Migrate() error = %v, want %v", err, ErrUnknownFormat)
+	}
+	if err := store.Migrate(int(formatV2)); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if store.version != formatV2 {
+		t.Errorf("version = %v, want %v", store.version, formatV2)
+	}
+	// the new writes are in the new format too
+	store.SetWithTTL("othello", "shakespeare", time.Hour)
+	store.Close()
+
+	header, _ := os.ReadFile(fileName)
+	if version, err := decodeFileHeader(header[:fileHeaderSize]); err != nil || version != formatV2 {
+		t.Errorf("decodeFileHeader() = %v, %v, want %v", version, err, formatV2)
+	}
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare!", "dune": "frank herbert", "othello": "shakespeare"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	// formatV1 has no expiry, the store is left as it was
+	if err := store.Migrate(int(formatV1)); err == nil {
+		t.Errorf("Migrate() of a key with an expiry to formatV1 error = nil, want an error")
+	}
+	if got, _ := store.Get("othello"); got != "shakespeare" {
+		t.Errorf("Get() after a failed Migrate() = %v, want %v", got, "shakespeare")
+	}
+}
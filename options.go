@@ -0,0 +1,560 @@
+package caskdb
+
+import "time"
+
+// Option configures a DiskStore. Options are passed to NewDiskStore and applied in
+// the order given, so a later option overrides an earlier one:
+//
+//	store, _ := NewDiskStore("books.db", WithAsyncQueueSize(64))
+type Option func(*options)
+
+// options holds all the knobs of a DiskStore. Every field must have a sensible zero
+// value or a default in defaultOptions, so that NewDiskStore("books.db") keeps
+// working without any options.
+type options struct {
+	// asyncQueueSize is the number of SetAsync writes which can wait for the
+	// background writer before the queue is considered full
+	asyncQueueSize int
+	// asyncFullPolicy decides what SetAsync does when the queue is full
+	asyncFullPolicy QueueFullPolicy
+	// asyncReadYourWrites makes Get see the queued SetAsync writes
+	asyncReadYourWrites bool
+	// indexOnly skips reading the values, see WithIndexOnly
+	indexOnly bool
+	// compactIndex uses compactIndex for the keyDir, see WithCompactIndex
+	compactIndex bool
+	// externalIndexDir is where the externalIndex keeps its files, see
+	// WithExternalIndex. Empty keeps the keyDir in the memory
+	externalIndexDir string
+	// indexOrder decides when Set updates the keyDir, see WithIndexOrder
+	indexOrder IndexOrder
+	// fileSystem is where the files live, see WithFileSystem
+	fileSystem FileSystem
+	// cacheSize is the number of values kept in the read cache, zero disables it
+	cacheSize int
+	// cacheTTL is how long a cached value is served, see WithCacheTTL
+	cacheTTL time.Duration
+	// followSymlinks allows the database path to be a symlink, see WithFollowSymlinks
+	followSymlinks bool
+	// rotateInterval is how often the active segment is rotated, zero disables it
+	rotateInterval time.Duration
+	// retention is how long the sealed segments are kept, zero keeps them forever
+	retention time.Duration
+	// loadProgress is called while the keyDir is loaded at the startup, if not nil
+	loadProgress func(bytesRead, totalBytes int64)
+	// maxIndexKeys is the limit on the keys in the keyDir, zero means no limit
+	maxIndexKeys int
+	// maxFileSize is the limit on the size of the active segment, zero means no
+	// limit
+	maxFileSize    int64
+	fileFullPolicy FileFullPolicy
+	// wal enables the write-ahead log
+	wal bool
+	// readOnly opens the store without writing to it, see WithReadOnly
+	readOnly bool
+	// comparator orders the keys of the sorted scans, nil means the byte order
+	comparator func(a, b string) int
+	// digest keeps the rolling digest of the records, see WithDigest
+	digest bool
+	// compression compresses the values of the new records, see WithCompression
+	compression bool
+	// utf8Keys rejects the keys which are not valid UTF-8, see WithUTF8Keys
+	utf8Keys bool
+	// corruptionFallback serves an older version of a corrupt key, see
+	// WithCorruptionFallback
+	corruptionFallback bool
+	// batchedReads coalesces the reads of MGet, see WithBatchedReads
+	batchedReads bool
+	// flushOnIdle is the quiet period after which the WAL is checkpointed, zero
+	// disables it
+	flushOnIdle time.Duration
+	// dedup stores the large values once per segment, see WithDedup
+	dedup bool
+	// seekMetrics counts the reads from the disk, see WithSeekMetrics
+	seekMetrics bool
+	// maxSkippedRecords is the number of the corrupt records the startup skips
+	// before failing, see WithMaxSkippedRecords. Negative doesn't check the records
+	maxSkippedRecords int
+	// verifyKeyOnRead checks the key of the records read, see WithVerifyKeyOnRead
+	verifyKeyOnRead bool
+	// recentKeys is the number of the latest writes RecentKeys remembers, zero
+	// disables it
+	recentKeys int
+	// mustExist makes NewDiskStore fail for a missing file, see WithMustExist
+	mustExist bool
+	// syncCoordinator batches the fsyncs with the other stores, see
+	// WithSyncCoordinator
+	syncCoordinator *SyncCoordinator
+	// databaseID keeps a unique ID of the database, see WithDatabaseID
+	databaseID bool
+	// coldAfter is the time after the last access a key moves to the cold tier, zero
+	// without WithColdTier
+	coldAfter time.Duration
+}
+
+const defaultAsyncQueueSize = 1024
+
+func defaultOptions() options {
+	return options{
+		asyncQueueSize:  defaultAsyncQueueSize,
+		asyncFullPolicy: BlockWhenFull,
+		fileSystem:      osFS{},
+		// the startup doesn't read the values, it can't tell a corrupt record
+		maxSkippedRecords: -1,
+	}
+}
+
+// WithAsyncQueueSize sets the maximum number of in-flight SetAsync writes. Once n
+// writes are waiting, SetAsync either blocks or fails depending on the
+// WithAsyncFullPolicy option. Values less than one are ignored.
+func WithAsyncQueueSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.asyncQueueSize = n
+		}
+	}
+}
+
+// WithAsyncFullPolicy sets what SetAsync does when the async queue is full. The
+// default is BlockWhenFull.
+func WithAsyncFullPolicy(policy QueueFullPolicy) Option {
+	return func(o *options) {
+		o.asyncFullPolicy = policy
+	}
+}
+
+// WithAsyncReadYourWrites makes Get return the values of the SetAsync writes still
+// waiting in the queue, so that a Get right after a SetAsync sees the new value. The
+// queued values are kept in memory till the background writer gets to them, then the
+// keyDir takes over. A write which fails to be written is gone from Get as well, see
+// Metrics.AsyncFailed.
+//
+// Only Get and GetOK see the queued writes, Has, Keys and the rest see the keys once
+// they are written.
+func WithAsyncReadYourWrites() Option {
+	return func(o *options) {
+		o.asyncReadYourWrites = true
+	}
+}
+
+// WithIndexOnly opens the store for the workloads which only need the keys and
+// their metadata, never the values. The startup reads only the headers and the keys
+// and jumps over the value bytes, which saves a lot of I/O when the values are
+// large. Get returns ErrValuesDisabled, while Has, Keys, Len and Info keep working.
+func WithIndexOnly(indexOnly bool) Option {
+	return func(o *options) {
+		o.indexOnly = indexOnly
+	}
+}
+
+// WithCompactIndex keeps the keyDir in a compact representation instead of a Go
+// map. It packs all the keys into a single buffer, which needs a lot less memory
+// and puts almost no load on the garbage collector, at the cost of slightly slower
+// lookups. It is worth it for the stores with millions of keys, the default map is
+// better for the small ones.
+func WithCompactIndex(compact bool) Option {
+	return func(o *options) {
+		o.compactIndex = compact
+	}
+}
+
+// WithExternalIndex keeps the keyDir in sorted files in dir instead of the memory,
+// for the stores with more keys than fit in the RAM even with WithCompactIndex. Only
+// the latest writes, and one of every externalIndexBlock keys, are kept in the
+// memory. A lookup which misses the memory reads a block of every file, which makes
+// it a lot slower than with the in-memory indexes, and so are the startup and
+// Merge, which build the index from scratch.
+//
+// The files are rebuilt at every startup, dir is a scratch space: a local directory,
+// whatever the WithFileSystem option is. The files left behind by a crash can be
+// removed. An I/O error on the files fails the next reads and writes of the store
+// with it, till RebuildIndex builds the index again. It takes precedence over
+// WithCompactIndex.
+func WithExternalIndex(dir string) Option {
+	return func(o *options) {
+		o.externalIndexDir = dir
+	}
+}
+
+// IndexOrder decides whether Set makes a write visible in the keyDir before or after
+// it is durable on the disk.
+type IndexOrder int
+
+const (
+	// IndexAfterSync updates the keyDir only after the fsync of the write succeeds.
+	// A key is visible to Get only once it is durable, and a failed write is never
+	// visible. This is the default.
+	IndexAfterSync IndexOrder = iota
+	// IndexBeforeSync updates the keyDir right after the write, and then waits for
+	// the fsync without holding the lock, so that the other reads and writes don't
+	// wait on it.
+	IndexBeforeSync
+)
+
+// WithIndexOrder sets the order of the keyDir update and the fsync in Set.
+//
+// With IndexBeforeSync, there is a window between the write and the end of its
+// fsync where Get already returns the new value, but it is not durable yet. If the
+// machine crashes in this window, the value is lost even though it was read by
+// someone. If the fsync fails, Set returns the error, but the value stays visible
+// till the next restart, and it may or may not be there after it.
+//
+// With IndexAfterSync, Get returns only what is on the disk: if the fsync fails,
+// the write is cut off from the file and the keyDir is left untouched, so the
+// store before and after a restart agree.
+func WithIndexOrder(order IndexOrder) Option {
+	return func(o *options) {
+		o.indexOrder = order
+	}
+}
+
+// WithFileSystem makes the store do all of its file operations through fsys instead
+// of the os package. Pass NewMemFS() to run the store entirely in memory.
+func WithFileSystem(fsys FileSystem) Option {
+	return func(o *options) {
+		o.fileSystem = fsys
+	}
+}
+
+// WithCacheSize enables an LRU cache of the n most recently read values, which
+// serves the hot keys without any disk reads. The cache never serves a value of a
+// key which was written to since, it is disabled by default.
+func WithCacheSize(n int) Option {
+	return func(o *options) {
+		o.cacheSize = n
+	}
+}
+
+// WithCacheTTL makes the read cache serve a value for at most d after it was read
+// from the disk, after which it is read again. The cache is always consistent with
+// the writes of this store, but not with other processes modifying the file. The
+// TTL bounds how stale the values can be in such a case, followed by RebuildIndex.
+// It has no effect without WithCacheSize.
+func WithCacheTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.cacheTTL = d
+	}
+}
+
+// WithFollowSymlinks allows the database path to be a symlink to a regular file. By
+// default NewDiskStore refuses to open a symlink, as pointing the database at the
+// wrong file through a stale or a malicious link is easy to miss.
+func WithFollowSymlinks(follow bool) Option {
+	return func(o *options) {
+		o.followSymlinks = follow
+	}
+}
+
+// WithRotateInterval seals the active segment and starts a new one every d, no
+// matter how large it is, see Rotate. This bounds the time window of the data in
+// every segment, so that the old data can be dropped a segment at a time. Close
+// stops the rotation.
+func WithRotateInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.rotateInterval = d
+	}
+}
+
+// WithRetention deletes the sealed segments whose newest record is older than
+// maxAge, along with the keys which don't have a newer record in a younger segment.
+// It is a cheap alternative to a TTL on every key, the old data is dropped a whole
+// segment at a time. The segments are checked when the store is opened and after
+// every Rotate, so it is best used along with WithRotateInterval.
+func WithRetention(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.retention = maxAge
+	}
+}
+
+// WithLoadProgress sets fn to be called periodically while NewDiskStore loads the
+// keyDir, with the bytes of the segments read so far and the total size of them.
+// The last call has bytesRead equal to totalBytes. A large database takes a while
+// to load, this lets the application show the progress or give up on a startup
+// taking too long.
+//
+// fn is called from the goroutine calling NewDiskStore, and it should be quick.
+func WithLoadProgress(fn func(bytesRead, totalBytes int64)) Option {
+	return func(o *options) {
+		o.loadProgress = fn
+	}
+}
+
+// WithMaxIndexKeys bounds the memory of the keyDir to about n keys. The KeyEntries of
+// the cold keys are evicted from the keyDir past that, and they are found again by
+// scanning the segments when the key is read next. This trades the read latency of
+// the cold keys for a bounded index, for the databases with more keys than the RAM
+// can hold. The data on the disk is never touched.
+//
+// Keys, Len, Merge and the other operations which need all the keys get slow with
+// it, they load the evicted keys back first. The keyDir is loaded in full at the
+// startup, and trimmed down after.
+func WithMaxIndexKeys(n int) Option {
+	return func(o *options) {
+		o.maxIndexKeys = n
+	}
+}
+
+// WithMaxFileSize caps the size of the active segment, in bytes. A write which would
+// take it past the cap is handled as per WithFileFullPolicy: it is rejected with
+// ErrFileFull, or the segment is rotated first. The file never grows past the cap
+// with either of them, which makes the disk usage predictable for the embedded
+// cases.
+//
+// The cap is checked by the writes only. Merge and ReplaceAll write the new file
+// without it.
+func WithMaxFileSize(size int64) Option {
+	return func(o *options) {
+		o.maxFileSize = size
+	}
+}
+
+// WithFileFullPolicy sets what happens to a write which doesn't fit in the active
+// segment under WithMaxFileSize. The default is RejectWhenFileFull.
+func WithFileFullPolicy(policy FileFullPolicy) Option {
+	return func(o *options) {
+		o.fileFullPolicy = policy
+	}
+}
+
+// FileFullPolicy decides what a write does when the active segment has no room for
+// it, see WithMaxFileSize.
+type FileFullPolicy int
+
+const (
+	// RejectWhenFileFull makes the write return ErrFileFull. Nothing is written, and
+	// the store keeps working for the reads and the smaller writes.
+	RejectWhenFileFull FileFullPolicy = iota
+	// RotateWhenFileFull seals the active segment and writes to a new one, see
+	// Rotate. The total size across the segments is not capped.
+	RotateWhenFileFull
+)
+
+// WithWAL makes every write go to a write-ahead log first, see writeAheadLog. A
+// write is durable once it is synced to the WAL, which is a plain sequential file,
+// and the segment is synced only at the checkpoints. This takes the fsync of the
+// segments off the write path, and keeps the durability independent of how the
+// segments are laid out and compacted. The writes which didn't make it to the
+// segment before a crash are replayed from the WAL at the startup.
+//
+// The cost is the write amplification: every record is written twice, once to the
+// WAL and once to the segment, and the WAL is rewritten at every checkpoint.
+func WithWAL() Option {
+	return func(o *options) {
+		o.wal = true
+	}
+}
+
+// WithReadOnly opens the store for reading only, the files are never written to or
+// deleted. All the writes fail with ErrReadOnly. The database file must exist.
+//
+// This is meant for the readers next to a writer in another process, like a read
+// replica on a shared disk. The keyDir is of the files as they were at the open, see
+// RefreshReadOnly to pick up the writes made since.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithComparator sets the order of the keys in SortedKeys, ForEachSorted and Range.
+// cmp returns a negative number when a comes before b, a positive one when after and
+// zero when they are equal, like strings.Compare, which is the default. Use it for
+// an order other than the raw bytes, like the numeric keys where "9" should come
+// before "10". It must be a consistent total order, or the sorted scans are
+// undefined.
+func WithComparator(cmp func(a, b string) int) Option {
+	return func(o *options) {
+		o.comparator = cmp
+	}
+}
+
+// WithDigest keeps a rolling digest of all the records for tamper evidence, see
+// FileDigest. Every record written from now on stores the checksum of the one before
+// it, and its own checksum covers that, see flagChained. The chain is followed at
+// the startup by reading all the records, values included, and then extended with
+// every write.
+func WithDigest() Option {
+	return func(o *options) {
+		o.digest = true
+	}
+}
+
+// WithCompression compresses the values of the records written from now on with
+// DEFLATE. It pays off for the large and repetitive values, a small value could come
+// out larger.
+//
+// Whether a record is compressed is in its flags, so the option only decides about
+// the new writes. The records written with it are read back fine without it, and the
+// other way around, the option can be toggled across the restarts. A formatV1 file
+// can't have the flags, it is rotated on the first compressed write.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compression = true
+	}
+}
+
+// WithUTF8Keys makes the writes reject the keys which are not valid UTF-8 with
+// ErrInvalidKey, for the deployments which log or export the keys as text, like
+// JSON. By default, the keys are arbitrary bytes. The keys already in the store are
+// left alone.
+func WithUTF8Keys(utf8Keys bool) Option {
+	return func(o *options) {
+		o.utf8Keys = utf8Keys
+	}
+}
+
+// WithCorruptionFallback makes Get serve the previous version of a key whose latest
+// record is corrupt, instead of failing with ErrChecksumMismatch. The segments are
+// scanned backwards from the corrupt record for the newest older record of the key
+// which is intact. If there is none, or the key was deleted or had expired before,
+// Get fails as usual. Every fallback is logged, the corrupt record stays in place
+// till it is overwritten.
+//
+// This trades the correctness for the availability: the value served is stale.
+// Leave it off if a stale value is worse than an error.
+func WithCorruptionFallback(fallback bool) Option {
+	return func(o *options) {
+		o.corruptionFallback = fallback
+	}
+}
+
+// WithBatchedReads makes MGet read the records in batches instead of one at a time.
+// The records of the keys are sorted by where they are on the disk, and the ones
+// close to each other, within batchReadGap bytes, are read with a single ReadAt,
+// which cuts down the syscalls for the high rate random reads. Where the OS
+// supports it, the kernel is also told about all the reads up front, with
+// posix_fadvise, so that it can fetch them from the disk in parallel and in the
+// order it likes.
+//
+// The bytes between the records in a batch are read and thrown away, so this pays
+// off when the keys read together are often written together.
+func WithBatchedReads() Option {
+	return func(o *options) {
+		o.batchedReads = true
+	}
+}
+
+// WithFlushOnIdle syncs the active segment and empties the WAL once there have been
+// no writes for d, see WithWAL. During the bursts, the segment is synced only at the
+// checkpoints, and the writes since the last one are only in the WAL. This bounds
+// how long they stay so in the quiet periods, and how much has to be replayed after
+// a crash. Every write restarts the wait, and Close stops it.
+//
+// Without WithWAL, every write is synced right away, and there is nothing to flush.
+func WithFlushOnIdle(d time.Duration) Option {
+	return func(o *options) {
+		o.flushOnIdle = d
+	}
+}
+
+// WithDedup stores the values in a content addressed table: the value of a Set is
+// written once per segment, however many keys it is set to, and the records of the
+// keys refer to it by its SHA-256. This saves the disk space when many keys have
+// the same large value, like the copies of a document. The values smaller than
+// dedupMinSize bytes are written as usual.
+//
+// A stored value is reclaimed by Merge once no live key has it. The store reads
+// the deduplicated records whatever its options are, the option only decides how
+// the new writes are stored. A Batch writes its values as usual.
+func WithDedup() Option {
+	return func(o *options) {
+		o.dedup = true
+	}
+}
+
+// WithSeekMetrics counts the Gets which go to the disk, and the reads of the records
+// they make, in Metrics.DiskGets and Metrics.DiskReads. A Get reads its record with
+// a single ReadAt, and a deduplicated value of WithDedup takes one more for the blob.
+// This checks that the reads stay at that. The reads of all the other operations
+// are counted too, like the ones of Merge, so measure with only the Gets running.
+func WithSeekMetrics() Option {
+	return func(o *options) {
+		o.seekMetrics = true
+	}
+}
+
+// WithMaxSkippedRecords checks every record against its checksum at the startup, and
+// skips the corrupt ones, like Repair does, instead of loading them into the keyDir.
+// If more than n records in total are skipped, NewDiskStore fails with
+// ErrTooManyCorrupt: a badly damaged store would otherwise open with most of its
+// data missing. The number of the records skipped is logged once the store is
+// loaded.
+//
+// This reads the values too, which makes the startup slower. Negative values are
+// ignored.
+func WithMaxSkippedRecords(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.maxSkippedRecords = n
+		}
+	}
+}
+
+// WithVerifyKeyOnRead makes Get check that the record it read from the disk is of
+// the key asked for, and fail with ErrKeyMismatch if it is not, instead of
+// returning the value of another key. The checksum catches the damaged records, but
+// not an intact record at a wrong offset, from a bug or a corrupt index. The key is
+// in the record anyway, the check costs a comparison. The values served from the
+// read cache were checked when they were read.
+func WithVerifyKeyOnRead(verify bool) Option {
+	return func(o *options) {
+		o.verifyKeyOnRead = verify
+	}
+}
+
+// WithRecentKeys remembers the keys of the last n writes, in a ring buffer, for
+// RecentKeys. Every write costs a slot in the ring, it is a fixed amount of memory
+// however large the store is. Values less than one are ignored.
+func WithRecentKeys(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.recentKeys = n
+		}
+	}
+}
+
+// WithMustExist makes NewDiskStore fail with ErrDatabaseNotFound if the database
+// file does not exist, instead of creating an empty one. A mistyped path otherwise
+// looks like a store which lost all its data. Use it for the stores which are
+// created once, by a setup step, and only opened after.
+func WithMustExist(mustExist bool) Option {
+	return func(o *options) {
+		o.mustExist = mustExist
+	}
+}
+
+// WithSyncCoordinator has the fsyncs of the writes batched by c, along with the ones
+// of the other stores sharing it, see SyncCoordinator. It applies to the fsyncs a
+// Set waits for without holding the store's lock, which is the case with
+// WithIndexOrder(IndexBeforeSync): only those can be batched across the concurrent
+// writes. The other writes keep syncing on their own.
+func WithSyncCoordinator(c *SyncCoordinator) Option {
+	return func(o *options) {
+		o.syncCoordinator = c
+	}
+}
+
+// WithDatabaseID gives the database a unique ID, returned by DatabaseID. A random
+// UUID is generated the first time the database is opened with the option, and kept
+// in a record at the start of every segment, so any copy of the files or a dump of
+// DumpTo has it too. The ID stays the same across the merges and the migrations, so
+// the tools like backup catalogs can tell the copies of a database apart from the
+// other databases. Once it has an ID, the database keeps it when opened without the
+// option, and it can't be migrated to formatV1, which has no room for it.
+func WithDatabaseID() Option {
+	return func(o *options) {
+		o.databaseID = true
+	}
+}
+
+// WithColdTier has Merge move the keys not accessed for the given duration to a cold
+// tier: a sealed segment of their own, with the values compressed. The keys accessed
+// since stay in the active segment, the hot tier. Get reads from either tier, only
+// the reads of the cold keys take the decompression. The reads are tracked in the
+// memory, at the cost of an entry for every key read since the last merge. See
+// mergeTiered for the details.
+func WithColdTier(after time.Duration) Option {
+	return func(o *options) {
+		o.coldAfter = after
+	}
+}
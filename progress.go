@@ -0,0 +1,51 @@
+package caskdb
+
+// loadProgressInterval is the number of bytes read between the calls to the
+// WithLoadProgress callback
+const loadProgressInterval = 1 << 20
+
+// loadProgress tracks the bytes read while loading the keyDir, across all the
+// segments, and reports them to the WithLoadProgress callback. The zero value, with
+// fn not set, reports nothing.
+type loadProgress struct {
+	fn    func(bytesRead, totalBytes int64)
+	total int64
+	// done is the total size of the segments scanned before the current one
+	done int64
+	// reported is the bytesRead of the last call to fn
+	reported int64
+}
+
+// newLoadProgress returns the loadProgress for loading the sealed segments and the
+// active segment of the given size
+func (d *DiskStore) newLoadProgress(activeSize int64) *loadProgress {
+	p := &loadProgress{fn: d.opts.loadProgress, total: activeSize}
+	for _, seg := range d.segments {
+		p.total += seg.size
+	}
+	return p
+}
+
+// segment returns the progress callback of scanKeyDir for the next segment, of the
+// given size
+func (p *loadProgress) segment(size int64) func(offset int64) {
+	if p.fn == nil {
+		return nil
+	}
+	start := p.done
+	p.done += size
+	return func(offset int64) {
+		if bytesRead := start + offset; bytesRead-p.reported >= loadProgressInterval {
+			p.reported = bytesRead
+			p.fn(bytesRead, p.total)
+		}
+	}
+}
+
+// finish reports the load as complete. The trailing bytes of an incomplete record
+// are counted as read, so the last call always has bytesRead equal to totalBytes.
+func (p *loadProgress) finish() {
+	if p.fn != nil && (p.reported != p.total || p.total == 0) {
+		p.fn(p.total, p.total)
+	}
+}
@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_WithLoadProgress(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("x", 64*1024)
+	for i := 0; i < 50; i++ {
+		store.Set(fmt.Sprintf("key %d", i), value)
+		if i == 20 {
+			store.Rotate()
+		}
+	}
+	store.Close()
+	var wantTotal int64
+	for _, name := range []string{fileName, segmentName(fileName, 1)} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		wantTotal += stat.Size()
+	}
+
+	var calls [][2]int64
+	progress := func(bytesRead, totalBytes int64) {
+		calls = append(calls, [2]int64{bytesRead, totalBytes})
+	}
+	store, err = NewDiskStore(fileName, WithIndexOnly(true), WithLoadProgress(progress))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if len(calls) < 2 {
+		t.Fatalf("WithLoadProgress() called %v times, want at least 2", len(calls))
+	}
+	for i, call := range calls {
+		if call[1] != wantTotal {
+			t.Errorf("WithLoadProgress() totalBytes = %v, want %v", call[1], wantTotal)
+		}
+		if i > 0 && call[0] <= calls[i-1][0] {
+			t.Errorf("WithLoadProgress() bytesRead = %v after %v, want increasing", call[0], calls[i-1][0])
+		}
+	}
+	if last := calls[len(calls)-1]; last[0] != wantTotal {
+		t.Errorf("WithLoadProgress() last bytesRead = %v, want %v", last[0], wantTotal)
+	}
+}
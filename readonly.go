@@ -0,0 +1,81 @@
+package caskdb
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// RefreshReadOnly catches up a store opened with WithReadOnly with the records
+// appended to the active segment since the open, or the last refresh, by another
+// process. Only the new tail of the file is scanned, from where the keyDir left off.
+// A record still being written is picked up by the next refresh.
+//
+// A rotation or a merge by the writer replaces the active segment underneath, which
+// can't be followed by scanning the tail. RefreshReadOnly returns ErrStale then, and
+// the store has to be reopened.
+//
+// On a writable store, the keyDir is always up to date and there's nothing to do.
+func (d *DiskStore) RefreshReadOnly() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// the writer sealed the active segment, our file is a sealed segment now
+	ids, err := listSegments(d.opts.fileSystem, d.fileName)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 && ids[len(ids)-1] >= d.activeID {
+		return ErrStale
+	}
+	stat, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	// the writer swapped in another file, like with a Merge which left no sealed
+	// segments, and our file is gone
+	current, err := d.opts.fileSystem.Stat(d.fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrStale
+	}
+	if err != nil {
+		return err
+	}
+	if !sameFile(current, stat) {
+		return ErrStale
+	}
+	size := stat.Size()
+	if size < int64(d.writePosition) {
+		return ErrStale
+	}
+	// the file was empty at the open, the writer has written the file header since
+	if d.writePosition == 0 {
+		if size < fileHeaderSize {
+			return nil
+		}
+		header := make([]byte, fileHeaderSize)
+		n, err := d.file.ReadAt(header, 0)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if d.version, err = decodeFileHeader(header[:n]); err != nil {
+			return err
+		}
+		d.writePosition = dataStartOf(d.version)
+	}
+	hSize := headerSizeOf(d.version)
+	_, err = forEachRecordFrom(d.file, int64(d.writePosition), size, d.version, func(position int, h recordHeader, key []byte) error {
+		totalSize := hSize + h.keySize + h.valueSize
+		if d.digest != nil {
+			record := make([]byte, totalSize)
+			if err := readFull(d.file, record, int64(position)); err != nil {
+				return err
+			}
+			d.digest.add(record, d.version)
+		}
+		// the records follow each other, so indexRecord puts each of them at the
+		// right position
+		d.indexRecord(h, string(key), int(totalSize))
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_RefreshReadOnly(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	writer, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer writer.Close()
+	writer.Set("crime and punishment", "dostoevsky")
+
+	reader, err := NewDiskStore(fileName, WithReadOnly())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer reader.Close()
+	if err := reader.Set("hamlet", "shakespeare"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set() error = %v, want %v", err, ErrReadOnly)
+	}
+	writer.Set("anna karenina", "tolstoy")
+	writer.Delete("crime and punishment")
+	if _, err := reader.Get("anna karenina"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() before the refresh error = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	if err := reader.RefreshReadOnly(); err != nil {
+		t.Fatalf("RefreshReadOnly() error = %v", err)
+	}
+	if got, _ := reader.Get("anna karenina"); got != "tolstoy" {
+		t.Errorf("Get() = %v, want %v", got, "tolstoy")
+	}
+	if _, err := reader.Get("crime and punishment"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of the deleted key error = %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// Windows can't rename a file open in the reader
+	if err := writer.Rotate(); err != nil {
+		t.Skipf("Rotate() error = %v", err)
+	}
+	writer.Set("hamlet", "shakespeare")
+	if err := reader.RefreshReadOnly(); !errors.Is(err, ErrStale) {
+		t.Errorf("RefreshReadOnly() after a rotation error = %v, want %v", err, ErrStale)
+	}
+}
+
+func TestDiskStore_RefreshReadOnlyAfterMerge(t *testing.T) {
+	for name, fsys := range map[string]FileSystem{"os": osFS{}, "mem": NewMemFS()} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		writer, err := NewDiskStore(fileName, WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer writer.Close()
+		writer.Set("crime and punishment", "dostoevsky")
+		reader, err := NewDiskStore(fileName, WithFileSystem(fsys), WithReadOnly())
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer reader.Close()
+
+		// no sealed segments before or after the merge, only the file is new
+		writer.Set("crime and punishment", "fyodor dostoevsky")
+		if err := writer.Merge(); err != nil {
+			// Windows can't rename over a file open in the reader
+			t.Skipf("Merge() error = %v", err)
+		}
+		writer.Set("anna karenina", "tolstoy")
+		if err := reader.RefreshReadOnly(); !errors.Is(err, ErrStale) {
+			t.Errorf("%s: RefreshReadOnly() after a merge error = %v, want %v", name, err, ErrStale)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package caskdb
+
+import "sort"
+
+// recentKeys is a ring buffer of the keys written last, oldest first, see
+// WithRecentKeys. A key written again has an entry for every write, the older ones
+// are skipped by RecentKeys.
+type recentKeys struct {
+	keys []string
+	// next is where the next key goes, the oldest key in a full ring
+	next int
+	full bool
+}
+
+func newRecentKeys(capacity int) *recentKeys {
+	return &recentKeys{keys: make([]string, capacity)}
+}
+
+// add records a write of the key, it pushes out the oldest one in a full ring
+func (r *recentKeys) add(key string) {
+	r.keys[r.next] = key
+	r.next = (r.next + 1) % len(r.keys)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// forEachNewest calls fn for the keys in the ring, the newest first, till fn returns
+// false
+func (r *recentKeys) forEachNewest(fn func(key string) bool) {
+	n := r.next
+	if r.full {
+		n = len(r.keys)
+	}
+	for i := 1; i <= n; i++ {
+		if !fn(r.keys[(r.next-i+len(r.keys))%len(r.keys)]) {
+			return
+		}
+	}
+}
+
+// RecentKeys returns the n most recently written live keys, in the order they were
+// written, the newest last. A key is there once, for its latest write, and the
+// deleted and expired keys are not. It returns nil without WithRecentKeys.
+//
+// Only the last writes, as many as the capacity given to WithRecentKeys, are
+// remembered, so there could be less than n keys even if the store has more. The
+// overwrites of the same key take up the room too. At the startup, the ring is
+// filled with the keys of the latest records.
+func (d *DiskStore) RecentKeys(n int) []string {
+	if d.recent == nil || n <= 0 {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var keys []string
+	seen := make(map[string]bool)
+	d.recent.forEachNewest(func(key string) bool {
+		if seen[key] {
+			return true
+		}
+		seen[key] = true
+		if _, ok := d.lookup(key); ok {
+			keys = append(keys, key)
+		}
+		return len(keys) < n
+	})
+	// the newest last
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return keys
+}
+
+// loadRecentKeys fills the ring with the keys of the latest records in the keyDir,
+// in the order they were written. The segment ids and the offsets give the order,
+// the timestamps are only to the second. The caller must hold the write lock.
+func (d *DiskStore) loadRecentKeys() {
+	type written struct {
+		key    string
+		kEntry KeyEntry
+	}
+	capacity := len(d.recent.keys)
+	newest := func(latest []written) {
+		sort.Slice(latest, func(i, j int) bool {
+			a, b := latest[i].kEntry, latest[j].kEntry
+			return a.fileID > b.fileID || (a.fileID == b.fileID && a.position > b.position)
+		})
+	}
+	// the capacity newest of them, trimmed every time it doubles
+	var latest []written
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		latest = append(latest, written{key, kEntry})
+		if len(latest) == 2*capacity {
+			newest(latest)
+			latest = latest[:capacity]
+		}
+		return true
+	})
+	newest(latest)
+	if len(latest) > capacity {
+		latest = latest[:capacity]
+	}
+	for i := len(latest) - 1; i >= 0; i-- {
+		d.recent.add(latest[i].key)
+	}
+}
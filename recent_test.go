@@ -0,0 +1,46 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_RecentKeys(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithRecentKeys(4))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for _, key := range []string{"anna karenina", "brave new world", "crime and punishment", "dune", "anna karenina", "hamlet"} {
+		store.Set(key, "value of "+key)
+	}
+	store.Delete("dune")
+
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, nil},
+		{2, []string{"anna karenina", "hamlet"}},
+		// the ring has the last 4 writes, with dune deleted
+		{10, []string{"crime and punishment", "anna karenina", "hamlet"}},
+	}
+	for _, tt := range tests {
+		if got := store.RecentKeys(tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("RecentKeys(%v) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+	store.Close()
+
+	// the latest records fill the ring at the startup
+	store, err = NewDiskStore(fileName, WithRecentKeys(3))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	want := []string{"crime and punishment", "anna karenina", "hamlet"}
+	if got := store.RecentKeys(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("RecentKeys() after reopen = %v, want %v", got, want)
+	}
+}
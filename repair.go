@@ -0,0 +1,183 @@
+package caskdb
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Repair salvages what it can from a damaged store. It reads the records of all the
+// segments in the order they were written, and writes the ones which match their
+// checksum to a new database file at dst, in the current format. The corrupt
+// records are dropped, and their count is returned. The store itself is not
+// modified, open dst with NewDiskStore to use the repaired data.
+//
+// A corrupt record is skipped by its size, if that takes us to a valid record or the
+// end of the file. Otherwise the sizes in its header are garbage too, and the bytes
+// are searched for the next valid record. The formatV1 records have no checksums, so
+// only the ones which don't fit in the file are dropped.
+//
+// The read lock is held for the entire repair. dst must not exist already.
+func (d *DiskStore) Repair(dst string) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if dst == d.fileName {
+		return 0, ErrRepairInPlace
+	}
+	fsys := d.opts.fileSystem
+	out, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, err
+	}
+	dropped, err := d.repairTo(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(dst)
+		return 0, err
+	}
+	return dropped, nil
+}
+
+// repairTo writes the file header and the valid records of all the segments to w,
+// and returns the number of the corrupt records dropped
+func (d *DiskStore) repairTo(w io.Writer) (int, error) {
+	if _, err := w.Write(encodeFileHeader(currentFormat)); err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, seg := range d.allSegments() {
+		stat, err := seg.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		size := stat.Size()
+		position := int64(dataStartOf(seg.version))
+		for position < size {
+			data, err := validRecordAt(seg.file, position, size, seg.version)
+			if err != nil {
+				return 0, err
+			}
+			if data != nil {
+				h, key, value := decodeKV(data, seg.version)
+				_, record := encodeRecord(h, key, value)
+				if _, err := w.Write(record); err != nil {
+					return 0, err
+				}
+				position += int64(len(data))
+				continue
+			}
+			dropped++
+			if position, err = nextValidRecord(seg.file, position, size, seg.version); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return dropped, nil
+}
+
+// recoverKeyDir is scanKeyDir for WithMaxSkippedRecords. It reads the records whole,
+// to check them against their checksums, and skips the corrupt ones like Repair
+// does. It also returns the number of the records skipped. The trailing bytes of an
+// incomplete record count as one, the next record goes after them.
+func recoverKeyDir(r io.ReaderAt, size int64, version uint32, fileID uint32, keyDir keyIndex, blobs map[blobKey]KeyEntry, progress func(offset int64)) (int, uint64, int, error) {
+	var newest uint64
+	skipped := 0
+	now := time.Now().Unix()
+	hSize := headerSizeOf(version)
+	position := int64(dataStartOf(version))
+	for position < size {
+		data, err := validRecordAt(r, position, size, version)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if data == nil {
+			skipped++
+			if position, err = nextValidRecord(r, position, size, version); err != nil {
+				return 0, 0, 0, err
+			}
+			continue
+		}
+		h := decodeHeader(data[:hSize], version)
+		keyEnd := hSize + h.keySize
+		kEntry := NewKeyEntry(fileID, h.timestamp, uint32(position), uint32(len(data)))
+		_, rest := splitChain(h.flags, data[keyEnd:])
+		kEntry.expiry, _ = splitExpiry(h.flags, rest)
+		loadRecord(keyDir, blobs, kEntry, h.flags, string(data[hSize:keyEnd]), now)
+		if h.timestamp > newest {
+			newest = h.timestamp
+		}
+		position += int64(len(data))
+		if progress != nil {
+			progress(position)
+		}
+	}
+	return int(position), newest, skipped, nil
+}
+
+// nextValidRecord returns the position of the next valid record after the corrupt
+// one at position, or size if there is none
+func nextValidRecord(r io.ReaderAt, position int64, size int64, version uint32) (int64, error) {
+	// without the checksums, any bytes look like a valid record, there is nothing
+	// to search for
+	if version == formatV1 {
+		return size, nil
+	}
+	header := make([]byte, headerSizeOf(version))
+	if _, err := r.ReadAt(header, position); err == nil {
+		h := decodeHeader(header, version)
+		next := position + int64(headerSizeOf(version)) + int64(h.keySize) + int64(h.valueSize)
+		if next == size {
+			return size, nil
+		}
+		if next < size {
+			data, err := validRecordAt(r, next, size, version)
+			if err != nil {
+				return 0, err
+			}
+			if data != nil {
+				return next, nil
+			}
+		}
+	}
+	for next := position + 1; next < size; next++ {
+		data, err := validRecordAt(r, next, size, version)
+		if err != nil {
+			return 0, err
+		}
+		if data != nil {
+			return next, nil
+		}
+	}
+	return size, nil
+}
+
+// validRecordAt returns the record at position, if it fits in the size and matches
+// its checksum. Otherwise it returns nil.
+func validRecordAt(r io.ReaderAt, position int64, size int64, version uint32) ([]byte, error) {
+	hSize := int64(headerSizeOf(version))
+	if position+hSize > size {
+		return nil, nil
+	}
+	header := make([]byte, hSize)
+	if _, err := r.ReadAt(header, position); err != nil {
+		return nil, err
+	}
+	h := decodeHeader(header, version)
+	totalSize := hSize + int64(h.keySize) + int64(h.valueSize)
+	if position+totalSize > size {
+		return nil, nil
+	}
+	data := make([]byte, totalSize)
+	if _, err := r.ReadAt(data, position); err != nil {
+		return nil, err
+	}
+	if !validChecksum(data, version) {
+		return nil, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,118 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiskStore_Repair(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	keys := []string{"anna karenina", "brave new world", "crime and punishment", "dune", "hamlet", "othello"}
+	for _, key := range keys {
+		store.Set(key, "value of "+key)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	// a flipped byte in the value of brave new world, and garbage sizes in the
+	// header of hamlet
+	kEntry, _ := store.keyDir.get("brave new world")
+	file.WriteAt([]byte{'?'}, int64(kEntry.position+kEntry.totalSize-1))
+	kEntry, _ = store.keyDir.get("hamlet")
+	file.WriteAt([]byte{0xff, 0xff, 0xff}, int64(kEntry.position+13))
+	file.Close()
+	before, _ := os.ReadFile(fileName)
+
+	dst := filepath.Join(dir, "repaired.db")
+	dropped, err := store.Repair(dst)
+	if err != nil {
+		t.Fatalf("Repair() error = %v", err)
+	}
+	if dropped != 2 {
+		t.Errorf("Repair() dropped = %v, want %v", dropped, 2)
+	}
+	if after, _ := os.ReadFile(fileName); string(after) != string(before) {
+		t.Errorf("Repair() modified the source file")
+	}
+	if _, err := store.Repair(fileName); err != ErrRepairInPlace {
+		t.Errorf("Repair() error = %v, want %v", err, ErrRepairInPlace)
+	}
+
+	repaired, err := NewDiskStore(dst)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer repaired.Close()
+	if err := repaired.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	got := repaired.Keys()
+	sort.Strings(got)
+	want := []string{"anna karenina", "crime and punishment", "dune", "othello"}
+	if len(got) != len(want) {
+		t.Fatalf("Keys() = %v, want %v", got, want)
+	}
+	for i, key := range want {
+		if got[i] != key {
+			t.Errorf("Keys() = %v, want %v", got, want)
+		}
+		if val, _ := repaired.Get(key); val != "value of "+key {
+			t.Errorf("Get() = %v, want %v", val, "value of "+key)
+		}
+	}
+}
+
+func TestDiskStore_WithMaxSkippedRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	keys := []string{"anna karenina", "brave new world", "crime and punishment", "dune", "hamlet"}
+	for _, key := range keys {
+		store.Set(key, "value of "+key)
+	}
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	// a flipped byte in the values of brave new world and dune
+	for _, key := range []string{"brave new world", "dune"} {
+		kEntry, _ := store.keyDir.get(key)
+		file.WriteAt([]byte{'?'}, int64(kEntry.position+kEntry.totalSize-1))
+	}
+	file.Close()
+	store.Close()
+
+	if _, err := NewDiskStore(fileName, WithMaxSkippedRecords(1)); !errors.Is(err, ErrTooManyCorrupt) {
+		t.Fatalf("NewDiskStore() error = %v, want %v", err, ErrTooManyCorrupt)
+	}
+	store, err = NewDiskStore(fileName, WithMaxSkippedRecords(2))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	got := store.Keys()
+	sort.Strings(got)
+	want := []string{"anna karenina", "crime and punishment", "hamlet"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	// the writes go after the skipped records
+	store.Set("dune", "frank herbert")
+	if val, _ := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+}
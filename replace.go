@@ -0,0 +1,72 @@
+package caskdb
+
+import (
+	"bufio"
+	"math"
+	"time"
+)
+
+// ReplaceAll replaces the whole contents of the store with pairs, in one durable
+// step. The keys not in pairs are gone. It is meant for the cases where the full
+// desired state is known, like pushing a new config.
+//
+// A new file with exactly the pairs is written and synced first, and then renamed
+// over the database file, like Merge does. A crash before the rename leaves the old
+// contents in place. The sealed segments are moved to the trash right before the
+// rename, and the startup after a crash either puts them back or removes them, so
+// they never come back along with the new file. See replaceFiles.
+//
+// The records are written like the ones of Set, compressed with WithCompression and
+// chained with WithDigest, but the values are not deduplicated with WithDedup. A key
+// which can't be written, see WithUTF8Keys, fails ReplaceAll before anything is
+// written. So does a file past 4GiB with ErrFileFull, the positions in the keyDir
+// are 32 bits.
+func (d *DiskStore) ReplaceAll(pairs map[string]string) error {
+	for key := range pairs {
+		if err := d.checkKey(key); err != nil {
+			return err
+		}
+	}
+	timestamp := uint64(time.Now().Unix())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.replaceFile(currentFormat, func(dst File) (keyIndex, int, error) {
+		w := bufio.NewWriter(dst)
+		if _, err := w.Write(encodeFileHeader(currentFormat)); err != nil {
+			return nil, 0, err
+		}
+		writePosition := uint64(fileHeaderSize)
+		// the new file starts the chain of the digest over, from the database ID
+		chain := &digestChain{}
+		if record := d.idRecord(currentFormat); record != nil {
+			if _, err := w.Write(record); err != nil {
+				return nil, 0, err
+			}
+			writePosition += uint64(len(record))
+			chain.add(record, currentFormat)
+		}
+		prev := chain.sum
+		keyDir := newKeyIndex(d.opts)
+		for key, value := range pairs {
+			h := recordHeader{timestamp: timestamp}
+			h.flags |= d.compressFlag(h.flags)
+			var data []byte
+			data, _, prev = d.encodeBatchIn(currentFormat, prev, []recordHeader{h}, []batchOp{{h.flags, key, value}})
+			if writePosition+uint64(len(data)) > math.MaxUint32 {
+				closeIndex(keyDir)
+				return nil, 0, ErrFileFull
+			}
+			if _, err := w.Write(data); err != nil {
+				closeIndex(keyDir)
+				return nil, 0, err
+			}
+			keyDir.put(key, NewKeyEntry(d.activeID, timestamp, uint32(writePosition), uint32(len(data))))
+			writePosition += uint64(len(data))
+		}
+		if err := w.Flush(); err != nil {
+			closeIndex(keyDir)
+			return nil, 0, err
+		}
+		return keyDir, int(writePosition), nil
+	})
+}
@@ -0,0 +1,184 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_ReplaceAll(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithCacheSize(10))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	store.Set("anna karenina", "tolstoy")
+	store.Rotate()
+	store.Set("hamlet", "shakespeare")
+	store.Get("hamlet")
+
+	pairs := map[string]string{
+		"hamlet": "william",
+		"dune":   "frank herbert",
+	}
+	if err := store.ReplaceAll(pairs); err != nil {
+		t.Fatalf("ReplaceAll() error = %v", err)
+	}
+	if _, err := os.Stat(segmentName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("ReplaceAll() left behind the sealed segment")
+	}
+	check := func(store *DiskStore) {
+		keys := store.Keys()
+		sort.Strings(keys)
+		if len(keys) != 2 || keys[0] != "dune" || keys[1] != "hamlet" {
+			t.Errorf("Keys() = %v, want [dune hamlet]", keys)
+		}
+		for key, val := range pairs {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("Get() = %v, want %v", got, val)
+			}
+		}
+		if _, err := store.Get("anna karenina"); err != ErrKeyNotFound {
+			t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+	check(store)
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+// errStuck is the error of stuckFS
+var errStuck = errors.New("file is stuck")
+
+// stuckFS fails the renames and the removes of MemFS for the names fail returns
+// true for
+type stuckFS struct {
+	*MemFS
+	fail func(name string) bool
+}
+
+func (s *stuckFS) Rename(oldName string, newName string) error {
+	if s.fail(oldName) {
+		return errStuck
+	}
+	return s.MemFS.Rename(oldName, newName)
+}
+
+func (s *stuckFS) Remove(name string) error {
+	if s.fail(name) {
+		return errStuck
+	}
+	return s.MemFS.Remove(name)
+}
+
+func TestDiskStore_ReplaceAllCrash(t *testing.T) {
+	setup := func(fsys FileSystem) *DiskStore {
+		store, err := NewDiskStore("test.db", WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("crime and punishment", "dostoevsky")
+		store.Rotate()
+		store.Set("hamlet", "shakespeare")
+		return store
+	}
+	check := func(fsys FileSystem, want map[string]string) {
+		store, err := NewDiskStore("test.db", WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer store.Close()
+		keys := store.Keys()
+		sort.Strings(keys)
+		if len(keys) != len(want) {
+			t.Errorf("Keys() after reopen = %v, want the keys of %v", keys, want)
+		}
+		for key, val := range want {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("Get() after reopen = %v, want %v", got, val)
+			}
+		}
+	}
+
+	// the swap is done, but the replaced segment is stuck in the trash
+	memFS := NewMemFS()
+	store := setup(&stuckFS{memFS, func(name string) bool { return strings.HasSuffix(name, trashSuffix) }})
+	if err := store.ReplaceAll(map[string]string{"dune": "frank herbert"}); err != nil {
+		t.Fatalf("ReplaceAll() error = %v", err)
+	}
+	store.Close()
+	check(memFS, map[string]string{"dune": "frank herbert"})
+
+	// a crash in between the trash and the swap, the segment can't be put back
+	memFS = NewMemFS()
+	store = setup(&stuckFS{memFS, func(name string) bool {
+		return strings.HasSuffix(name, mergeSuffix) || strings.HasSuffix(name, trashSuffix)
+	}})
+	if err := store.ReplaceAll(map[string]string{"dune": "frank herbert"}); err == nil {
+		t.Fatalf("ReplaceAll() error = nil, want an error")
+	}
+	store.Close()
+	check(memFS, map[string]string{"crime and punishment": "dostoevsky", "hamlet": "shakespeare"})
+}
+
+func TestDiskStore_ReplaceAllOptions(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithUTF8Keys(true), WithCompression(), WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	if err := store.ReplaceAll(map[string]string{"dune": "frank herbert", "hamlet\xff": "x"}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("ReplaceAll() error = %v, want %v", err, ErrInvalidKey)
+	}
+	if got, _ := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() after a failed ReplaceAll() = %v, want %v", got, "shakespeare")
+	}
+	value := strings.Repeat("call me ishmael. ", 10)
+	pairs := map[string]string{"moby dick": value, "dune": "frank herbert"}
+	if err := store.ReplaceAll(pairs); err != nil {
+		t.Fatalf("ReplaceAll() error = %v", err)
+	}
+	digest := store.FileDigest()
+	store.Close()
+
+	// the records are compressed and chained, like the ones of Set
+	data, _ := os.ReadFile(fileName)
+	var prev uint32
+	for position := fileHeaderSize; position < len(data); {
+		h := decodeHeader(data[position:position+headerSize], currentFormat)
+		if want := flagCompressed | flagChained; h.flags != want {
+			t.Errorf("record at %v flags = %v, want %v", position, h.flags, want)
+		}
+		prev = h.checksum
+		position += headerSize + int(h.keySize+h.valueSize)
+	}
+	if want := binary.LittleEndian.AppendUint32(nil, prev); !bytes.Equal(digest, want) {
+		t.Errorf("FileDigest() = %x, want the checksum of the last record %x", digest, want)
+	}
+	store, err = NewDiskStore(fileName, WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range pairs {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	if got := store.FileDigest(); !bytes.Equal(got, digest) {
+		t.Errorf("FileDigest() after reopen = %x, want %x", got, digest)
+	}
+}
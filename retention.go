@@ -0,0 +1,62 @@
+package caskdb
+
+import "time"
+
+// expireSegments deletes the sealed segments past the retention, see WithRetention.
+// A read-only store leaves them to the writer. The caller must hold the write lock.
+func (d *DiskStore) expireSegments(now time.Time) error {
+	if d.opts.retention <= 0 || d.opts.readOnly {
+		return nil
+	}
+	cutoff := now.Add(-d.opts.retention).Unix()
+	dropped := false
+	// the segments are deleted oldest first, and we stop at the first one which is
+	// still within the retention. Deleting a younger segment while an older one is
+	// kept would bring back the older values of its keys on the next startup
+	for _, seg := range d.sortedSegments() {
+		if int64(seg.newest) >= cutoff {
+			break
+		}
+		if err := d.dropSegment(seg); err != nil {
+			return err
+		}
+		dropped = true
+	}
+	if dropped && d.digest != nil {
+		return d.rebuildDigest()
+	}
+	return nil
+}
+
+// dropSegment deletes the sealed segment, and the keys whose latest record is in
+// it. The caller must hold the write lock.
+func (d *DiskStore) dropSegment(seg *segment) error {
+	// the file is closed before removing, Windows can't remove an open file
+	seg.file.Close()
+	if err := d.opts.fileSystem.Remove(seg.name); err != nil {
+		if reopened, openErr := d.openSegment(seg.id); openErr == nil {
+			reopened.newest = seg.newest
+			d.segments[seg.id] = reopened
+		}
+		return err
+	}
+	delete(d.segments, seg.id)
+	var keys []string
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.fileID == seg.id {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		d.keyDir.delete(key)
+		d.expiry.remove(key)
+	}
+	// the refs to the blobs of the segment are all in it, and gone with it
+	for blob := range d.blobs {
+		if blob.fileID == seg.id {
+			delete(d.blobs, blob)
+		}
+	}
+	return d.renumberActive()
+}
@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_WithRetention(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the first segment has only the records from two hours back
+	old := uint64(time.Now().Add(-2 * time.Hour).Unix())
+	for _, kv := range [][2]string{{"crime and punishment", "dostoevsky"}, {"anna karenina", "tolstoy"}} {
+		_, record := encodeKV(old, kv[0], kv[1])
+		if err := store.ApplyRecord(record); err != nil {
+			t.Fatalf("ApplyRecord() error = %v", err)
+		}
+	}
+	store.Rotate()
+	// anna karenina is written again, into the second segment
+	store.Set("anna karenina", "leo tolstoy")
+	store.Set("hamlet", "shakespeare")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+
+	// the aged out segment is deleted by the first Rotate, and the active segment
+	// takes its id, the one it would get at the next startup
+	segments, err := store.Segments()
+	if err != nil {
+		t.Fatalf("Segments() error = %v", err)
+	}
+	if len(segments) != 2 || segments[0].ID != 1 || segments[0].Age > time.Hour {
+		t.Errorf("Segments() = %+v, want the segment within the retention and the active one", segments)
+	}
+	if _, err := os.Stat(segmentName(fileName, 2)); !os.IsNotExist(err) {
+		t.Errorf("Rotate() left a segment behind: %v", err)
+	}
+	check := func(store *DiskStore) {
+		if _, err := store.Get("crime and punishment"); err != ErrKeyNotFound {
+			t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+		}
+		for key, val := range map[string]string{"anna karenina": "leo tolstoy", "hamlet": "shakespeare"} {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("Get() = %v, want %v", got, val)
+			}
+		}
+	}
+	check(store)
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestDiskStore_WithRetentionOnOpen(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	_, record := encodeKV(uint64(time.Now().Add(-2*time.Hour).Unix()), "hamlet", "shakespeare")
+	store.ApplyRecord(record)
+	store.Rotate()
+	store.Close()
+
+	store, err = NewDiskStore(fileName, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Has("hamlet") {
+		t.Errorf("Has() = true, want false for a key in an aged out segment")
+	}
+	if _, err := os.Stat(segmentName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("NewDiskStore() did not delete the aged out segment")
+	}
+}
@@ -0,0 +1,109 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Record is a record of a database file, as read by ScanFile
+type Record struct {
+	// Offset is the byte offset of the record in the file
+	Offset int64
+	// Key is the key of the record
+	Key string
+	// Value is the value of the record, empty for a delete
+	Value string
+	// Timestamp is the time of the write, in unix epoch seconds
+	Timestamp uint64
+	// Expiry is the time the value expires at, in unix epoch seconds, or zero if it
+	// never does
+	Expiry uint64
+	// Meta is the metadata stored by SetWithMeta, nil if there is none
+	Meta []byte
+	// Deleted is true for the tombstone of a delete
+	Deleted bool
+}
+
+// ScanFile reads the database file at path and calls fn with every record in it, in
+// the order they were written, overwritten and deleted ones included. It is meant for
+// the tools which process the log once, like analytics over the writes. No keyDir is
+// built for the scan, only the records in the blobs of WithDedup are kept track of,
+// to resolve the values referring to them. The scan stops at the first error
+// returned by fn, and returns it.
+//
+// A torn write at the end of the file is not an error, the scan just ends before it:
+// that is an incomplete record, or a last record which does not match its checksum.
+// A corrupt record anywhere else is reported with a *VerifyError.
+func ScanFile(path string, fn func(rec Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	header := make([]byte, fileHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	version, err := decodeFileHeader(header[:n])
+	if err != nil {
+		return err
+	}
+	hSize := headerSizeOf(version)
+	blobs := make(map[string]KeyEntry)
+	_, err = forEachRecord(file, size, version, func(position int, h recordHeader, _ []byte) error {
+		data := make([]byte, hSize+h.keySize+h.valueSize)
+		if err := readFull(file, data, int64(position)); err != nil {
+			return err
+		}
+		if !validChecksum(data, version) {
+			if int64(position+len(data)) == size {
+				return errTornTail
+			}
+			return &VerifyError{File: path, Offset: int64(position), Err: ErrChecksumMismatch}
+		}
+		h, key, value := decodeKV(data, version)
+		if h.flags&flagBlob != 0 {
+			blobs[key] = NewKeyEntry(0, h.timestamp, uint32(position), uint32(len(data)))
+			return nil
+		}
+		// the database ID is no record of a write
+		if h.flags&flagDatabaseID != 0 {
+			return nil
+		}
+		if h.flags&flagRef != 0 {
+			kEntry, ok := blobs[value]
+			if !ok {
+				return fmt.Errorf("caskdb: blob %x of the record at offset %d does not exist", value, position)
+			}
+			blob := make([]byte, kEntry.totalSize)
+			if err := readFull(file, blob, int64(kEntry.position)); err != nil {
+				return err
+			}
+			_, _, value = decodeKV(blob, version)
+		}
+		return fn(Record{
+			Offset:    int64(position),
+			Key:       key,
+			Value:     value,
+			Timestamp: h.timestamp,
+			Expiry:    h.expiry,
+			Meta:      h.meta,
+			Deleted:   h.flags&flagTombstone != 0,
+		})
+	})
+	if err == errTornTail {
+		return nil
+	}
+	return err
+}
+
+// errTornTail ends the scan of ScanFile at a torn write
+var errTornTail = errors.New("caskdb: torn write at the end of the file")
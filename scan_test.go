@@ -0,0 +1,72 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	long := strings.Repeat("all happy families are alike. ", 5)
+	store.Set("crime and punishment", "dostoevsky")
+	store.SetWithMeta("anna karenina", "tolstoy", []byte("1878"))
+	store.Set("war and peace", long)
+	store.Set("anna karenina", long)
+	store.Delete("crime and punishment")
+	store.Close()
+	// a torn write at the end
+	file, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	file.Write([]byte("torn"))
+	file.Close()
+
+	type scanned struct {
+		key     string
+		value   string
+		meta    string
+		deleted bool
+	}
+	want := []scanned{
+		{"crime and punishment", "dostoevsky", "", false},
+		{"anna karenina", "tolstoy", "1878", false},
+		{"war and peace", long, "", false},
+		{"anna karenina", long, "", false},
+		{"crime and punishment", "", "", true},
+	}
+	var got []scanned
+	var offset int64 = -1
+	err = ScanFile(fileName, func(rec Record) error {
+		if rec.Offset <= offset {
+			t.Errorf("Record.Offset = %v, want past %v", rec.Offset, offset)
+		}
+		offset = rec.Offset
+		got = append(got, scanned{rec.Key, rec.Value, string(rec.Meta), rec.Deleted})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanFile() = %v, want %v", got, want)
+	}
+
+	errStop := errors.New("stop")
+	visited := 0
+	err = ScanFile(fileName, func(rec Record) error {
+		visited++
+		if visited == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || visited != 2 {
+		t.Errorf("ScanFile() = %v after %v records, want %v after 2", err, visited, errStop)
+	}
+}
@@ -0,0 +1,336 @@
+package caskdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The data is spread over one or more files, called segments. All the writes go to
+// the active segment, which is the file given to NewDiskStore. Rotate seals the
+// active segment by renaming it to `<file name>.<id>`, and starts a fresh active
+// segment in its place:
+//
+//	books.db.1   sealed, oldest
+//	books.db.2   sealed
+//	books.db     active
+//
+// The sealed segments are never written to again, only read. Every KeyEntry has the
+// id of the segment its record is in. The active segment's id is always one more
+// than the newest sealed segment's, or 1 if there are none: when Merge or the
+// retention removes the newest sealed segments, the active one is renumbered, see
+// renumberActive. At startup, the sealed segments
+// are loaded in the order of their ids, followed by the active one, so a newer
+// record of a key overrides the older ones, just like within a single file.
+//
+// Splitting the data by time like this makes it possible to drop or compact the old
+// data a segment at a time.
+
+// segment is a sealed segment
+type segment struct {
+	id      uint32
+	name    string
+	file    File
+	version uint32
+	// size is the size of the file, the sealed segments don't change
+	size int64
+	// newest is the newest timestamp of the records in the segment
+	newest uint64
+}
+
+// segmentName returns the file name of the sealed segment with the given id
+func segmentName(fileName string, id uint32) string {
+	return fileName + "." + strconv.FormatUint(uint64(id), 10)
+}
+
+// listSegments returns the ids of the sealed segments of fileName, in ascending order
+func listSegments(fsys FileSystem, fileName string) ([]uint32, error) {
+	names, err := fsys.ReadDirNames(filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(fileName) + "."
+	var ids []uint32
+	for _, name := range names {
+		if len(name) <= len(prefix) || name[:len(prefix)] != prefix {
+			continue
+		}
+		id, err := strconv.ParseUint(name[len(prefix):], 10, 32)
+		if err != nil || segmentName(prefix[:len(prefix)-1], uint32(id)) != name {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegments opens the sealed segments, initKeyDir loads them into the keyDir. The
+// active segment gets the id after the newest sealed segment.
+func (d *DiskStore) openSegments() error {
+	ids, err := listSegments(d.opts.fileSystem, d.fileName)
+	if err != nil {
+		return err
+	}
+	d.segments = make(map[uint32]*segment)
+	d.activeID = 1
+	for _, id := range ids {
+		seg, err := d.openSegment(id)
+		if err != nil {
+			d.closeSegments()
+			return err
+		}
+		d.segments[id] = seg
+		d.activeID = id + 1
+	}
+	return nil
+}
+
+// openSegment opens the sealed segment with the given id, read only
+func (d *DiskStore) openSegment(id uint32) (*segment, error) {
+	name := segmentName(d.fileName, id)
+	file, err := d.opts.fileSystem.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, name: name, file: file}
+	if err := seg.init(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+// init reads the size and the format version of the segment
+func (s *segment) init() error {
+	stat, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = stat.Size()
+	header := make([]byte, fileHeaderSize)
+	n, err := s.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	s.version, err = decodeFileHeader(header[:n])
+	return err
+}
+
+// sortedSegments returns the sealed segments in the ascending order of their ids
+func (d *DiskStore) sortedSegments() []*segment {
+	segments := make([]*segment, 0, len(d.segments))
+	for _, seg := range d.segments {
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+	return segments
+}
+
+// allSegments returns the sealed segments in the ascending order of their ids,
+// followed by the active segment. The caller must hold the lock.
+func (d *DiskStore) allSegments() []*segment {
+	active := &segment{id: d.activeID, name: d.fileName, file: d.file, version: d.version, size: int64(d.writePosition), newest: d.newest}
+	return append(d.sortedSegments(), active)
+}
+
+func (d *DiskStore) closeSegments() {
+	for _, seg := range d.segments {
+		seg.file.Close()
+	}
+}
+
+// segmentFile returns the file and the format version of the segment with the
+// given id, which could be the active one. The caller must hold the lock.
+func (d *DiskStore) segmentFile(id uint32) (File, uint32, error) {
+	if id == d.activeID {
+		return d.file, d.version, nil
+	}
+	seg, ok := d.segments[id]
+	if !ok {
+		return nil, 0, fmt.Errorf("caskdb: segment %d does not exist", id)
+	}
+	return seg.file, seg.version, nil
+}
+
+// readRecord reads the record pointed by the kEntry, and returns it along with the
+// format version it is in. The caller must hold the lock.
+func (d *DiskStore) readRecord(kEntry KeyEntry) ([]byte, uint32, error) {
+	file, version, err := d.segmentFile(kEntry.fileID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// we read at the right offset directly instead of moving the file cursor with
+	// Seek, since the cursor is shared and there could be many Gets running
+	// concurrently under the read lock
+	data := make([]byte, kEntry.totalSize)
+	d.countRead()
+	if _, err := file.ReadAt(data, int64(kEntry.position)); err != nil {
+		return nil, 0, err
+	}
+	return data, version, nil
+}
+
+// Rotate seals the active segment and starts a new one. An empty active segment is
+// not sealed, there is nothing in it but the database ID at most. See
+// WithRotateInterval to rotate on a schedule. With WithRetention, the sealed
+// segments past the retention are deleted after the rotation.
+func (d *DiskStore) Rotate() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.rotate(); err != nil {
+		return err
+	}
+	return d.expireSegments(time.Now())
+}
+
+// rotate is Rotate, the caller must hold the write lock
+func (d *DiskStore) rotate() error {
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if d.writePosition == dataStartOf(d.version) {
+		return nil
+	}
+	// nor is one with just the database ID, every new segment starts with it
+	if d.writePosition == dataStartOf(d.version)+len(d.idRecord(d.version)) {
+		if id, err := findID(d.file, int64(d.writePosition), d.version); err != nil || id != "" {
+			return err
+		}
+	}
+	fsys := d.opts.fileSystem
+	name := segmentName(d.fileName, d.activeID)
+	// the file is closed before renaming, Windows can't rename an open file
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	renameErr := fsys.Rename(d.fileName, name)
+	if renameErr != nil {
+		// we continue with the old active segment
+		file, err := fsys.OpenFile(d.fileName, os.O_APPEND|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		d.file = file
+		return renameErr
+	}
+	seg, err := d.openSegment(d.activeID)
+	if err != nil {
+		return d.unseal(name, err)
+	}
+	file, err := fsys.OpenFile(d.fileName, os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		seg.file.Close()
+		return d.unseal(name, err)
+	}
+	seg.newest = d.newest
+	d.segments[seg.id] = seg
+	d.file = file
+	d.activeID++
+	d.newest = 0
+	d.version = currentFormat
+	d.writePosition = 0
+	if err := d.write(encodeFileHeader(currentFormat)); err != nil {
+		return err
+	}
+	d.writePosition = fileHeaderSize
+	if record := d.idRecord(currentFormat); record != nil {
+		if err := d.write(record); err != nil {
+			return err
+		}
+		d.addDigest(record)
+		d.writePosition += len(record)
+	}
+	// the sealed segment was synced, the WAL has nothing for the new one
+	return d.checkpointWAL()
+}
+
+// unseal undoes a rotation which failed past the rename of the active segment to
+// name: the segment is renamed back and opened as the active segment again, and err
+// is returned. If it can't be renamed back, it is opened under name, which the next
+// startup loads as a sealed segment along with the same records. The caller must
+// hold the write lock.
+func (d *DiskStore) unseal(name string, err error) error {
+	fsys := d.opts.fileSystem
+	if fsys.Rename(name, d.fileName) == nil {
+		name = d.fileName
+	}
+	file, openErr := fsys.OpenFile(name, os.O_APPEND|os.O_RDWR, 0666)
+	if openErr != nil {
+		return openErr
+	}
+	d.file = file
+	return err
+}
+
+// renumberActive gives the active segment the id it gets at the next startup, one
+// past the newest sealed segment, after the sealed segments were removed. The id
+// goes in the entries of the WAL and in the watermarks of ShipSince, so it has to
+// stay the same across a restart. The WAL is checkpointed, its entries are of the
+// old id. The caller must hold the write lock.
+func (d *DiskStore) renumberActive() error {
+	id := uint32(1)
+	for sealed := range d.segments {
+		if sealed >= id {
+			id = sealed + 1
+		}
+	}
+	if id == d.activeID {
+		return nil
+	}
+	repointed := make(map[string]KeyEntry)
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.fileID == d.activeID {
+			kEntry.fileID = id
+			repointed[key] = kEntry
+		}
+		return true
+	})
+	for key, kEntry := range repointed {
+		d.keyDir.put(key, kEntry)
+	}
+	for blob, kEntry := range d.blobs {
+		if blob.fileID == d.activeID {
+			delete(d.blobs, blob)
+			kEntry.fileID = id
+			d.blobs[blobKey{id, blob.hash}] = kEntry
+		}
+	}
+	d.activeID = id
+	// a cached value could be of an older segment which had the id
+	if d.cache != nil {
+		d.cache.reset()
+	}
+	return d.checkpointWAL()
+}
+
+// updateNewest records the timestamp of a record written to the active segment.
+// The caller must hold the write lock.
+func (d *DiskStore) updateNewest(timestamp uint64) {
+	if timestamp > d.newest {
+		d.newest = timestamp
+	}
+}
+
+// runRotator rotates the active segment every interval, till rotateStop is closed
+func (d *DiskStore) runRotator(interval time.Duration) {
+	defer close(d.rotateDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.rotateStop:
+			return
+		case <-ticker.C:
+			// TODO: log the error
+			d.Rotate()
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package caskdb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Rotate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	store.Set("anna karenina", "tolstoy")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	// an empty active segment is not sealed
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	store.Set("anna karenina", "leo tolstoy")
+	store.Set("hamlet", "shakespeare")
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "leo tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+	store.Close()
+	if ids, _ := listSegments(osFS{}, fileName); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("listSegments() = %v, want [1]", ids)
+	}
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() after reopen = %v, want %v", got, val)
+		}
+	}
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestDiskStore_WithRotateInterval(t *testing.T) {
+	interval := 50 * time.Millisecond
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithRotateInterval(interval))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	time.Sleep(3 * interval)
+	store.Set("anna karenina", "tolstoy")
+	time.Sleep(3 * interval)
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	for _, name := range []string{segmentName(fileName, 1), segmentName(fileName, 2)} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("sealed segment %v does not exist: %v", name, err)
+		}
+	}
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_MergeSegments(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("anna karenina", "draft")
+	store.Set("hamlet", "shakespeare")
+	store.Rotate()
+	store.Set("anna karenina", "tolstoy")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if _, err := os.Stat(segmentName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("Merge() left behind the sealed segment")
+	}
+	for key, val := range map[string]string{"anna karenina": "tolstoy", "hamlet": "shakespeare"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+// exclFS fails the exclusive creates of MemFS, like the one of a new active segment
+type exclFS struct {
+	*MemFS
+}
+
+func (e *exclFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&os.O_EXCL != 0 {
+		return nil, errors.New("disk on fire")
+	}
+	return e.MemFS.OpenFile(name, flag, perm)
+}
+
+func TestDiskStore_RotateFailure(t *testing.T) {
+	memFS := NewMemFS()
+	store, err := NewDiskStore("test.db", WithFileSystem(&exclFS{memFS}))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	if err := store.Rotate(); err == nil {
+		t.Fatalf("Rotate() error = nil, want an error")
+	}
+	// the store goes on with the old active segment
+	if err := store.Set("anna karenina", "tolstoy"); err != nil {
+		t.Fatalf("Set() after a failed Rotate() error = %v", err)
+	}
+	if got, err := store.Get("crime and punishment"); err != nil || got != "dostoevsky" {
+		t.Errorf("Get() after a failed Rotate() = %v, %v, want %v", got, err, "dostoevsky")
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db", WithFileSystem(memFS))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range map[string]string{"crime and punishment": "dostoevsky", "anna karenina": "tolstoy"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() after reopen = %v, want %v", got, val)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package caskdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// SegmentInfo describes a segment file, see Segments
+type SegmentInfo struct {
+	// ID is the id of the segment, the order the segments were written in
+	ID uint32
+	// Path is the file of the segment
+	Path string
+	// Active is true for the active segment, which takes the writes
+	Active bool
+	// Size is the size of the file
+	Size int64
+	// LiveBytes is the size of the records the keyDir points to
+	LiveBytes int64
+	// DeadBytes is the size of the rest of the records, overwritten or deleted since
+	DeadBytes int64
+	// Age is the time since the newest record of the segment was written, zero for
+	// an empty segment
+	Age time.Duration
+}
+
+// Segments returns the segments of the store, oldest first, the active one last.
+// Like FragmentationByPrefix, it scans the headers and the keys of all the segments
+// to tell the live bytes from the dead ones, holding the read lock.
+//
+// This is meant for the operators and the tools which look after the files, see
+// DropSegment.
+func (d *DiskStore) Segments() ([]SegmentInfo, error) {
+	if err := d.restoreEvicted(); err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now()
+	var infos []SegmentInfo
+	for _, seg := range d.allSegments() {
+		info := SegmentInfo{ID: seg.id, Path: seg.name, Active: seg.id == d.activeID, Size: seg.size}
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+			size := int64(headerSizeOf(seg.version) + h.keySize + h.valueSize)
+			if d.liveAt(string(key), seg.id, position) {
+				info.LiveBytes += size
+			} else {
+				info.DeadBytes += size
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if seg.newest > 0 {
+			info.Age = now.Sub(time.Unix(int64(seg.newest), 0))
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// DropSegment deletes the sealed segment with the given id, if none of its records
+// are needed anymore. It refuses with ErrSegmentLive if the segment has the latest
+// record of a key. It also refuses if the segment has a delete or an expired record
+// which hides an older record of the key in an older segment, dropping it would
+// bring the older value back on the next startup. The active segment can't be
+// dropped.
+func (d *DiskStore) DropSegment(id uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.opts.readOnly {
+		return ErrReadOnly
+	}
+	if id == d.activeID {
+		return fmt.Errorf("caskdb: segment %d is the active segment", id)
+	}
+	seg, ok := d.segments[id]
+	if !ok {
+		return fmt.Errorf("caskdb: segment %d does not exist", id)
+	}
+	// the evicted keys could be live in the segment too
+	if err := d.restoreEvictedLocked(); err != nil {
+		return err
+	}
+	// hiding has the keys whose records in the segment hide the older ones
+	hiding := make(map[string]bool)
+	_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, h recordHeader, key []byte) error {
+		if d.liveAt(string(key), seg.id, position) {
+			return fmt.Errorf("%w: segment %d has the latest record of %q", ErrSegmentLive, id, key)
+		}
+		if h.flags&flagTombstone != 0 || h.flags&flagExpiry != 0 {
+			// a newer record of the key in a newer segment hides the older ones
+			// anyway
+			if _, ok := d.keyDir.get(string(key)); !ok {
+				hiding[string(key)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(hiding) > 0 {
+		for _, older := range d.sortedSegments() {
+			if older.id >= id {
+				break
+			}
+			_, err := forEachRecord(older.file, older.size, older.version, func(_ int, h recordHeader, key []byte) error {
+				if h.flags&flagTombstone == 0 && hiding[string(key)] {
+					return fmt.Errorf("%w: segment %d hides an older record of %q", ErrSegmentLive, id, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := d.dropSegment(seg); err != nil {
+		return err
+	}
+	return d.rebuildDigest()
+}
+
+// liveAt reports whether the keyDir points to the record of the key at the segment
+// and the position. The caller must hold the lock.
+func (d *DiskStore) liveAt(key string, fileID uint32, position int) bool {
+	kEntry, ok := d.keyDir.get(key)
+	return ok && kEntry.fileID == fileID && kEntry.position == uint32(position)
+}
@@ -0,0 +1,91 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Segments(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("crime and punishment", "dostoevsky")
+	store.Set("anna karenina", "tolstoy")
+	store.Rotate()
+	store.Set("crime and punishment", "fyodor dostoevsky")
+	store.Set("anna karenina", "leo tolstoy")
+	store.Delete("hamlet")
+	store.Set("hamlet", "shakespeare")
+	store.Rotate()
+	store.Delete("hamlet")
+
+	infos, err := store.Segments()
+	if err != nil {
+		t.Fatalf("Segments() error = %v", err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("len(Segments()) = %v, want %v", len(infos), 3)
+	}
+	for i, info := range infos {
+		if info.ID != uint32(i+1) || info.Active != (i == 2) {
+			t.Errorf("Segments()[%d] = %+v, want the id %v", i, info, i+1)
+		}
+	}
+	if infos[0].LiveBytes != 0 || infos[0].DeadBytes != infos[0].Size-fileHeaderSize {
+		t.Errorf("Segments()[0] = %+v, want all the records dead", infos[0])
+	}
+	if infos[1].LiveBytes == 0 || infos[1].DeadBytes == 0 {
+		t.Errorf("Segments()[1] = %+v, want both the live and the dead records", infos[1])
+	}
+	if infos[1].Path != segmentName(fileName, 2) || infos[2].Path != fileName {
+		t.Errorf("Segments() paths = %v, %v, want %v, %v", infos[1].Path, infos[2].Path, segmentName(fileName, 2), fileName)
+	}
+
+	// the segment 2 has the latest records of the books
+	if err := store.DropSegment(2); !errors.Is(err, ErrSegmentLive) {
+		t.Errorf("DropSegment(2) error = %v, want %v", err, ErrSegmentLive)
+	}
+	if err := store.DropSegment(3); err == nil {
+		t.Errorf("DropSegment() of the active segment error = nil, want an error")
+	}
+	if err := store.DropSegment(1); err != nil {
+		t.Fatalf("DropSegment(1) error = %v", err)
+	}
+	if infos, _ := store.Segments(); len(infos) != 2 || infos[0].ID != 2 {
+		t.Errorf("Segments() after DropSegment() = %+v, want the segments 2 and 3", infos)
+	}
+	for key, val := range map[string]string{"crime and punishment": "fyodor dostoevsky", "anna karenina": "leo tolstoy"} {
+		if got, _ := store.Get(key); got != val {
+			t.Errorf("Get() = %v, want %v", got, val)
+		}
+	}
+}
+
+func TestDiskStore_DropSegmentHidingRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Rotate()
+	store.Delete("hamlet")
+	store.Rotate()
+	store.Set("othello", "shakespeare")
+
+	// the delete in the segment 2 hides the record in the segment 1
+	if err := store.DropSegment(2); !errors.Is(err, ErrSegmentLive) {
+		t.Errorf("DropSegment(2) error = %v, want %v", err, ErrSegmentLive)
+	}
+	if err := store.DropSegment(1); err != nil {
+		t.Fatalf("DropSegment(1) error = %v", err)
+	}
+	if err := store.DropSegment(2); err != nil {
+		t.Errorf("DropSegment(2) after the older record is gone error = %v", err)
+	}
+}
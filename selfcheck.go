@@ -0,0 +1,80 @@
+package caskdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SelfCheckError is returned by SelfCheck, it lists how the keyDir differs from the
+// index built by a fresh scan
+type SelfCheckError struct {
+	// Diffs has one line for every key which differs, sorted by the key
+	Diffs []string
+}
+
+func (e *SelfCheckError) Error() string {
+	return fmt.Sprintf("caskdb: keyDir differs from the segments in %d keys:\n%s", len(e.Diffs), strings.Join(e.Diffs, "\n"))
+}
+
+// SelfCheck verifies the keyDir against the segments. It builds a throwaway index by
+// scanning all the segments, exactly like the startup, and compares it with the
+// live keyDir key by key: the segment, the offset, the size, the timestamp and the
+// expiry of every KeyEntry. It returns nil if they are the same, or a
+// *SelfCheckError with the keys which differ.
+//
+// The keyDir is updated by many code paths, like Set, Merge, the retention and the
+// eviction. Any bug in them which leaves the keyDir pointing to the wrong record
+// shows up here. The expired keys, and with WithMaxIndexKeys the evicted ones, are
+// not counted as a difference.
+//
+// The read lock is held for the entire check, nothing is modified.
+func (d *DiskStore) SelfCheck() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	fresh := newKeyIndex(d.opts)
+	defer closeIndex(fresh)
+	for _, seg := range d.allSegments() {
+		if _, _, err := scanKeyDir(seg.file, seg.size, seg.version, seg.id, fresh, nil, nil); err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	var diffs []string
+	d.keyDir.forEach(func(key string, kEntry KeyEntry) bool {
+		if kEntry.expired(now) {
+			return true
+		}
+		want, ok := fresh.get(key)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%q: keyDir has %+v, the segments have none", key, kEntry))
+		case want != kEntry:
+			diffs = append(diffs, fmt.Sprintf("%q: keyDir has %+v, the segments have %+v", key, kEntry, want))
+		}
+		return true
+	})
+	fresh.forEach(func(key string, want KeyEntry) bool {
+		if _, ok := d.keyDir.get(key); ok || want.expired(now) {
+			return true
+		}
+		if d.evicted != nil && d.evicted.mayContain(key) {
+			return true
+		}
+		diffs = append(diffs, fmt.Sprintf("%q: keyDir has none, the segments have %+v", key, want))
+		return true
+	})
+	// the diffs are of no use if either index couldn't be read
+	if err := indexErr(fresh); err != nil {
+		return err
+	}
+	if err := indexErr(d.keyDir); err != nil {
+		return err
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	return &SelfCheckError{Diffs: diffs}
+}
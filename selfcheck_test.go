@@ -0,0 +1,38 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SelfCheck(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("crime and punishment", "dostoevsky")
+	store.Set("anna karenina", "tolstoy")
+	store.Set("anna karenina", "leo tolstoy")
+	store.SetWithTTL("hamlet", "shakespeare", time.Hour)
+	store.Delete("crime and punishment")
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if err := store.SelfCheck(); err != nil {
+		t.Errorf("SelfCheck() error = %v, want nil", err)
+	}
+
+	// point anna karenina to the record of hamlet
+	kEntry, _ := store.keyDir.get("hamlet")
+	store.keyDir.put("anna karenina", kEntry)
+	store.keyDir.delete("dune")
+	var serr *SelfCheckError
+	if err := store.SelfCheck(); !errors.As(err, &serr) || len(serr.Diffs) != 2 {
+		t.Errorf("SelfCheck() error = %v, want 2 diffs", err)
+	}
+}
@@ -0,0 +1,86 @@
+package caskdb
+
+import "io"
+
+// ShipSince writes the records appended to the store after the watermark to w, and
+// returns the watermark to ship from the next time. The zero watermark ships all the
+// records there are. Like DumpTo, the output is the file header followed by the
+// records in the current format, so a follower can apply it with Import. Unlike
+// DumpTo, it has every record in the order it was written, the overwritten ones and
+// the deletes too, which keeps the follower in step with the store:
+//
+//	var watermark uint64
+//	for {
+//		var buf bytes.Buffer
+//		watermark, err = store.ShipSince(watermark, &buf)
+//		...
+//		follower.Import(&buf)
+//	}
+//
+// The records are self-contained: a value stored once with WithDedup is shipped in
+// every record which refers to it, and the blob records are left out. The database
+// ID at the start of every segment is shipped too, Import leaves it out.
+//
+// The watermark is the id of a segment in the upper 32 bits, and an offset in it
+// in the lower ones. The ids stay the same across a restart, see renumberActive.
+// Merge, ReplaceAll and CompactSmallSegments rewrite the files, a watermark from
+// before them is meaningless and the follower starts over from zero. A watermark
+// past the end of the store, which is the case after a Merge, is refused with
+// ErrStaleWatermark. The read lock is held while shipping.
+func (d *DiskStore) ShipSince(watermark uint64, w io.Writer) (uint64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	fileID, position := uint32(watermark>>32), int64(uint32(watermark))
+	if fileID > d.activeID || fileID == d.activeID && position > int64(d.writePosition) {
+		return watermark, ErrStaleWatermark
+	}
+	if _, err := w.Write(encodeFileHeader(currentFormat)); err != nil {
+		return watermark, err
+	}
+	var buf []byte
+	for _, seg := range d.allSegments() {
+		if seg.id < fileID {
+			continue
+		}
+		start := int64(dataStartOf(seg.version))
+		if seg.id == fileID && position > start {
+			start = position
+		}
+		hSize := headerSizeOf(seg.version)
+		_, err := forEachRecordFrom(seg.file, start, seg.size, seg.version, func(position int, h recordHeader, _ []byte) error {
+			// the values of the blobs go along with the refs to them
+			if h.flags&flagBlob != 0 {
+				return nil
+			}
+			totalSize := hSize + h.keySize + h.valueSize
+			if cap(buf) < int(totalSize) {
+				buf = make([]byte, totalSize)
+			}
+			record := buf[:totalSize]
+			if err := readFull(seg.file, record, int64(position)); err != nil {
+				return err
+			}
+			if !validChecksum(record, seg.version) {
+				return ErrChecksumMismatch
+			}
+			// the records of an older format are converted to the current one. A ref
+			// is resolved, the blob need not be in the follower's segment, and a link
+			// of the digest is dropped, the follower keeps its own, see WithDigest
+			if seg.version != currentFormat || h.flags&(flagRef|flagChained) != 0 {
+				h, key, value, err := d.decodeRecord(seg.id, record, seg.version)
+				if err != nil {
+					return err
+				}
+				h.flags &^= flagChained
+				h.chain = 0
+				_, record = encodeRecord(h, key, value)
+			}
+			_, err := w.Write(record)
+			return err
+		})
+		if err != nil {
+			return watermark, err
+		}
+	}
+	return uint64(d.activeID)<<32 | uint64(d.writePosition), nil
+}
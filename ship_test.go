@@ -0,0 +1,176 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_ShipSince(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	follower, err := NewDiskStore(filepath.Join(dir, "follower.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer follower.Close()
+
+	store.Set("crime and punishment", "dostoevsky")
+	store.Set("anna karenina", "tolstoy")
+	var buf bytes.Buffer
+	watermark, err := store.ShipSince(0, &buf)
+	if err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	if err := follower.Import(&buf); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+
+	store.Set("hamlet", "shakespeare")
+	store.Rotate()
+	store.Set("anna karenina", "leo tolstoy")
+	store.Delete("crime and punishment")
+	buf.Reset()
+	next, err := store.ShipSince(watermark, &buf)
+	if err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	// exactly the three records after the watermark
+	_, hamlet := encodeKV(0, "hamlet", "shakespeare")
+	_, anna := encodeKV(0, "anna karenina", "leo tolstoy")
+	_, tombstone := encodeRecord(recordHeader{flags: flagTombstone}, "crime and punishment", "")
+	if want := fileHeaderSize + len(hamlet) + len(anna) + len(tombstone); buf.Len() != want {
+		t.Errorf("ShipSince() wrote %v bytes, want %v", buf.Len(), want)
+	}
+	if want := uint64(2)<<32 | uint64(fileHeaderSize+len(anna)+len(tombstone)); next != want {
+		t.Errorf("ShipSince() watermark = %x, want %x", next, want)
+	}
+	if err := follower.Import(&buf); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	got, want := follower.Keys(), store.Keys()
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("follower Keys() = %v, want %v", got, want)
+	}
+	if val, _ := follower.Get("anna karenina"); val != "leo tolstoy" {
+		t.Errorf("follower Get() = %v, want %v", val, "leo tolstoy")
+	}
+
+	// nothing new to ship
+	buf.Reset()
+	if again, _ := store.ShipSince(next, &buf); again != next || buf.Len() != fileHeaderSize {
+		t.Errorf("ShipSince() with nothing new = %x and %v bytes, want %x and %v bytes", again, buf.Len(), next, fileHeaderSize)
+	}
+}
+
+func TestDiskStore_ShipSinceAfterMerge(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("crime and punishment", "dostoevsky")
+	store.Rotate()
+	store.Set("anna karenina", "tolstoy")
+	var buf bytes.Buffer
+	stale, err := store.ShipSince(0, &buf)
+	if err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if _, err := store.ShipSince(stale, &buf); !errors.Is(err, ErrStaleWatermark) {
+		t.Errorf("ShipSince() of a watermark from before Merge() error = %v, want %v", err, ErrStaleWatermark)
+	}
+	watermark, err := store.ShipSince(0, &buf)
+	if err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	store.Close()
+
+	// the watermark is still good after a restart
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	buf.Reset()
+	if _, err := store.ShipSince(watermark, &buf); err != nil {
+		t.Fatalf("ShipSince() after reopen error = %v", err)
+	}
+	_, hamlet := encodeKV(0, "hamlet", "shakespeare")
+	if want := fileHeaderSize + len(hamlet); buf.Len() != want {
+		t.Errorf("ShipSince() after reopen wrote %v bytes, want %v", buf.Len(), want)
+	}
+}
+
+func TestDiskStore_ShipSinceDedup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"), WithDedup(), WithDigest())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	followerName := filepath.Join(dir, "follower.db")
+	follower, err := NewDiskStore(followerName, WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("call me ishmael. ", 10)
+	store.Set("a", value)
+	var buf bytes.Buffer
+	watermark, err := store.ShipSince(0, &buf)
+	if err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	if err := follower.Import(&buf); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	follower.Rotate()
+
+	// a ref to the blob which went with the last shipment
+	store.Set("b", value)
+	buf.Reset()
+	if _, err := store.ShipSince(watermark, &buf); err != nil {
+		t.Fatalf("ShipSince() error = %v", err)
+	}
+	// plain records alone, without the refs, the blobs or the links of the digest
+	data := buf.Bytes()
+	for position := fileHeaderSize; position < len(data); {
+		h := decodeHeader(data[position:position+headerSize], currentFormat)
+		if h.flags&(flagRef|flagBlob|flagChained) != 0 {
+			t.Errorf("ShipSince() record at %v flags = %v, want no ref, blob or chain", position, h.flags)
+		}
+		position += headerSize + int(h.keySize+h.valueSize)
+	}
+	if err := follower.Import(&buf); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if got, err := follower.Get("b"); err != nil || got != value {
+		t.Errorf("Get() = %v, %v, want %v, nil", got, err, value)
+	}
+	follower.Close()
+
+	follower, err = NewDiskStore(followerName, WithDedup())
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer follower.Close()
+	for _, key := range []string{"a", "b"} {
+		if got, err := follower.Get(key); err != nil || got != value {
+			t.Errorf("Get(%v) after reopen = %v, %v, want %v, nil", key, got, err, value)
+		}
+	}
+}
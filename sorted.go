@@ -0,0 +1,66 @@
+package caskdb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// SortedKeys returns all the keys in the store in the order of the comparator, see
+// WithComparator. The keyDir is a hash table, so this sorts a snapshot of the keys
+// on every call.
+func (d *DiskStore) SortedKeys() []string {
+	keys := d.Keys()
+	cmp := d.comparator()
+	sort.Slice(keys, func(i, j int) bool { return cmp(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+// ForEachSorted calls fn with every key and its value, in the order of the
+// comparator, till fn returns false. Like Iterator, it goes over a snapshot of the
+// keys, and reads the latest value of each. The keys deleted in the meanwhile are
+// skipped.
+func (d *DiskStore) ForEachSorted(fn func(key, value string) bool) error {
+	return d.forEachOf(d.SortedKeys(), fn)
+}
+
+// Range is ForEachSorted over the keys from start, inclusive, till end, exclusive, as
+// per the comparator. An empty end means no upper bound.
+func (d *DiskStore) Range(start, end string, fn func(key, value string) bool) error {
+	cmp := d.comparator()
+	keys := d.SortedKeys()
+	from := sort.Search(len(keys), func(i int) bool { return cmp(keys[i], start) >= 0 })
+	to := len(keys)
+	if end != "" {
+		to = sort.Search(len(keys), func(i int) bool { return cmp(keys[i], end) >= 0 })
+	}
+	if to < from {
+		return nil
+	}
+	return d.forEachOf(keys[from:to], fn)
+}
+
+// forEachOf calls fn with the keys and their values, in the given order
+func (d *DiskStore) forEachOf(keys []string, fn func(key, value string) bool) error {
+	for _, key := range keys {
+		value, err := d.Get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// comparator returns the comparator of the sorted scans, the byte order by default
+func (d *DiskStore) comparator() func(a, b string) int {
+	if d.opts.comparator != nil {
+		return d.opts.comparator
+	}
+	return strings.Compare
+}
@@ -0,0 +1,48 @@
+package caskdb
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDiskStore_WithComparator(t *testing.T) {
+	numeric := func(a, b string) int {
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x - y
+	}
+	store, err := NewDiskStore("test.db", WithComparator(numeric))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	for _, key := range []string{"2", "10", "1"} {
+		store.Set(key, "value-"+key)
+	}
+
+	if got, want := store.SortedKeys(), []string{"1", "2", "10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SortedKeys() = %v, want %v", got, want)
+	}
+	var got []string
+	store.ForEachSorted(func(key, value string) bool {
+		if value != "value-"+key {
+			t.Errorf("ForEachSorted() value = %v, want %v", value, "value-"+key)
+		}
+		got = append(got, key)
+		return true
+	})
+	if want := []string{"1", "2", "10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachSorted() keys = %v, want %v", got, want)
+	}
+	got = nil
+	store.Range("2", "", func(key, value string) bool {
+		got = append(got, key)
+		return true
+	})
+	if want := []string{"2", "10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() keys = %v, want %v", got, want)
+	}
+}
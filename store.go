@@ -1,7 +1,8 @@
 package caskdb
 
 type Store interface {
-	Get(key string) string
-	Set(key string, value string)
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	Delete(key string) error
 	Close() bool
 }
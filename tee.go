@@ -0,0 +1,70 @@
+package caskdb
+
+import "log"
+
+// SecondaryErrorPolicy decides what TeeStore does when a write to the secondary
+// store fails.
+type SecondaryErrorPolicy int
+
+const (
+	// FailOnSecondaryError makes the write return the secondary's error. The write
+	// to the primary has happened already, it is not undone.
+	FailOnSecondaryError SecondaryErrorPolicy = iota
+	// LogSecondaryError logs the secondary's error and carries on, the write
+	// succeeds as long as the primary took it. The secondary falls behind, which
+	// suits a best effort standby.
+	LogSecondaryError
+)
+
+// TeeStore is a Store which writes to two stores, and reads from the first one, the
+// primary. It is meant for moving the data to a new store, or keeping a hot
+// standby: every Set and Delete goes to the primary first, and then to the
+// secondary. A write which fails on the primary is not sent to the secondary.
+//
+// The two writes are not atomic together, a reader of the secondary could see it
+// behind the primary.
+type TeeStore struct {
+	primary   Store
+	secondary Store
+	policy    SecondaryErrorPolicy
+}
+
+// NewTeeStore returns a TeeStore over the primary and the secondary stores, with
+// the policy for the failed writes to the secondary.
+func NewTeeStore(primary Store, secondary Store, policy SecondaryErrorPolicy) *TeeStore {
+	return &TeeStore{primary: primary, secondary: secondary, policy: policy}
+}
+
+func (t *TeeStore) Get(key string) (string, error) {
+	return t.primary.Get(key)
+}
+
+func (t *TeeStore) Set(key string, value string) error {
+	if err := t.primary.Set(key, value); err != nil {
+		return err
+	}
+	return t.secondaryError(key, t.secondary.Set(key, value))
+}
+
+func (t *TeeStore) Delete(key string) error {
+	if err := t.primary.Delete(key); err != nil {
+		return err
+	}
+	return t.secondaryError(key, t.secondary.Delete(key))
+}
+
+// Close closes both the stores, it returns true only if both were closed.
+func (t *TeeStore) Close() bool {
+	ok := t.primary.Close()
+	return t.secondary.Close() && ok
+}
+
+// secondaryError applies the policy to the error of a write of the key to the
+// secondary
+func (t *TeeStore) secondaryError(key string, err error) error {
+	if err == nil || t.policy == FailOnSecondaryError {
+		return err
+	}
+	log.Printf("caskdb: write of %q to the secondary store failed: %v", key, err)
+	return nil
+}
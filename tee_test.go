@@ -0,0 +1,69 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// brokenStore is a Store whose writes fail
+type brokenStore struct {
+	MemoryStore
+}
+
+var errBroken = errors.New("broken store")
+
+func (b *brokenStore) Set(key string, value string) error {
+	return errBroken
+}
+
+func (b *brokenStore) Delete(key string) error {
+	return errBroken
+}
+
+func TestTeeStore(t *testing.T) {
+	primary, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	secondary := NewMemoryStore()
+	store := NewTeeStore(primary, secondary, FailOnSecondaryError)
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if err := store.Delete("dune"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for _, backend := range []Store{primary, secondary, store} {
+		if val, _ := backend.Get("hamlet"); val != "shakespeare" {
+			t.Errorf("Get() = %v, want %v", val, "shakespeare")
+		}
+		if _, err := backend.Get("dune"); err != ErrKeyNotFound {
+			t.Errorf("Get() of a deleted key error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+}
+
+func TestTeeStore_SecondaryError(t *testing.T) {
+	tests := []struct {
+		policy SecondaryErrorPolicy
+		want   error
+	}{
+		{FailOnSecondaryError, errBroken},
+		{LogSecondaryError, nil},
+	}
+	for _, tt := range tests {
+		primary := NewMemoryStore()
+		store := NewTeeStore(primary, &brokenStore{}, tt.policy)
+		if err := store.Set("hamlet", "shakespeare"); err != tt.want {
+			t.Errorf("Set() error = %v, want %v", err, tt.want)
+		}
+		// the primary took the write either way
+		if val, _ := primary.Get("hamlet"); val != "shakespeare" {
+			t.Errorf("Get() = %v, want %v", val, "shakespeare")
+		}
+		if err := store.Delete("hamlet"); err != tt.want {
+			t.Errorf("Delete() error = %v, want %v", err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package caskdb
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// With WithColdTier, Merge splits the live records in two tiers by the time the keys
+// were last accessed:
+//
+//	books.db.7   cold tier, compressed
+//	books.db     hot tier, the active segment, id 8
+//
+// The cold tier is a sealed segment like any other, written by the merge right
+// before the new active segment, so Get reads from either tier the same way. Its
+// values are compressed whatever the options are, it is written once and read
+// rarely. A deduplicated value of WithDedup is stored in full in the cold tier, the
+// blob stays with the hot keys referring to it.
+//
+// A key is accessed by a write or a read of its value. The time of the last write is
+// the timestamp of the record, the reads are tracked in the memory. So the reads
+// before a restart are forgotten, and the key is as cold as its last write then. A
+// cold key read after a merge stays in the cold tier, till the next merge moves it
+// back to the hot one.
+
+// coldSuffix is appended to the file name to get the name of the temporary file the
+// cold tier is written to
+const coldSuffix = ".cold"
+
+// accessTimes has the time of the last read of the keys, see WithColdTier. The reads
+// run concurrently under the read lock, so it has a lock of its own.
+type accessTimes struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+func newAccessTimes() *accessTimes {
+	return &accessTimes{last: make(map[string]uint64)}
+}
+
+// touch records a read of the key, at now in unix epoch seconds
+func (a *accessTimes) touch(key string, now uint64) {
+	a.mu.Lock()
+	a.last[key] = now
+	a.mu.Unlock()
+}
+
+// lastAccess returns the time of the last read or write of the key, whichever is
+// later
+func (a *accessTimes) lastAccess(key string, kEntry KeyEntry) uint64 {
+	a.mu.Lock()
+	last := a.last[key]
+	a.mu.Unlock()
+	if kEntry.timestamp > last {
+		return kEntry.timestamp
+	}
+	return last
+}
+
+// prune forgets the keys which are not in the keyDir anymore
+func (a *accessTimes) prune(keyDir keyIndex) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key := range a.last {
+		if _, ok := keyDir.get(key); !ok {
+			delete(a.last, key)
+		}
+	}
+}
+
+// touch records a read of the key, with WithColdTier. It is safe to call under the
+// read lock.
+func (d *DiskStore) touch(key string) {
+	if d.access != nil {
+		d.access.touch(key, uint64(time.Now().Unix()))
+	}
+}
+
+// mergeTiered is Merge with WithColdTier. The hot keys are copied to the new active
+// segment like Merge does, and the cold ones to the cold tier, which takes the id of
+// the current active segment. The cold tier is in place before the new active
+// segment is swapped in: if we crash in between, the next start loads it before the
+// current active segment, which has nothing older than it for the cold keys. The
+// caller must hold the write lock.
+func (d *DiskStore) mergeTiered() error {
+	cutoff := uint64(time.Now().Add(-d.opts.coldAfter).Unix())
+	cold := func(key string, kEntry KeyEntry) bool {
+		return d.access.lastAccess(key, kEntry) < cutoff
+	}
+	coldID := d.activeID
+	err := d.replaceFiles(d.version, func(dst File) (keyIndex, int, *segment, error) {
+		coldDir := newKeyIndex(d.opts)
+		defer closeIndex(coldDir)
+		seg, err := d.writeColdTier(coldID, coldDir, cold)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		// without any cold keys, the new active segment keeps the id
+		hotID := coldID
+		if seg != nil {
+			hotID++
+		}
+		keyDir, writePosition, err := d.copyLiveIn(dst, d.version, hotID, cold)
+		if err != nil {
+			d.removeSegmentFile(seg)
+			return nil, 0, nil, err
+		}
+		coldDir.forEach(func(key string, kEntry KeyEntry) bool {
+			keyDir.put(key, kEntry)
+			return true
+		})
+		return keyDir, writePosition, seg, nil
+	})
+	if err != nil {
+		return err
+	}
+	d.access.prune(d.keyDir)
+	return nil
+}
+
+// writeColdTier writes the live records of the cold keys to a new sealed segment
+// with the given id, in the current format and compressed, and puts their
+// KeyEntries in keyDir. It returns the segment, opened, or nil if there are no cold
+// keys. The caller must hold the write lock.
+func (d *DiskStore) writeColdTier(id uint32, keyDir keyIndex, cold func(key string, kEntry KeyEntry) bool) (*segment, error) {
+	fsys := d.opts.fileSystem
+	tmpName := d.fileName + coldSuffix
+	tmp, err := fsys.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	entries, newest, err := d.copyCold(tmp, id, keyDir, cold)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && entries > 0 {
+		err = fsys.Rename(tmpName, segmentName(d.fileName, id))
+	}
+	if err != nil || entries == 0 {
+		fsys.Remove(tmpName)
+		return nil, err
+	}
+	seg, err := d.openSegment(id)
+	if err != nil {
+		fsys.Remove(segmentName(d.fileName, id))
+		return nil, err
+	}
+	seg.newest = newest
+	return seg, nil
+}
+
+// copyCold writes the file header and the live records of the cold keys to dst, see
+// writeColdTier. It returns the number of the records written, and the newest
+// timestamp of them.
+func (d *DiskStore) copyCold(dst File, id uint32, keyDir keyIndex, cold func(key string, kEntry KeyEntry) bool) (int, uint64, error) {
+	if _, err := dst.Write(encodeFileHeader(currentFormat)); err != nil {
+		return 0, 0, err
+	}
+	writePosition := fileHeaderSize
+	if record := d.idRecord(currentFormat); record != nil {
+		if _, err := dst.Write(record); err != nil {
+			return 0, 0, err
+		}
+		writePosition += len(record)
+	}
+	entries := 0
+	var newest uint64
+	for _, seg := range d.allSegments() {
+		_, err := forEachRecord(seg.file, seg.size, seg.version, func(position int, _ recordHeader, key []byte) error {
+			kEntry, ok := d.keyDir.get(string(key))
+			if !ok || kEntry.fileID != seg.id || kEntry.position != uint32(position) || !cold(string(key), kEntry) {
+				return nil
+			}
+			data, version, err := d.readRecord(kEntry)
+			if err != nil {
+				return err
+			}
+			if !validChecksum(data, version) {
+				return ErrChecksumMismatch
+			}
+			h, name, value, err := d.decodeRecord(kEntry.fileID, data, version)
+			if err != nil {
+				return err
+			}
+			h.flags |= flagCompressed
+			_, record := encodeRecord(h, name, value)
+			if _, err := dst.Write(record); err != nil {
+				return err
+			}
+			newEntry := NewKeyEntry(id, kEntry.timestamp, uint32(writePosition), uint32(len(record)))
+			newEntry.expiry = kEntry.expiry
+			keyDir.put(name, newEntry)
+			writePosition += len(record)
+			entries++
+			if h.timestamp > newest {
+				newest = h.timestamp
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return entries, newest, nil
+}
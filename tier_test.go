@@ -0,0 +1,100 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_WithColdTier(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName, WithColdTier(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("the old man and the sea. ", 20)
+	// the records written a day ago, and not read since
+	old := uint64(time.Now().Add(-24 * time.Hour).Unix())
+	for i := 0; i < 10; i++ {
+		_, record := encodeRecord(recordHeader{timestamp: old}, fmt.Sprintf("cold %d", i), value)
+		if err := store.ApplyRecord(record); err != nil {
+			t.Fatalf("ApplyRecord() error = %v", err)
+		}
+	}
+	_, record := encodeRecord(recordHeader{timestamp: old}, "read", value)
+	store.ApplyRecord(record)
+	store.Get("read")
+	store.Set("written", value)
+
+	// the reads run along with the merge
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if got, err := store.Get("written"); err != nil || got != value {
+					t.Errorf("Get() = %v, %v, want the value", len(got), err)
+				}
+			}
+		}()
+	}
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	wg.Wait()
+
+	tierOf := func(key string) string {
+		kEntry, ok := store.keyDir.get(key)
+		if !ok {
+			t.Fatalf("keyDir has no %q", key)
+		}
+		if kEntry.fileID == store.activeID {
+			return "hot"
+		}
+		return "cold"
+	}
+	for _, key := range []string{"cold 0", "cold 9", "read", "written"} {
+		want := "hot"
+		if strings.HasPrefix(key, "cold") {
+			want = "cold"
+		}
+		if got := tierOf(key); got != want {
+			t.Errorf("tier of %q = %v, want %v", key, got, want)
+		}
+	}
+	if segments, _ := store.Segments(); len(segments) != 2 {
+		t.Errorf("Segments() = %v, want the cold tier and the active segment", segments)
+	}
+	kEntry, _ := store.keyDir.get("cold 0")
+	if data, version, err := store.readRecord(kEntry); err != nil || decodeHeader(data, version).flags&flagCompressed == 0 {
+		t.Errorf("record of a cold key = %v, want it compressed", err)
+	}
+	for i := 0; i < 10; i++ {
+		if got, err := store.Get(fmt.Sprintf("cold %d", i)); err != nil || got != value {
+			t.Errorf("Get() of a cold key = %v, %v, want the value", len(got), err)
+		}
+	}
+	// the cold keys read since move back to the hot tier with the next merge
+	if err := store.Merge(); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if got := tierOf("cold 0"); got != "hot" {
+		t.Errorf("tier of a cold key read since = %v, want hot", got)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"cold 0", "cold 9", "read", "written"} {
+		if got, err := store.Get(key); err != nil || got != value {
+			t.Errorf("Get() after reopen = %v, %v, want the value", len(got), err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package caskdb
+
+import "fmt"
+
+// VerifyError is returned by Verify, it tells where the first problem is
+type VerifyError struct {
+	// File is the name of the segment file with the problem
+	File string
+	// Offset is the byte offset in the file where the problem starts
+	Offset int64
+	// Err is ErrChecksumMismatch or ErrMisaligned
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%v in %s at offset %d", e.Err, e.File, e.Offset)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Verify reads all the segments and checks them for corruption. It returns nil if
+// they are fine, or a *VerifyError with the file and the offset of the first
+// problem.
+//
+// Two things are checked:
+//
+//   - every record matches its checksum
+//   - the records line up with the file: starting from the first record, the size
+//     of every record takes us exactly to the start of the next one, and the last
+//     one ends exactly at the end of the file
+//
+// The second one is a structural check for the whole file, it catches what the
+// checksums can't. Say, a byte gets inserted in between two records. All the
+// records after it are read from the wrong offset, and the sizes read from their
+// headers are garbage, which takes us past the end of the file. It also catches the
+// trailing garbage, like a torn write at the end. The files of formatV1 don't have
+// the checksums, so this is the only check we can do on them.
+//
+// The read lock is held for the entire check.
+func (d *DiskStore) Verify() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, seg := range d.allSegments() {
+		if err := verifySegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySegment does the checks of Verify on a single segment
+func verifySegment(seg *segment) error {
+	stat, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+	var corrupt *VerifyError
+	end, err := forEachRecord(seg.file, size, seg.version, func(position int, h recordHeader, _ []byte) error {
+		data := make([]byte, headerSizeOf(seg.version)+h.keySize+h.valueSize)
+		if _, err := seg.file.ReadAt(data, int64(position)); err != nil {
+			return err
+		}
+		if !validChecksum(data, seg.version) {
+			corrupt = &VerifyError{File: seg.name, Offset: int64(position), Err: ErrChecksumMismatch}
+			return corrupt
+		}
+		return nil
+	})
+	if corrupt != nil {
+		return corrupt
+	}
+	if err != nil {
+		return err
+	}
+	// the scan stops at the first record which does not fit in the file
+	if int64(end) != size {
+		return &VerifyError{File: seg.name, Offset: int64(end), Err: ErrMisaligned}
+	}
+	return nil
+}
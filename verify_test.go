@@ -0,0 +1,85 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Verify(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if err := store.Verify(); err != nil {
+		t.Errorf("Verify() error = %v, want nil", err)
+	}
+
+	// flip a byte in the value of dune
+	kEntry, _ := store.keyDir.get("dune")
+	file, err := os.OpenFile("test.db", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	file.WriteAt([]byte{'?'}, int64(kEntry.position+kEntry.totalSize-1))
+	file.Close()
+	var verr *VerifyError
+	if err := store.Verify(); !errors.As(err, &verr) || verr.Err != ErrChecksumMismatch || verr.Offset != int64(kEntry.position) {
+		t.Errorf("Verify() error = %v, want %v at offset %v", err, ErrChecksumMismatch, kEntry.position)
+	}
+}
+
+func TestDiskStore_VerifyInsertedByte(t *testing.T) {
+	// the formatV1 files have no checksums, only the alignment check can find the
+	// inserted byte
+	var data []byte
+	var offset int
+	for i, kv := range [][2]string{{"hamlet", "shakespeare"}, {"dune", "frank herbert"}, {"othello", "shakespeare"}} {
+		_, record := encodeKVV1(uint64(time.Now().Unix()), kv[0], kv[1])
+		if i == 1 {
+			offset = len(data)
+			data = append(data, 0xff)
+		}
+		data = append(data, record...)
+	}
+	if err := os.WriteFile("test.db", data, 0666); err != nil {
+		t.Fatalf("failed to write the db file: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	var verr *VerifyError
+	if err := store.Verify(); !errors.As(err, &verr) || verr.Err != ErrMisaligned || verr.Offset != int64(offset) {
+		t.Errorf("Verify() error = %v, want %v at offset %v", err, ErrMisaligned, offset)
+	}
+}
+
+func TestDiskStore_VerifyTrailingGarbage(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	stat, _ := os.Stat("test.db")
+	file, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open the db file: %v", err)
+	}
+	file.Write([]byte("garbage"))
+	file.Close()
+	var verr *VerifyError
+	if err := store.Verify(); !errors.As(err, &verr) || verr.Err != ErrMisaligned || verr.Offset != stat.Size() {
+		t.Errorf("Verify() error = %v, want %v at offset %v", err, ErrMisaligned, stat.Size())
+	}
+}
@@ -0,0 +1,202 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+// With WithWAL, every write goes to a write-ahead log first. The WAL is a plain
+// sequential file next to the database file, `<file name>.wal`, and a write is
+// durable once it is appended to the WAL and the WAL is synced. The record is then
+// written to the active segment without waiting for its fsync. The active segment
+// is synced at a checkpoint, when the WAL grows past walCheckpointSize, at Rotate,
+// Merge and Close, and the WAL is emptied after it.
+//
+// The WAL starts with the file header, followed by the entries:
+//
+//	┌─────────┬─────────────┬──────────────┬─────────────┬─────────┐
+//	│ crc(4B) │ file_id(4B) │ position(8B) │ length(4B)  │ records │
+//	└─────────┴─────────────┴──────────────┴─────────────┴─────────┘
+//
+// The records are exactly as written to the segment file_id at the position, in the
+// format of that segment. An entry has a single record, or all the records of a
+// Batch. The crc covers everything after it. At the startup, the
+// entries of the active segment which are past the end of it, i.e. the ones which
+// didn't make it to the segment before a crash, are written to it again.
+
+const (
+	// walSuffix is appended to the file name to get the name of the WAL
+	walSuffix = ".wal"
+	// walEntryHeaderSize is the size of the entry header before the record
+	walEntryHeaderSize = 20
+	// walCheckpointSize is the size of the WAL past which a checkpoint is done
+	walCheckpointSize = 4 << 20
+)
+
+// writeAheadLog is the open WAL
+type writeAheadLog struct {
+	file File
+	size int64
+}
+
+// openWAL opens the WAL, replays its entries which are not in the active segment and
+// checkpoints. The keyDir must be loaded already.
+func (d *DiskStore) openWAL() error {
+	file, err := d.opts.fileSystem.OpenFile(d.fileName+walSuffix, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	d.wal = &writeAheadLog{file: file}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > fileHeaderSize {
+		if err := d.replayWAL(stat.Size()); err != nil {
+			return err
+		}
+	}
+	return d.checkpointWAL()
+}
+
+// replayWAL writes the entries of the WAL missing from the active segment to it
+func (d *DiskStore) replayWAL(size int64) error {
+	r := d.wal.file
+	header := make([]byte, walEntryHeaderSize)
+	replayed := false
+	for position := int64(fileHeaderSize); position+walEntryHeaderSize <= size; {
+		if err := readFull(r, header, position); err != nil {
+			return err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[16:20]))
+		if position+walEntryHeaderSize+length > size {
+			break
+		}
+		entry := make([]byte, walEntryHeaderSize+length)
+		if err := readFull(r, entry, position); err != nil {
+			return err
+		}
+		// a torn entry at the end, the write of it never returned
+		if binary.LittleEndian.Uint32(entry[0:4]) != crc32.ChecksumIEEE(entry[4:]) {
+			break
+		}
+		position += int64(len(entry))
+		fileID := binary.LittleEndian.Uint32(entry[4:8])
+		at := binary.LittleEndian.Uint64(entry[8:16])
+		// the entries of the sealed segments were synced when they were sealed, and
+		// the ones before the write position made it to the segment
+		if fileID != d.activeID || at < uint64(d.writePosition) {
+			continue
+		}
+		if !replayed {
+			// cut off a partial record at the end, the entries go right after the
+			// last complete one
+			if err := d.file.Truncate(int64(d.writePosition)); err != nil {
+				return err
+			}
+			replayed = true
+		}
+		records := entry[walEntryHeaderSize:]
+		if _, err := d.file.Write(records); err != nil {
+			return err
+		}
+		hSize := headerSizeOf(d.version)
+		_, err := forEachRecordFrom(bytes.NewReader(records), 0, int64(len(records)), d.version, func(_ int, h recordHeader, key []byte) error {
+			d.indexRecord(h, string(key), int(hSize+h.keySize+h.valueSize))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWAL appends the records to the WAL, syncs it and then writes the records to
+// the active segment without a sync. The caller must hold the write lock.
+func (d *DiskStore) writeWAL(data []byte) error {
+	entry := make([]byte, walEntryHeaderSize, walEntryHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(entry[4:8], d.activeID)
+	binary.LittleEndian.PutUint64(entry[8:16], uint64(d.writePosition))
+	binary.LittleEndian.PutUint32(entry[16:20], uint32(len(data)))
+	entry = append(entry, data...)
+	binary.LittleEndian.PutUint32(entry[0:4], crc32.ChecksumIEEE(entry[4:]))
+	if _, err := d.wal.file.Write(entry); err != nil {
+		d.wal.file.Truncate(d.wal.size)
+		return err
+	}
+	if err := d.wal.file.Sync(); err != nil {
+		d.wal.file.Truncate(d.wal.size)
+		return err
+	}
+	d.wal.size += int64(len(entry))
+	// the write is durable now, the WAL has it
+	if _, err := d.file.Write(data); err != nil {
+		d.file.Truncate(int64(d.writePosition))
+		d.wal.file.Truncate(d.wal.size - int64(len(entry)))
+		d.wal.size -= int64(len(entry))
+		return err
+	}
+	if d.idleFlush != nil {
+		d.idleFlush.Reset(d.opts.flushOnIdle)
+	}
+	if d.wal.size > walCheckpointSize {
+		// the write is done regardless, a failed checkpoint is retried at the next
+		// write
+		d.checkpointWAL()
+	}
+	return nil
+}
+
+// checkpointWAL syncs the active segment and empties the WAL, all of its entries are
+// durable in the segments after the sync. The caller must hold the write lock.
+func (d *DiskStore) checkpointWAL() error {
+	if d.wal == nil {
+		return nil
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	if err := d.wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.wal.file.Write(encodeFileHeader(currentFormat)); err != nil {
+		return err
+	}
+	if err := d.wal.file.Sync(); err != nil {
+		return err
+	}
+	d.wal.size = fileHeaderSize
+	return nil
+}
+
+// flushIdle checkpoints the WAL once the writes have gone quiet, see
+// WithFlushOnIdle. It runs on its own goroutine.
+func (d *DiskStore) flushIdle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// the store could have been closed while we waited for the lock
+	if d.wal == nil || d.wal.size <= fileHeaderSize {
+		return
+	}
+	// TODO: log the error, the next write resets the timer and we retry
+	d.checkpointWAL()
+}
+
+// closeWAL checkpoints and closes the WAL
+func (d *DiskStore) closeWAL() error {
+	if d.wal == nil {
+		return nil
+	}
+	if d.idleFlush != nil {
+		d.idleFlush.Stop()
+	}
+	err := d.checkpointWAL()
+	if closeErr := d.wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	d.wal = nil
+	return err
+}
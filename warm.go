@@ -0,0 +1,38 @@
+package caskdb
+
+import "io"
+
+// Warm loads the records of the given keys into the OS page cache, so that the
+// Gets which follow don't wait on the disk. It is meant for right after the
+// startup, when the hot set of keys is known. The keys which don't exist are
+// skipped.
+//
+// Where the OS supports it, Warm only hints to the kernel to read ahead the records,
+// with posix_fadvise, and returns without waiting for them. Elsewhere it reads the
+// records and throws them away. Either way, the values are not cached by the store
+// itself, see WithCacheSize for that.
+func (d *DiskStore) Warm(keys ...string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var buf []byte
+	for _, key := range keys {
+		kEntry, ok := d.keyDir.get(key)
+		if !ok {
+			continue
+		}
+		file, _, err := d.segmentFile(kEntry.fileID)
+		if err != nil {
+			return err
+		}
+		if adviseWillNeed(file, int64(kEntry.position), int64(kEntry.totalSize)) {
+			continue
+		}
+		if cap(buf) < int(kEntry.totalSize) {
+			buf = make([]byte, kEntry.totalSize)
+		}
+		if _, err := file.ReadAt(buf[:kEntry.totalSize], int64(kEntry.position)); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
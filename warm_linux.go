@@ -0,0 +1,20 @@
+//go:build linux && (amd64 || arm64)
+
+package caskdb
+
+import "syscall"
+
+// posixFadvWillNeed is POSIX_FADV_WILLNEED from fcntl.h
+const posixFadvWillNeed = 3
+
+// adviseWillNeed asks the kernel to read ahead the given range of the file into the
+// page cache. It reports false if the hint could not be given, say because the file
+// is not an OS file.
+func adviseWillNeed(file File, offset int64, length int64) bool {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return false
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), posixFadvWillNeed, 0, 0)
+	return errno == 0
+}
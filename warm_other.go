@@ -0,0 +1,8 @@
+//go:build !(linux && (amd64 || arm64))
+
+package caskdb
+
+// adviseWillNeed is not supported on this platform, Warm falls back to plain reads
+func adviseWillNeed(file File, offset int64, length int64) bool {
+	return false
+}
@@ -0,0 +1,33 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskStore_Warm(t *testing.T) {
+	for name, fsys := range map[string]FileSystem{"os": osFS{}, "memory": NewMemFS()} {
+		store, err := NewDiskStore("test.db", WithFileSystem(fsys))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		tests := map[string]string{
+			"crime and punishment": "dostoevsky",
+			"anna karenina":        "tolstoy",
+			"hamlet":               "shakespeare",
+		}
+		for key, val := range tests {
+			store.Set(key, val)
+		}
+		if err := store.Warm("hamlet", "anna karenina", "some rando key"); err != nil {
+			t.Errorf("%v: Warm() error = %v", name, err)
+		}
+		for key, val := range tests {
+			if got, _ := store.Get(key); got != val {
+				t.Errorf("%v: Get() = %v, want %v", name, got, val)
+			}
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}